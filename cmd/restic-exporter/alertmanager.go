@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+var alertmanagerRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "restic_exporter",
+		Subsystem: "alertmanager",
+		Name:      "requests_total",
+		Help:      "Requests posting alerts to Alertmanager by result",
+	},
+	[]string{"result"},
+)
+
+// alertmanagerConfig configures the Alertmanagers the alerts of the built-in
+// rules are sent to. All of them get every alert; an Alertmanager cluster
+// deduplicates them.
+type alertmanagerConfig struct {
+	URLs []string `yaml:"urls"`
+
+	Username        string `yaml:"username"`
+	PasswordFile    string `yaml:"password_file"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+
+	// Timeout of each request. It defaults to ten seconds.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Labels and Annotations are added to all alerts, taking precedence
+	// over those of the rules.
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	// GeneratorURL links alerts back to the exporter, e.g. to its
+	// /api/v1/alerts.
+	GeneratorURL string `yaml:"generator_url"`
+}
+
+func (a *alertmanagerConfig) validate() error {
+
+	if len(a.URLs) == 0 {
+		return errors.New("urls required")
+	}
+	for _, u := range a.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid url %q", redactURL(u))
+		}
+	}
+
+	if a.Username != "" && a.BearerTokenFile != "" {
+		return errors.New("username and bearer_token_file are mutually exclusive")
+	}
+	if (a.Username == "") != (a.PasswordFile == "") {
+		return errors.New("username and password_file required together")
+	}
+
+	if a.Timeout == 0 {
+		a.Timeout = 10 * time.Second
+	}
+
+	for name := range a.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// redactURL returns u without the password it may contain.
+func redactURL(u string) string {
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "<invalid>"
+	}
+
+	return parsed.Redacted()
+}
+
+// alertmanagerAlert is an alert of the Alertmanager v2 API.
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// sendAlerts posts the firing and resolved alerts to the Alertmanagers.
+// Firing alerts end after four evaluation intervals unless sent again, so
+// they resolve by themselves if the exporter goes away.
+func (a *alertmanagerConfig) sendAlerts(ctx context.Context, interval time.Duration, now time.Time) {
+
+	var payload []alertmanagerAlert
+	for _, al := range currentAlerts() {
+		var endsAt time.Time
+		switch al.State {
+		case "firing":
+			endsAt = now.Add(4 * interval)
+		case "resolved":
+			endsAt = *al.ResolvedAt
+		default:
+			continue
+		}
+
+		labels := map[string]string{}
+		for name, value := range al.Labels {
+			labels[name] = value
+		}
+		for name, value := range a.Labels {
+			labels[name] = value
+		}
+		annotations := map[string]string{}
+		for name, value := range al.Annotations {
+			annotations[name] = value
+		}
+		for name, value := range a.Annotations {
+			annotations[name] = value
+		}
+
+		payload = append(payload, alertmanagerAlert{
+			Labels:       labels,
+			Annotations:  annotations,
+			StartsAt:     *al.FiredAt,
+			EndsAt:       endsAt,
+			GeneratorURL: a.GeneratorURL,
+		})
+	}
+	if len(payload) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Encoding alerts failed", "err", err)
+		return
+	}
+
+	for _, u := range a.URLs {
+		if err := a.post(ctx, u, data); err != nil {
+			slog.Error("Sending alerts to Alertmanager failed", "url", redactURL(u), "err", err)
+			alertmanagerRequests.WithLabelValues("error").Inc()
+		} else {
+			alertmanagerRequests.WithLabelValues("success").Inc()
+		}
+	}
+}
+
+// post sends the encoded alerts to the Alertmanager at base.
+func (a *alertmanagerConfig) post(ctx context.Context, base string, data []byte) error {
+
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/api/v2/alerts", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "restic-exporter/"+version)
+
+	// credentials are read on every request, so rotated ones are picked up
+	if a.Username != "" {
+		password, err := readSecretFile(a.PasswordFile)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(a.Username, password)
+	}
+	if a.BearerTokenFile != "" {
+		token, err := readSecretFile(a.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alertmanager responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// alertRuleTypes are the conditions alert rules can check.
+var alertRuleTypes = []string{"backup_age", "probe_failed", "check_failed", "restore_test_failed", "repository_size"}
+
+// resolvedAlertRetention is how long resolved alerts are still listed.
+const resolvedAlertRetention = 15 * time.Minute
+
+// alertsConfig configures alert rules evaluated against the results the
+// exporter already has, without running restic.
+type alertsConfig struct {
+	// Interval is how often the rules are evaluated. It defaults to a
+	// minute.
+	Interval time.Duration `yaml:"interval"`
+	Rules    []alertRule   `yaml:"rules"`
+
+	Alertmanager *alertmanagerConfig `yaml:"alertmanager"`
+
+	// labelNames are the names of the labels of all rules, sorted.
+	labelNames []string
+}
+
+// alertRule is a threshold on the results of probes, maintenance checks,
+// restore tests or repository stats.
+type alertRule struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Repositories are names or path.Match patterns of the repositories
+	// the rule applies to, all if empty.
+	Repositories []string `yaml:"repositories"`
+	// MaxAge is the age of the latest snapshot of a host backup_age fires
+	// at.
+	MaxAge model.Duration `yaml:"max_age"`
+	// MaxSize is the size of the stored repository data repository_size
+	// fires at.
+	MaxSize byteSize `yaml:"max_size"`
+	// For is how long the condition has to hold before the alert fires.
+	For         time.Duration     `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	annotations map[string]*template.Template
+}
+
+// byteSize is a number of bytes, given in YAML as an integer or with a unit
+// like 500GB, 500 GB or 2TiB.
+type byteSize int64
+
+var byteUnits = map[string]int64{
+	"B":  1,
+	"KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12, "PB": 1e15,
+	"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40, "PiB": 1 << 50,
+}
+
+func (b *byteSize) UnmarshalYAML(value *yaml.Node) error {
+
+	s := strings.TrimSpace(value.Value)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	unit := int64(1)
+	if i >= 0 {
+		var ok bool
+		if unit, ok = byteUnits[strings.TrimSpace(s[i:])]; !ok {
+			return fmt.Errorf("invalid size %q", value.Value)
+		}
+		s = strings.TrimSpace(s[:i])
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", value.Value)
+	}
+	*b = byteSize(n * float64(unit))
+
+	return nil
+}
+
+func (a *alertsConfig) validate() error {
+
+	if a.Alertmanager != nil {
+		if err := a.Alertmanager.validate(); err != nil {
+			return fmt.Errorf("alertmanager: %w", err)
+		}
+	}
+
+	if len(a.Rules) == 0 {
+		return nil
+	}
+
+	if a.Interval == 0 {
+		a.Interval = time.Minute
+	}
+
+	names := map[string]bool{}
+	labels := map[string]bool{}
+	for i := range a.Rules {
+		r := &a.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d: name required", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %q configured twice", r.Name)
+		}
+		names[r.Name] = true
+
+		switch r.Type {
+		case "backup_age":
+			if r.MaxAge <= 0 {
+				return fmt.Errorf("rule %q: max_age required", r.Name)
+			}
+		case "repository_size":
+			if r.MaxSize <= 0 {
+				return fmt.Errorf("rule %q: max_size required", r.Name)
+			}
+		default:
+			if !slices.Contains(alertRuleTypes, r.Type) {
+				return fmt.Errorf("rule %q: unknown type %q", r.Name, r.Type)
+			}
+		}
+
+		for _, pattern := range r.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %q: invalid repository pattern %q", r.Name, pattern)
+			}
+		}
+
+		for name := range r.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+				return fmt.Errorf("rule %q: invalid label name %q", r.Name, name)
+			}
+			if name == "alertname" || name == "alertstate" || name == "repository" || name == "hostname" {
+				return fmt.Errorf("rule %q: label %q is reserved", r.Name, name)
+			}
+			labels[name] = true
+		}
+
+		r.annotations = map[string]*template.Template{}
+		for name, text := range r.Annotations {
+			t, err := template.New(name).Option("missingkey=zero").Parse(text)
+			if err != nil {
+				return fmt.Errorf("rule %q: annotation %s: %w", r.Name, name, err)
+			}
+			r.annotations[name] = t
+		}
+	}
+
+	a.labelNames = nil
+	for name := range labels {
+		a.labelNames = append(a.labelNames, name)
+	}
+	slices.Sort(a.labelNames)
+
+	return nil
+}
+
+// appliesTo returns whether the rule checks repo.
+func (r *alertRule) appliesTo(repo *repository) bool {
+
+	if len(r.Repositories) == 0 {
+		return true
+	}
+	for _, pattern := range r.Repositories {
+		if matched, _ := path.Match(pattern, repo.Name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// alert is an instance of a rule for a repository, or a host of it.
+type alert struct {
+	Name string `json:"name"`
+	// State is pending, firing or resolved.
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Value is the age in seconds or size in bytes that exceeded the
+	// threshold. It is unset for failures and hosts without a snapshot.
+	Value      *float64   `json:"value,omitempty"`
+	ActiveAt   time.Time  `json:"active_at"`
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+
+	// repository and host are the source of the alert, host is empty for
+	// repository alerts.
+	repository, host string
+}
+
+// alertCondition is the result of checking a rule for a repository or
+// host. Unknown conditions keep the state of their alert.
+type alertCondition struct {
+	host   string
+	active bool
+	known  bool
+	value  *float64
+}
+
+var (
+	alertsMu sync.Mutex
+	// alerts are the pending, firing and recently resolved alerts, keyed by
+	// rule, repository and host. They survive configuration reloads.
+	alerts = map[[3]string]*alert{}
+)
+
+// conditions checks rule against the results of repo.
+func (r *alertRule) conditions(repo *repository, now time.Time) []alertCondition {
+
+	var conditions []alertCondition
+	switch r.Type {
+	case "backup_age", "probe_failed":
+		for _, h := range hostStatusesOf(repo.Name) {
+			c := alertCondition{host: h.Host, known: true}
+			if r.Type == "probe_failed" {
+				c.active = h.LastError != ""
+			} else if h.LastError != "" {
+				// a failed probe tells nothing about the age
+				c.known = false
+			} else if h.Latest.IsZero() {
+				c.active = true
+			} else {
+				age := now.Sub(h.Latest)
+				c.active = age > time.Duration(r.MaxAge)
+				c.value = floatPtr(age.Round(time.Second).Seconds())
+			}
+			conditions = append(conditions, c)
+		}
+
+	case "check_failed":
+		s := statusOf(repo.Name)
+		conditions = append(conditions, alertCondition{active: s.CheckError != "", known: !s.LastCheck.IsZero()})
+
+	case "restore_test_failed":
+		s := statusOf(repo.Name)
+		conditions = append(conditions, alertCondition{active: s.RestoreTestError != "", known: !s.LastRestoreTest.IsZero()})
+
+	case "repository_size":
+		stats, _, ok := cachedRepositoryStats(repo, "raw-data")
+		c := alertCondition{known: ok}
+		if ok {
+			c.active = byteSize(stats.TotalSize) > r.MaxSize
+			c.value = floatPtr(float64(stats.TotalSize))
+		}
+		conditions = append(conditions, c)
+	}
+
+	return conditions
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+// runAlertRules evaluates the alert rules of cfg every interval until ctx
+// is done. The leader sends the alerts to the configured Alertmanagers.
+func runAlertRules(ctx context.Context, cfg *config) {
+
+	ticker := time.NewTicker(cfg.Alerts.Interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		evaluateAlertRules(cfg, now)
+		if cfg.Alerts.Alertmanager != nil && isLeader() {
+			cfg.Alerts.Alertmanager.sendAlerts(ctx, cfg.Alerts.Interval, now)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// evaluateAlertRules updates the alerts from the rules of cfg. Alerts whose
+// condition no longer holds, or whose rule or repository is gone, resolve.
+func evaluateAlertRules(cfg *config, now time.Time) {
+
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+
+	seen := map[[3]string]bool{}
+	for i := range cfg.Alerts.Rules {
+		r := &cfg.Alerts.Rules[i]
+		for _, repo := range cfg.Repositories {
+			if !r.appliesTo(repo) {
+				continue
+			}
+			for _, c := range r.conditions(repo, now) {
+				key := [3]string{r.Name, repo.Name, c.host}
+				a, ok := alerts[key]
+				if !c.known {
+					if ok && a.State != "resolved" {
+						seen[key] = true
+					}
+					continue
+				}
+				if !c.active {
+					continue
+				}
+				seen[key] = true
+
+				if !ok || a.State == "resolved" {
+					a = &alert{Name: r.Name, State: "pending", ActiveAt: now, repository: repo.Name, host: c.host}
+					alerts[key] = a
+				}
+				a.Value = c.value
+				a.Labels = r.alertLabels(repo.Name, c.host)
+				a.Annotations = r.expandAnnotations(a)
+				if a.State == "pending" && now.Sub(a.ActiveAt) >= r.For {
+					a.State, a.FiredAt = "firing", &now
+				}
+			}
+		}
+	}
+
+	for key, a := range alerts {
+		switch {
+		case seen[key]:
+		case a.State == "pending":
+			delete(alerts, key)
+		case a.State == "firing":
+			a.State, a.ResolvedAt = "resolved", &now
+		case now.Sub(*a.ResolvedAt) > resolvedAlertRetention:
+			delete(alerts, key)
+		}
+	}
+}
+
+// alertLabels returns the labels of an alert of the rule.
+func (r *alertRule) alertLabels(repository, host string) map[string]string {
+
+	labels := map[string]string{"alertname": r.Name, "repository": repository}
+	if host != "" {
+		labels["hostname"] = host
+	}
+	for name, value := range r.Labels {
+		labels[name] = value
+	}
+
+	return labels
+}
+
+// expandAnnotations executes the annotation templates of the rule for a.
+// Templates get the labels and value of the alert.
+func (r *alertRule) expandAnnotations(a *alert) map[string]string {
+
+	if len(r.annotations) == 0 {
+		return nil
+	}
+
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{Labels: a.Labels}
+	if a.Value != nil {
+		data.Value = *a.Value
+	}
+
+	annotations := map[string]string{}
+	for name, t := range r.annotations {
+		var text strings.Builder
+		if err := t.Execute(&text, data); err != nil {
+			text.Reset()
+			text.WriteString(err.Error())
+		}
+		annotations[name] = text.String()
+	}
+
+	return annotations
+}
+
+// currentAlerts returns copies of the alerts, sorted by name, repository
+// and host.
+func currentAlerts() []alert {
+
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+
+	list := make([]alert, 0, len(alerts))
+	for _, a := range alerts {
+		list = append(list, *a)
+	}
+	slices.SortFunc(list, func(a, b alert) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.repository, b.repository); c != 0 {
+			return c
+		}
+		return strings.Compare(a.host, b.host)
+	})
+
+	return list
+}
+
+// alertsHandler serves the pending, firing and recently resolved alerts as
+// JSON, optionally only those in the state given by the state parameter.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+
+	state := r.URL.Query().Get("state")
+	if state != "" && state != "pending" && state != "firing" && state != "resolved" {
+		writeAPIError(w, http.StatusBadRequest, "invalid parameter: unknown state "+state)
+		return
+	}
+
+	list := []alert{}
+	for _, a := range currentAlerts() {
+		if state == "" || a.State == state {
+			list = append(list, a)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// alertsCollector exports the pending and firing alerts like the ALERTS
+// series of Prometheus.
+type alertsCollector struct{}
+
+func (c *alertsCollector) Describe(ch chan<- *prometheus.Desc) {
+	// unchecked, as the labels depend on the configured rules
+}
+
+func (c *alertsCollector) Collect(ch chan<- prometheus.Metric) {
+
+	labelNames := append([]string{"alertname", "alertstate", "repository", "hostname"}, currentConfig.Load().Alerts.labelNames...)
+	desc := prometheus.NewDesc("restic_alerts", "Pending and firing alerts of the built-in rules", labelNames, nil)
+
+	for _, a := range currentAlerts() {
+		if a.State == "resolved" {
+			continue
+		}
+		values := []string{a.Name, a.State, a.repository, a.host}
+		for _, name := range labelNames[4:] {
+			values = append(values, a.Labels[name])
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestByteSize(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "500GB", want: 500e9},
+		{in: "500 GB", want: 500e9},
+		{in: "1.5 TiB", want: 3 << 39},
+		{in: "2TiB", want: 2 << 40},
+		{in: "500 gb", wantErr: true},
+		{in: "GB", wantErr: true},
+		{in: "5 00GB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var b byteSize
+			err := yaml.Unmarshal([]byte(`"`+tt.in+`"`), &b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unmarshalling %q: error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && b != tt.want {
+				t.Errorf("unmarshalling %q = %d, want %d", tt.in, b, tt.want)
+			}
+		})
+	}
+}
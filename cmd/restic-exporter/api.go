@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"restic-exporter/pkg/collector"
+)
+
+type apiSnapshotsResponse struct {
+	Repository string               `json:"repository"`
+	Snapshots  []collector.Snapshot `json:"snapshots"`
+}
+
+// snapshotsHandler serves the snapshots of a repository, optionally
+// filtered by host and tags, as JSON.
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	host := query.Get("host")
+	var tags []string
+	for _, tag := range query["tag"] {
+		tags = append(tags, strings.Split(tag, ",")...)
+	}
+
+	cfg := currentConfig.Load()
+	if err := cfg.ProbeParams.check(host, "", tags); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid parameter: "+err.Error())
+		return
+	}
+
+	repo := cfg.repository(query.Get("repo"))
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown repository")
+		return
+	}
+
+	args := []string{"snapshots", "--json"}
+	if host != "" {
+		args = append(args, "--host", host)
+	}
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
+
+	snapshots := []collector.Snapshot{}
+	if err := unmarshallFromRestic(r.Context(), repo, &snapshots, args...); err != nil {
+		writeResticError(w, repo, err)
+		return
+	}
+	recordHistory(repo.Name, snapshots)
+
+	writeJSON(w, http.StatusOK, apiSnapshotsResponse{Repository: repo.Name, Snapshots: snapshots})
+}
+
+// writeJSON writes v as JSON response with status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Writing response failed", "err", err)
+	}
+}
+
+// writeAPIError writes msg as JSON error response with status.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// writeResticError responds to a failed restic invocation. Open circuit
+// breakers and timeouts are reported as unavailable, other failures as bad
+// gateway, as restic talks to the repository on the exporter's behalf.
+func writeResticError(w http.ResponseWriter, repo *repository, err error) {
+
+	slog.Error("API request failed", "repository", repo.Name, "err", err)
+
+	status := http.StatusBadGateway
+	var cmdErr *commandError
+	if errors.Is(err, errCircuitOpen) || (errors.As(err, &cmdErr) && cmdErr.reason == "timeout") {
+		status = http.StatusServiceUnavailable
+	}
+	writeAPIError(w, status, err.Error())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// auditLogger records every restic invocation. It is nil unless
+// RESTIC_EXPORTER_AUDIT_LOG is set to a file or "syslog".
+var auditLogger *slog.Logger
+
+type clientKey struct{}
+
+// withClient returns a copy of ctx recording the address of the client whose
+// request caused restic to run.
+func withClient(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientKey{}, addr)
+}
+
+func clientFromContext(ctx context.Context) string {
+	if addr, ok := ctx.Value(clientKey{}).(string); ok {
+		return addr
+	}
+	return ""
+}
+
+func setupAuditLog() error {
+
+	var w io.Writer
+
+	switch dest := os.Getenv("RESTIC_EXPORTER_AUDIT_LOG"); dest {
+	case "":
+		return nil
+	case "syslog":
+		sw, err := newSyslogWriter()
+		if err != nil {
+			return fmt.Errorf("RESTIC_EXPORTER_AUDIT_LOG: %w", err)
+		}
+		w = sw
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("RESTIC_EXPORTER_AUDIT_LOG: %w", err)
+		}
+		w = f
+	}
+
+	auditLogger = slog.New(slog.NewJSONHandler(w, nil))
+
+	return nil
+}
+
+// audit records a finished restic invocation. reason is empty if it
+// succeeded.
+func audit(ctx context.Context, repo *repository, args []string, duration time.Duration, exitCode int, reason string) {
+
+	if auditLogger == nil {
+		return
+	}
+
+	outcome := "success"
+	if reason != "" {
+		outcome = "failure"
+	}
+
+	auditLogger.Info("restic executed",
+		"repository", repo.label(),
+		"client", clientFromContext(ctx),
+		"argv", redactArgs(args),
+		"duration", duration,
+		"exit_code", exitCode,
+		"outcome", outcome,
+		"reason", reason,
+	)
+}
+
+// secretArgs are substrings of option names whose values are not recorded.
+var secretArgs = []string{"password", "secret", "token", "key"}
+
+// redactArgs hides option values that may contain secrets, both as
+// "--opt value" and "--opt=value" or "-o name=value", as well as passwords in
+// repository URLs.
+func redactArgs(args []string) []string {
+
+	redacted := make([]string, len(args))
+	hideNext := false
+
+	for i, arg := range args {
+		switch {
+		case hideNext:
+			redacted[i] = "xxxxx"
+			hideNext = false
+		case isSecretArg(arg):
+			if name, _, ok := strings.Cut(arg, "="); ok {
+				redacted[i] = name + "=xxxxx"
+			} else {
+				redacted[i] = arg
+				hideNext = strings.HasPrefix(arg, "-")
+			}
+		default:
+			redacted[i] = redactRepository(arg)
+		}
+	}
+
+	return redacted
+}
+
+func isSecretArg(arg string) bool {
+	name, _, _ := strings.Cut(strings.ToLower(arg), "=")
+	for _, s := range secretArgs {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// newSyslogWriter fails on platforms without syslog, the audit log can still
+// be written to a file.
+func newSyslogWriter() (io.Writer, error) {
+	return nil, errors.New("syslog not supported on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter returns a writer to the local syslog daemon for the audit
+// log.
+func newSyslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "restic-exporter")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var httpRequestsRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "restic_exporter",
+		Subsystem: "http",
+		Name:      "requests_rejected_total",
+		Help:      "Number of HTTP requests rejected because of the client's address",
+	},
+	[]string{"handler"},
+)
+
+// authConfig protects the endpoints that run restic or expose what it
+// returned. Requests must carry the password of one of BasicAuthUsers, given
+// as bcrypt hashes, or one of BearerTokens. Without either, no
+// authentication is required.
+type authConfig struct {
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	BearerTokens   []string          `yaml:"bearer_tokens"`
+
+	ClientCert clientCertConfig `yaml:"client_cert"`
+
+	// AllowedNetworks restricts the endpoints that trigger restic runs to
+	// clients from these CIDRs, e.g. 10.0.0.0/8. All clients are allowed if
+	// it is empty.
+	AllowedNetworks []string `yaml:"allowed_networks"`
+
+	allowedPrefixes []netip.Prefix
+}
+
+// clientCertConfig restricts the endpoints that trigger restic runs to
+// clients presenting a certificate. Certificates are verified by the TLS
+// server against the client_ca_file of the web configuration, which must
+// request them with client_auth_type VerifyClientCertIfGiven or stricter.
+type clientCertConfig struct {
+	Required bool `yaml:"required"`
+
+	// AllowedCommonNames, if set, further restricts the subject common
+	// names of accepted certificates. It implies Required.
+	AllowedCommonNames []string `yaml:"allowed_common_names"`
+}
+
+// validate checks that all passwords are valid bcrypt hashes and parses the
+// allowed networks.
+func (a *authConfig) validate() error {
+
+	for user, hash := range a.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("basic auth user %q: %w", user, err)
+		}
+	}
+	for _, token := range a.BearerTokens {
+		if token == "" {
+			return errors.New("empty bearer token")
+		}
+	}
+
+	a.allowedPrefixes = nil
+	for _, network := range a.AllowedNetworks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return fmt.Errorf("allowed networks: %w", err)
+		}
+		a.allowedPrefixes = append(a.allowedPrefixes, prefix.Masked())
+	}
+
+	return nil
+}
+
+func (a *authConfig) enabled() bool {
+	return len(a.BasicAuthUsers) > 0 || len(a.BearerTokens) > 0
+}
+
+// authorized reports whether r carries valid credentials.
+func (a *authConfig) authorized(r *http.Request) bool {
+
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, found := a.BasicAuthUsers[user]
+		return found && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range a.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *clientCertConfig) required() bool {
+	return c.Required || len(c.AllowedCommonNames) > 0
+}
+
+// authorized reports whether r was made with an accepted client certificate.
+func (c *clientCertConfig) authorized(r *http.Request) bool {
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	if len(c.AllowedCommonNames) == 0 {
+		return true
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return slices.Contains(c.AllowedCommonNames, cn)
+}
+
+// requireAuth rejects requests to h without the credentials required by the
+// current configuration.
+func requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		auth := &currentConfig.Load().Auth
+		if auth.enabled() && !auth.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="restic-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireClientCert rejects requests to h without a client certificate if
+// the current configuration requires one.
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		cert := &currentConfig.Load().Auth.ClientCert
+		if cert.required() && !cert.authorized(r) {
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowedAddress reports whether a client connecting from addr, in the form
+// of http.Request.RemoteAddr, may use the protected endpoints.
+func (a *authConfig) allowedAddress(addr string) bool {
+
+	if len(a.allowedPrefixes) == 0 {
+		return true
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+
+	for _, prefix := range a.allowedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowNetworks rejects requests to the handler registered as name from
+// clients outside the allowed networks of the current configuration.
+func allowNetworks(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !currentConfig.Load().Auth.allowedAddress(r.RemoteAddr) {
+			httpRequestsRejected.WithLabelValues(name).Inc()
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backupInProgress = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "in_progress",
+			Help:      "Whether a backup of the host is in progress",
+		},
+		[]string{"repository", "host"},
+	)
+	backupPercentDone = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "percent_done_ratio",
+			Help:      "Completed part of the backup in progress, from 0 to 1",
+		},
+		[]string{"repository", "host"},
+	)
+	backupBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "bytes",
+			Help:      "Bytes of the backup in progress, processed (done) and overall (total)",
+		},
+		[]string{"repository", "host", "state"},
+	)
+	backupFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "files",
+			Help:      "Files of the backup in progress, processed (done) and overall (total)",
+		},
+		[]string{"repository", "host", "state"},
+	)
+	backupETA = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "eta_seconds",
+			Help:      "Estimated time until the backup in progress completes",
+		},
+		[]string{"repository", "host"},
+	)
+	backupRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "runs_total",
+			Help:      "Number of backups tracked by the exporter by result",
+		},
+		[]string{"repository", "host", "result"},
+	)
+	backupDuration = prometheus.NewHistogramVec(
+		withNativeHistogram(prometheus.HistogramOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "duration_seconds",
+			Help:      "Duration of successful backups",
+			Buckets:   prometheus.ExponentialBuckets(60, 2, 10),
+		}),
+		[]string{"repository", "host"},
+	)
+	backupDataAdded = prometheus.NewHistogramVec(
+		withNativeHistogram(prometheus.HistogramOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "data_added_bytes",
+			Help:      "Data added to the repository by successful backups",
+			Buckets:   prometheus.ExponentialBuckets(1<<20, 4, 12),
+		}),
+		[]string{"repository", "host"},
+	)
+	backupLastFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "last_files",
+			Help:      "Files of the last successful backup by state (new, changed, unmodified)",
+		},
+		[]string{"repository", "host", "state"},
+	)
+	backupLastDataAdded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "last_data_added_bytes",
+			Help:      "Data added to the repository by the last successful backup",
+		},
+		[]string{"repository", "host"},
+	)
+	backupLastDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "last_duration_seconds",
+			Help:      "Duration of the last successful backup",
+		},
+		[]string{"repository", "host"},
+	)
+	backupLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time the last successful backup finished",
+		},
+		[]string{"repository", "host"},
+	)
+)
+
+// resticBackupMessage is a line of `restic backup --json` output.
+type resticBackupMessage struct {
+	MessageType string `json:"message_type"`
+
+	// status
+	SecondsElapsed   int64   `json:"seconds_elapsed"`
+	SecondsRemaining int64   `json:"seconds_remaining"`
+	PercentDone      float64 `json:"percent_done"`
+	TotalFiles       int64   `json:"total_files"`
+	FilesDone        int64   `json:"files_done"`
+	TotalBytes       int64   `json:"total_bytes"`
+	BytesDone        int64   `json:"bytes_done"`
+
+	// summary
+	FilesNew        int64   `json:"files_new"`
+	FilesChanged    int64   `json:"files_changed"`
+	FilesUnmodified int64   `json:"files_unmodified"`
+	DataAdded       int64   `json:"data_added"`
+	TotalDuration   float64 `json:"total_duration"`
+	SnapshotID      string  `json:"snapshot_id"`
+
+	// error
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	Item string `json:"item"`
+}
+
+// ingestBackup reads the output of `restic backup --json` for host and
+// repository from r, tracking its progress, until the backup's summary or
+// the end of r. A backup ending without a summary failed.
+func ingestBackup(repository, host string, r io.Reader) (*resticBackupMessage, error) {
+
+	labels := prometheus.Labels{"repository": repository, "host": host}
+	backupInProgress.With(labels).Set(1)
+	defer backupInProgress.With(labels).Set(0)
+
+	var (
+		summary *resticBackupMessage
+		lastErr string
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var msg resticBackupMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// restic prints some messages, e.g. warnings, as plain text
+			continue
+		}
+
+		switch msg.MessageType {
+		case "status":
+			backupPercentDone.With(labels).Set(msg.PercentDone)
+			backupBytes.WithLabelValues(repository, host, "done").Set(float64(msg.BytesDone))
+			backupBytes.WithLabelValues(repository, host, "total").Set(float64(msg.TotalBytes))
+			backupFiles.WithLabelValues(repository, host, "done").Set(float64(msg.FilesDone))
+			backupFiles.WithLabelValues(repository, host, "total").Set(float64(msg.TotalFiles))
+			backupETA.With(labels).Set(float64(msg.SecondsRemaining))
+			progress.update(backupProgress{
+				Repository:       repository,
+				Host:             host,
+				PercentDone:      msg.PercentDone,
+				TotalFiles:       msg.TotalFiles,
+				FilesDone:        msg.FilesDone,
+				TotalBytes:       msg.TotalBytes,
+				BytesDone:        msg.BytesDone,
+				SecondsElapsed:   msg.SecondsElapsed,
+				SecondsRemaining: msg.SecondsRemaining,
+			})
+		case "error":
+			if msg.Error != nil {
+				lastErr = msg.Item + ": " + msg.Error.Message
+			}
+		case "summary":
+			summary = &msg
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil && summary == nil {
+		err = errors.New("backup ended without summary")
+		if lastErr != "" {
+			err = errors.New("backup ended without summary, last error: " + lastErr)
+		}
+	}
+
+	backupPercentDone.With(labels).Set(0)
+	backupETA.With(labels).Set(0)
+
+	if err != nil {
+		backupRuns.WithLabelValues(repository, host, "failure").Inc()
+		progress.update(backupProgress{Repository: repository, Host: host, Done: true, Error: err.Error()})
+		return nil, err
+	}
+
+	// exemplars link the samples of the backup to its snapshot
+	exemplar := prometheus.Labels{"snapshot_id": shortID(summary.SnapshotID)}
+	backupRuns.WithLabelValues(repository, host, "success").(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
+	backupDuration.With(labels).(prometheus.ExemplarObserver).ObserveWithExemplar(summary.TotalDuration, exemplar)
+	backupDataAdded.With(labels).(prometheus.ExemplarObserver).ObserveWithExemplar(float64(summary.DataAdded), exemplar)
+	backupLastFiles.WithLabelValues(repository, host, "new").Set(float64(summary.FilesNew))
+	backupLastFiles.WithLabelValues(repository, host, "changed").Set(float64(summary.FilesChanged))
+	backupLastFiles.WithLabelValues(repository, host, "unmodified").Set(float64(summary.FilesUnmodified))
+	backupLastDataAdded.With(labels).Set(float64(summary.DataAdded))
+	backupLastDuration.With(labels).Set(summary.TotalDuration)
+	backupLastSuccess.With(labels).Set(float64(time.Now().Unix()))
+	progress.update(backupProgress{Repository: repository, Host: host, PercentDone: 1, Done: true})
+
+	return summary, nil
+}
+
+// shortID returns the short form of a snapshot ID, as restic prints it.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+type apiBackupResult struct {
+	Result     string `json:"result"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// backupProgressHandler ingests the output of `restic backup --json`
+// streamed in the request body, e.g. piped into curl by a backup job.
+func backupProgressHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	cfg := currentConfig.Load()
+	if err := cfg.ProbeParams.check(host, "", nil); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid parameter: "+err.Error())
+		return
+	}
+
+	repo := cfg.repository(r.URL.Query().Get("repo"))
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown repository")
+		return
+	}
+
+	// the body is streamed for as long as the backup runs
+	if err := http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+		slog.Warn("Backup progress may be cut off by the read timeout", "err", err)
+	}
+
+	summary, err := ingestBackup(repo.Name, host, r.Body)
+	if err != nil {
+		slog.Error("Backup failed", "repository", repo.Name, "host", host, "err", err)
+		writeJSON(w, http.StatusOK, apiBackupResult{Result: "failure", Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiBackupResult{Result: "success", SnapshotID: summary.SnapshotID})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backupJobRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup_job",
+			Name:      "running",
+			Help:      "Whether a backup of the profile started by the exporter is running",
+		},
+		[]string{"profile"},
+	)
+	backupJobSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup_job",
+			Name:      "last_success",
+			Help:      "Whether the last backup of the profile started by the exporter succeeded",
+		},
+		[]string{"profile"},
+	)
+	backupJobLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "backup_job",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time the last backup of the profile started by the exporter finished",
+		},
+		[]string{"profile"},
+	)
+)
+
+// backupConfig configures the backups POST /api/v1/backup can start. It is
+// disabled unless profiles and a token are configured.
+type backupConfig struct {
+	// TokenFile holds the bearer token requests have to present.
+	TokenFile string          `yaml:"token_file"`
+	Profiles  []backupProfile `yaml:"profiles"`
+
+	token string
+}
+
+// backupProfile is a backup of paths to a configured repository.
+type backupProfile struct {
+	Name       string   `yaml:"name"`
+	Repository string   `yaml:"repository"`
+	Paths      []string `yaml:"paths"`
+	// Host defaults to the exporter's host name.
+	Host      string   `yaml:"host"`
+	Tags      []string `yaml:"tags"`
+	Exclude   []string `yaml:"exclude"`
+	ExtraArgs []string `yaml:"extra_args"`
+}
+
+// validate checks b against the repositories of c.
+func (b *backupConfig) validate(c *config) error {
+
+	if len(b.Profiles) == 0 {
+		return nil
+	}
+
+	if b.TokenFile == "" {
+		return errors.New("token_file required")
+	}
+	token, err := readSecretFile(b.TokenFile)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("%s is empty", b.TokenFile)
+	}
+	b.token = token
+
+	names := map[string]bool{}
+	for i, p := range b.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("profile %d: name required", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("profile %q configured twice", p.Name)
+		}
+		names[p.Name] = true
+
+		if c.repository(p.Repository) == nil {
+			return fmt.Errorf("profile %q: unknown repository %q", p.Name, p.Repository)
+		}
+		if len(p.Paths) == 0 {
+			return fmt.Errorf("profile %q: paths required", p.Name)
+		}
+		for _, arg := range p.ExtraArgs {
+			if deniedArg(arg) {
+				return fmt.Errorf("profile %q: extra argument %q not allowed", p.Name, arg)
+			}
+		}
+	}
+
+	return nil
+}
+
+// profile returns the profile called name, or nil.
+func (b *backupConfig) profile(name string) *backupProfile {
+	for i := range b.Profiles {
+		if b.Profiles[i].Name == name {
+			return &b.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// backupJob is the state of the latest backup of a profile started by the
+// exporter.
+type backupJob struct {
+	Profile    string     `json:"profile"`
+	State      string     `json:"state"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	SnapshotID string     `json:"snapshot_id,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+var (
+	backupJobsMu sync.Mutex
+	backupJobs   = map[string]*backupJob{}
+)
+
+// startBackup starts a backup of profile p of repo, unless one is running.
+// It fails with errRepositoryBusy if another operation holds the gate of
+// repo.
+func startBackup(repo *repository, p backupProfile) (backupJob, error) {
+
+	backupJobsMu.Lock()
+	defer backupJobsMu.Unlock()
+
+	if job, ok := backupJobs[p.Name]; ok && job.State == "running" {
+		return *job, errors.New("backup already running")
+	}
+	gate := gateFor(repo.Name)
+	if err := gate.tryAcquire("backup"); err != nil {
+		return backupJob{}, err
+	}
+
+	job := &backupJob{Profile: p.Name, State: "running", StartedAt: time.Now()}
+	backupJobs[p.Name] = job
+	backupJobRunning.WithLabelValues(p.Name).Set(1)
+
+	go func() {
+		snapshotID, err := runBackup(resticCtx, repo, p)
+		gate.release()
+
+		backupJobsMu.Lock()
+		defer backupJobsMu.Unlock()
+
+		finished := time.Now()
+		job.FinishedAt = &finished
+		job.SnapshotID = snapshotID
+		job.State = "succeeded"
+		if err != nil {
+			job.State = "failed"
+			job.Error = err.Error()
+			slog.Error("Backup failed", "profile", p.Name, "repository", repo.Name, "err", err)
+		}
+		backupJobRunning.WithLabelValues(p.Name).Set(0)
+		backupJobSuccess.WithLabelValues(p.Name).Set(boolToFloat(err == nil))
+		backupJobLastRun.WithLabelValues(p.Name).Set(float64(finished.Unix()))
+	}()
+
+	return *job, nil
+}
+
+// runBackup runs restic backup for profile p and returns the ID of the
+// snapshot created. Its progress is tracked like ingested backups.
+func runBackup(ctx context.Context, repo *repository, p backupProfile) (string, error) {
+
+	host := p.Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	args := []string{"backup", "--json", "--host", host}
+	for _, tag := range p.Tags {
+		args = append(args, "--tag", tag)
+	}
+	for _, pattern := range p.Exclude {
+		args = append(args, "--exclude", pattern)
+	}
+	args = append(args, p.ExtraArgs...)
+	args = append(args, p.Paths...)
+
+	cmd := resticCommand(ctx, repo, args...)
+	var stdErr bytes.Buffer
+	cmd.Stderr = &stdErr
+	stdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	summary, ingestErr := ingestBackup(repo.Name, host, stdOut)
+	err = cmd.Wait()
+
+	code, reason := 0, ""
+	if err != nil {
+		code, reason = exitCode(err), failureReason(err, stdErr.String())
+	}
+	audit(ctx, repo, cmd.Args, time.Since(start), code, reason)
+
+	if err != nil {
+		// restic exits with 3 if some files could not be read, but still
+		// creates a snapshot
+		if code != 3 || summary == nil {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stdErr.String()))
+		}
+		slog.Warn("Backup incomplete, some files could not be read", "profile", p.Name, "repository", repo.Name)
+	}
+	if ingestErr != nil {
+		return "", ingestErr
+	}
+
+	return summary.SnapshotID, nil
+}
+
+// backupHandler starts the backup of the profile named by the profile
+// parameter on POST, and returns the state of its latest backup on GET.
+// Requests need the configured backup token.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+
+	cfg := currentConfig.Load()
+	if len(cfg.Backup.Profiles) == 0 {
+		writeAPIError(w, http.StatusNotFound, "no backup profiles configured")
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Backup.token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	p := cfg.Backup.profile(r.URL.Query().Get("profile"))
+	if p == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown profile")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		backupJobsMu.Lock()
+		job, ok := backupJobs[p.Name]
+		var state backupJob
+		if ok {
+			state = *job
+		}
+		backupJobsMu.Unlock()
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "no backup started yet")
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+
+	case http.MethodPost:
+		repo := cfg.repository(p.Repository)
+		if repo == nil {
+			writeAPIError(w, http.StatusNotFound, "repository of the profile is collected by another shard")
+			return
+		}
+		job, err := startBackup(repo, *p)
+		if errors.Is(err, errRepositoryBusy) {
+			writeAPIError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusConflict, job)
+			return
+		}
+		slog.Info("Backup started", "profile", p.Name, "client", r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, job)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var repositoryBlobsDesc = prometheus.NewDesc(
+	"restic_repository_blobs",
+	"Number of blobs in the repository index by type",
+	[]string{"repository", "type"}, nil,
+)
+
+// cachedBlobCounts are the blob counts of a repository by type, and when
+// they were collected.
+type cachedBlobCounts struct {
+	mu          sync.Mutex
+	counts      map[string]int64
+	collectedAt time.Time
+}
+
+var (
+	blobCountsCacheMu sync.Mutex
+	// blobCountsCache holds blob counts by repository name and location.
+	blobCountsCache = map[[2]string]*cachedBlobCounts{}
+)
+
+// blobCounts returns the number of data and tree blobs of repo, listing all
+// blobs of its index only if the cached counts are older than
+// RESTIC_EXPORTER_STATS_CACHE_TTL.
+func blobCounts(ctx context.Context, repo *repository) (map[string]int64, error) {
+
+	key := [2]string{repo.Name, repo.Repository}
+
+	blobCountsCacheMu.Lock()
+	c, ok := blobCountsCache[key]
+	if !ok {
+		c = &cachedBlobCounts{}
+		blobCountsCache[key] = c
+	}
+	blobCountsCacheMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts != nil && time.Since(c.collectedAt) < envStatsCacheTTL {
+		return c.counts, nil
+	}
+
+	out, err := runRestic(ctx, repo, "list", "blobs")
+	if err != nil {
+		return nil, err
+	}
+
+	// each line is the type and ID of a blob
+	counts := map[string]int64{"data": 0, "tree": 0}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if typ, _, ok := bytes.Cut(scanner.Bytes(), []byte(" ")); ok {
+			counts[string(typ)]++
+		}
+	}
+	c.counts, c.collectedAt = counts, time.Now()
+
+	return c.counts, nil
+}
+
+// collectBlobs exports the number of blobs of repo by type.
+func collectBlobs(ctx context.Context, repo *repository, ch chan<- prometheus.Metric) error {
+
+	counts, err := blobCounts(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for typ, n := range counts {
+		ch <- prometheus.MustNewConstMetric(repositoryBlobsDesc, prometheus.GaugeValue, float64(n), repo.Name, typ)
+	}
+
+	return nil
+}
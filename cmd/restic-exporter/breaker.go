@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var circuitOpen = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "restic_exporter",
+		Subsystem: "circuit_breaker",
+		Name:      "open",
+		Help:      "Whether restic is currently not run against the repository after repeated failures",
+	},
+	[]string{"repository"},
+)
+
+// A repository failing envBreakerFailures times in a row is left alone for
+// envBreakerCooldown. The breaker is disabled by default.
+var (
+	envBreakerFailures = getEnvInt("RESTIC_EXPORTER_BREAKER_FAILURES", 0)
+	envBreakerCooldown = getEnvDuration("RESTIC_EXPORTER_BREAKER_COOLDOWN", 5*time.Minute)
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+// circuitBreaker stops restic from being launched against a repository whose
+// backend keeps failing, e.g. because the storage is offline or times out, so
+// hung processes don't pile up and the backend isn't hammered.
+type circuitBreaker struct {
+	repository string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func breakerFor(repository string) *circuitBreaker {
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[repository]
+	if !ok {
+		b = &circuitBreaker{repository: repository}
+		breakers[repository] = b
+	}
+
+	return b
+}
+
+// allow returns errCircuitOpen while the breaker is open. Once the cooldown
+// is over, invocations are let through again; another failure reopens it.
+func (b *circuitBreaker) allow() error {
+
+	if envBreakerFailures <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Now().Before(b.openUntil) {
+		return fmt.Errorf("%w for %s until %s", errCircuitOpen, b.repository, b.openUntil.Format(time.RFC3339))
+	}
+	circuitOpen.WithLabelValues(b.repository).Set(0)
+
+	return nil
+}
+
+// record counts err towards opening the breaker if it is one of the
+// transient backend failures retryable tells apart. Others, e.g. a wrong
+// password, a locked repository or bad probe parameters, say nothing about
+// the backend and leave the count alone.
+func (b *circuitBreaker) record(err error) {
+
+	if envBreakerFailures <= 0 || (err != nil && !retryable(err)) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= envBreakerFailures {
+		b.openUntil = time.Now().Add(envBreakerCooldown)
+		circuitOpen.WithLabelValues(b.repository).Set(1)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+var buildInfo = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "restic_exporter",
+		Name:      "build_info",
+		Help:      "Version of the exporter build",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"revision":  commit,
+			"builddate": date,
+			"goversion": runtime.Version(),
+		},
+	},
+	func() float64 { return 1 },
+)
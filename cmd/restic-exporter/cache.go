@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheSizeDesc = prometheus.NewDesc(
+	"restic_exporter_cache_size_bytes",
+	"Size of the restic cache directory of the repository",
+	[]string{"repository"}, nil,
+)
+
+// Scheduled cleanup of restic caches, which otherwise grow with every
+// repository ever accessed. Disabled unless an interval is set.
+var (
+	envCacheCleanupInterval = getEnvDuration("RESTIC_EXPORTER_CACHE_CLEANUP_INTERVAL", 0)
+	envCacheMaxAge          = getEnvInt("RESTIC_EXPORTER_CACHE_MAX_AGE", 30)
+)
+
+// envCacheWarmup fills the caches when a configuration is applied, so the
+// first probes don't have to.
+var envCacheWarmup = getEnv("RESTIC_EXPORTER_CACHE_WARMUP", "true") == "true"
+
+// cacheCollector reports the size of the cache directories.
+type cacheCollector struct{}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheSizeDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, repo := range currentConfig.Load().Repositories {
+
+		size, err := dirSize(repo.cacheDir())
+		if err != nil {
+			slog.Error("Measuring cache size failed", "repository", repo.Name, "path", repo.cacheDir(), "err", err)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(size), repo.Name)
+	}
+}
+
+// dirSize returns the total size of the regular files below dir.
+func dirSize(dir string) (int64, error) {
+
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+// runCacheCleanup removes caches unused for the maximum cache age from the
+// cache directories of cfg every cache cleanup interval until ctx is done.
+func runCacheCleanup(ctx context.Context, cfg *config) {
+
+	ticker := time.NewTicker(envCacheCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, repo := range cfg.Repositories {
+			_, err := runRestic(ctx, repo, "cache", "--cleanup", "--max-age", strconv.Itoa(envCacheMaxAge))
+			if err != nil && ctx.Err() == nil {
+				slog.Error("Cache cleanup failed", "repository", repo.Name, "err", err)
+			}
+		}
+	}
+}
+
+// warmCaches runs the commands probes use against every repository of cfg,
+// one after the other, so that restic's cache holds their metadata.
+func warmCaches(ctx context.Context, cfg *config) {
+
+	for _, repo := range cfg.Repositories {
+
+		start := time.Now()
+		_, err := runRestic(ctx, repo, "snapshots", "--json")
+		if err == nil {
+			_, err = runRestic(ctx, repo, "stats", "latest", "--json")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("Cache warm-up failed", "repository", repo.Name, "err", err)
+			continue
+		}
+		slog.Info("Cache warmed up", "repository", repo.Name, "duration", time.Since(start))
+	}
+}
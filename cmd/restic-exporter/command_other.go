@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups; cancelling
+// cmd only kills restic itself.
+func setProcessGroup(cmd *exec.Cmd) {}
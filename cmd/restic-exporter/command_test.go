@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunResticWithoutRepository(t *testing.T) {
+
+	bin := envResticBin
+	envResticBin = filepath.Join(t.TempDir(), "restic")
+	defer func() { envResticBin = bin }()
+
+	// errors are recorded as in a one-shot collection
+	onceErrors.Lock()
+	onceErrors.enabled = true
+	onceErrors.Unlock()
+	defer func() {
+		onceErrors.Lock()
+		onceErrors.enabled, onceErrors.first = false, nil
+		onceErrors.Unlock()
+	}()
+
+	if _, err := runRestic(context.Background(), nil, "version"); err == nil {
+		t.Fatal("running a missing restic binary succeeded")
+	}
+	if _, err := checkResticVersion(context.Background()); err == nil {
+		t.Fatal("checking the version of a missing restic binary succeeded")
+	}
+}
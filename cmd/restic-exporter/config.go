@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the reloadable part of the exporter's configuration. Settings of
+// the process itself, such as the listen address, are only read from the
+// environment.
+type config struct {
+	Repositories []*repository `yaml:"repositories"`
+	Auth         authConfig    `yaml:"auth"`
+
+	ProbeParams probeParamsConfig `yaml:"probe_params"`
+
+	Vault vaultConfig `yaml:"vault"`
+
+	Discovery discoveryConfig `yaml:"discovery"`
+
+	Backup      backupConfig      `yaml:"backup"`
+	Maintenance maintenanceConfig `yaml:"maintenance"`
+
+	Metrics metricsConfig `yaml:"metrics"`
+
+	// MetricRelabelConfigs rewrite the labels and names of all metrics
+	// before they are exposed or pushed.
+	MetricRelabelConfigs []relabelConfig `yaml:"metric_relabel_configs"`
+
+	Alerts        alertsConfig        `yaml:"alerts"`
+	Notifications notificationsConfig `yaml:"notifications"`
+}
+
+// repository is a restic repository monitored by the exporter.
+type repository struct {
+	// Name identifies the repository in metric labels and the repository
+	// probe parameter. It defaults to the redacted repository location.
+	Name string `yaml:"name"`
+
+	// Repository is passed to restic as RESTIC_REPOSITORY. If empty, restic
+	// is configured by the exporter's environment.
+	Repository string `yaml:"repository"`
+
+	// Targets are the hosts backing up to this repository. Probes for them
+	// use it unless the repository parameter says otherwise.
+	Targets []string `yaml:"targets"`
+
+	// ExpectedHosts must have snapshots in the repository. Hosts that stop
+	// backing up are reported instead of their series just disappearing.
+	ExpectedHosts []string `yaml:"expected_hosts"`
+
+	// Labels are added to all metrics of the repository, and TargetLabels
+	// to those of the targets, e.g. the owning team or the environment.
+	Labels       map[string]string            `yaml:"labels"`
+	TargetLabels map[string]map[string]string `yaml:"target_labels"`
+
+	// PasswordFile and PasswordCommand are passed to restic as
+	// RESTIC_PASSWORD_FILE and RESTIC_PASSWORD_COMMAND, replacing any
+	// password from the exporter's environment.
+	PasswordFile    string `yaml:"password_file"`
+	PasswordCommand string `yaml:"password_command"`
+
+	Rclone rcloneConfig `yaml:"rclone"`
+
+	// LimitDownload and LimitUpload limit restic's bandwidth in KiB/s, so
+	// that monitoring doesn't saturate small links.
+	LimitDownload int `yaml:"limit_download"`
+	LimitUpload   int `yaml:"limit_upload"`
+
+	// Resources limits the memory, open files, CPUs and priority of restic.
+	Resources resourcesConfig `yaml:"resources"`
+
+	// ExtraArgs are appended to every restic invocation for the repository,
+	// e.g. -o s3.region=eu-west-1 or --retry-lock 5m.
+	ExtraArgs []string `yaml:"extra_args"`
+
+	// Env is added to the environment restic is run with for this
+	// repository only, e.g. backend credentials such as AWS_ACCESS_KEY_ID
+	// or B2_ACCOUNT_KEY.
+	Env map[string]string `yaml:"env"`
+
+	// Secrets maps environment variables of restic to references of
+	// secrets, e.g. aws-ssm:///restic/password.
+	Secrets map[string]string `yaml:"secrets"`
+
+	// VaultSecrets are read from Vault into restic's environment.
+	VaultSecrets []vaultSecret `yaml:"vault_secrets"`
+
+	RestoreTest restoreTestConfig `yaml:"restore_test"`
+
+	BackupSchedule backupScheduleConfig `yaml:"backup_schedule"`
+	SLA            slaConfig            `yaml:"sla"`
+
+	// cache is the repository's own cache directory, if any.
+	cache string
+
+	resolvedSecrets atomic.Pointer[[]string]
+
+	// vaultEnv holds the environment variables read from Vault. It is
+	// replaced while the configuration is in use.
+	vaultEnv atomic.Pointer[[]string]
+
+	// discovered holds the targets discovered in Consul or etcd. It is
+	// replaced while the configuration is in use.
+	discovered atomic.Pointer[[]probeTarget]
+}
+
+var currentConfig atomic.Pointer[config]
+
+// label returns the value of the repository label for r, which is nil for
+// invocations not concerning a repository such as `restic version`.
+func (r *repository) label() string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// cacheDir returns the restic cache directory for r. With several
+// repositories configured, each gets a subdirectory of its own.
+func (r *repository) cacheDir() string {
+	if r == nil || r.cache == "" {
+		return envCacheDir
+	}
+	return r.cache
+}
+
+// cacheDirName returns a directory name for the repository called name,
+// which may contain any characters.
+func cacheDirName(name string) string {
+
+	safe := strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.') {
+			return r
+		}
+		return '_'
+	}, name)
+
+	// names differing only in replaced characters must not share a cache
+	sum := sha256.Sum256([]byte(name))
+	return safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// rcloneConfig holds the options of the rclone backend, for repositories of
+// the form rclone:remote:path.
+type rcloneConfig struct {
+	// Program is the rclone binary, passed as -o rclone.program.
+	Program string `yaml:"program"`
+	// Args are the arguments restic starts rclone with, passed as
+	// -o rclone.args.
+	Args string `yaml:"args"`
+}
+
+// args returns the options restic is run with for r.
+func (r *repository) args() []string {
+
+	if r == nil {
+		return nil
+	}
+
+	var args []string
+	if r.Rclone.Program != "" {
+		args = append(args, "-o", "rclone.program="+r.Rclone.Program)
+	}
+	if r.Rclone.Args != "" {
+		args = append(args, "-o", "rclone.args="+r.Rclone.Args)
+	}
+	if r.LimitDownload > 0 {
+		args = append(args, "--limit-download", strconv.Itoa(r.LimitDownload))
+	}
+	if r.LimitUpload > 0 {
+		args = append(args, "--limit-upload", strconv.Itoa(r.LimitUpload))
+	}
+	args = append(args, r.ExtraArgs...)
+
+	return args
+}
+
+// environ returns the environment restic is run with for r, or nil if it is
+// the exporter's own.
+func (r *repository) environ() []string {
+
+	if r == nil {
+		return nil
+	}
+
+	var env []string
+	if r.Repository != "" {
+		env = append(env, "RESTIC_REPOSITORY="+r.Repository)
+	}
+	if r.PasswordFile != "" {
+		env = append(env, "RESTIC_PASSWORD_FILE="+r.PasswordFile)
+	}
+	if r.PasswordCommand != "" {
+		env = append(env, "RESTIC_PASSWORD_COMMAND="+r.PasswordCommand)
+	}
+	for _, name := range sortedKeys(r.Env) {
+		env = append(env, name+"="+r.Env[name])
+	}
+	if secrets := r.resolvedSecrets.Load(); secrets != nil {
+		env = append(env, *secrets...)
+	}
+	if secrets := r.vaultEnv.Load(); secrets != nil {
+		env = append(env, *secrets...)
+	}
+	if env == nil {
+		return nil
+	}
+
+	base := os.Environ()
+	if r.PasswordFile != "" || r.PasswordCommand != "" {
+		// restic prefers RESTIC_PASSWORD over the others
+		base = slices.DeleteFunc(base, func(kv string) bool {
+			return strings.HasPrefix(kv, "RESTIC_PASSWORD=") ||
+				strings.HasPrefix(kv, "RESTIC_PASSWORD_FILE=") ||
+				strings.HasPrefix(kv, "RESTIC_PASSWORD_COMMAND=")
+		})
+	}
+
+	return append(base, env...)
+}
+
+// loadConfig reads the file RESTIC_EXPORTER_CONFIG points to, decrypting it
+// if it is encrypted with sops. Without it, a single repository is
+// configured from the environment.
+func loadConfig() (*config, error) {
+
+	path := os.Getenv("RESTIC_EXPORTER_CONFIG")
+	if path == "" {
+		return configFromEnv()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if sopsEncrypted(data) {
+		if data, err = sopsDecrypt(path); err != nil {
+			return nil, fmt.Errorf("decrypting %s: %w", path, err)
+		}
+	}
+
+	var cfg config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.shard()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := cfg.resolveSecrets(ctx); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &cfg, nil
+}
+
+func configFromEnv() (*config, error) {
+
+	restoreTest, err := restoreTestConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		Repositories: []*repository{{
+			Name:        repositoryNameFromEnv(),
+			RestoreTest: restoreTest,
+		}},
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate checks cfg and fills in defaults.
+func (c *config) validate() error {
+
+	if len(c.Repositories) == 0 {
+		return errors.New("no repositories configured")
+	}
+
+	if err := c.Auth.validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+
+	if err := c.ProbeParams.validate(); err != nil {
+		return fmt.Errorf("probe params: %w", err)
+	}
+
+	usesVault := false
+	for _, repo := range c.Repositories {
+		usesVault = usesVault || len(repo.VaultSecrets) > 0
+	}
+	if err := c.Vault.validate(usesVault); err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+
+	names := map[string]bool{}
+	targets := map[string]string{}
+	for i, repo := range c.Repositories {
+
+		for name := range repo.Env {
+			if name == "" || strings.Contains(name, "=") {
+				return fmt.Errorf("repository %d: invalid environment variable %q", i, name)
+			}
+		}
+		if location, ok := repo.Env["RESTIC_REPOSITORY"]; ok {
+			if repo.Repository != "" {
+				return fmt.Errorf("repository %d: repository and RESTIC_REPOSITORY in env are mutually exclusive", i)
+			}
+			repo.Repository = location
+			delete(repo.Env, "RESTIC_REPOSITORY")
+		}
+
+		if repo.Name == "" {
+			if repo.Repository == "" {
+				return fmt.Errorf("repository %d: name or repository required", i)
+			}
+			repo.Name = redactRepository(repo.Repository)
+		}
+		if names[repo.Name] {
+			return fmt.Errorf("repository %q configured twice", repo.Name)
+		}
+		names[repo.Name] = true
+
+		if len(c.Repositories) > 1 {
+			repo.cache = filepath.Join(envCacheDir, cacheDirName(repo.Name))
+		}
+
+		if repo.Rclone != (rcloneConfig{}) && repo.Repository != "" && !strings.HasPrefix(repo.Repository, "rclone:") {
+			return fmt.Errorf("repository %q: rclone options require an rclone repository", repo.Name)
+		}
+
+		if repo.LimitDownload < 0 || repo.LimitUpload < 0 {
+			return fmt.Errorf("repository %q: negative bandwidth limit", repo.Name)
+		}
+
+		if err := repo.Resources.validate(); err != nil {
+			return fmt.Errorf("repository %q: resources: %w", repo.Name, err)
+		}
+
+		for _, arg := range repo.ExtraArgs {
+			if deniedArg(arg) {
+				return fmt.Errorf("repository %q: extra argument %q not allowed", repo.Name, arg)
+			}
+		}
+
+		if repo.PasswordFile != "" && repo.PasswordCommand != "" {
+			return fmt.Errorf("repository %q: password_file and password_command are mutually exclusive", repo.Name)
+		}
+		if repo.PasswordFile != "" {
+			// checked here so that a reload fails early on a missing file
+			if _, err := os.ReadFile(repo.PasswordFile); err != nil {
+				return fmt.Errorf("repository %q: %w", repo.Name, err)
+			}
+		}
+
+		for name, ref := range repo.Secrets {
+			if err := validateSecretRef(ref); err != nil {
+				return fmt.Errorf("repository %q: secret %s: %w", repo.Name, name, err)
+			}
+		}
+
+		for _, s := range repo.VaultSecrets {
+			if s.Path == "" || len(s.Env) == 0 {
+				return fmt.Errorf("repository %q: vault secrets require path and env", repo.Name)
+			}
+		}
+
+		for _, target := range repo.Targets {
+			if other, ok := targets[target]; ok {
+				return fmt.Errorf("target %q mapped to repositories %q and %q", target, other, repo.Name)
+			}
+			targets[target] = repo.Name
+		}
+
+		if err := validateStaticLabels(repo.Labels); err != nil {
+			return fmt.Errorf("repository %q: %w", repo.Name, err)
+		}
+		for target, labels := range repo.TargetLabels {
+			if err := validateStaticLabels(labels); err != nil {
+				return fmt.Errorf("repository %q: target %q: %w", repo.Name, target, err)
+			}
+		}
+
+		for i, host := range repo.ExpectedHosts {
+			if host == "" || slices.Contains(repo.ExpectedHosts[:i], host) {
+				return fmt.Errorf("repository %q: invalid or duplicate expected host %q", repo.Name, host)
+			}
+		}
+
+		if err := repo.RestoreTest.validate(); err != nil {
+			return fmt.Errorf("repository %q: %w", repo.Name, err)
+		}
+
+		if err := repo.BackupSchedule.validate(); err != nil {
+			return fmt.Errorf("repository %q: %w", repo.Name, err)
+		}
+
+		if err := repo.SLA.validate(); err != nil {
+			return fmt.Errorf("repository %q: %w", repo.Name, err)
+		}
+	}
+
+	if err := c.Discovery.validate(); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+
+	if err := c.Backup.validate(c); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	if err := c.Maintenance.validate(); err != nil {
+		return fmt.Errorf("maintenance: %w", err)
+	}
+
+	if err := c.Metrics.validate(); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+
+	for i := range c.MetricRelabelConfigs {
+		if err := c.MetricRelabelConfigs[i].validate(); err != nil {
+			return fmt.Errorf("metric relabel config %d: %w", i, err)
+		}
+	}
+
+	if err := c.Alerts.validate(); err != nil {
+		return fmt.Errorf("alerts: %w", err)
+	}
+
+	if err := c.Notifications.validate(); err != nil {
+		return fmt.Errorf("notifications: %w", err)
+	}
+
+	return nil
+}
+
+// repository returns the repository called name, or the first one if name
+// is empty. It returns nil if there is no such repository, which includes
+// repositories of other shards.
+func (c *config) repository(name string) *repository {
+
+	if name == "" {
+		if len(c.Repositories) == 0 {
+			return nil
+		}
+		return c.Repositories[0]
+	}
+
+	for _, repo := range c.Repositories {
+		if repo.Name == name {
+			return repo
+		}
+	}
+
+	return nil
+}
+
+// probeRepository returns the repository a probe is run against: the one
+// called name if given, else the one target is mapped to, else the first
+// one.
+func (c *config) probeRepository(name, target string) *repository {
+
+	if name == "" && target != "" {
+		for _, repo := range c.Repositories {
+			if slices.ContainsFunc(repo.targets(), func(t probeTarget) bool { return t.Host == target }) {
+				return repo
+			}
+		}
+	}
+
+	return c.repository(name)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// deniedArgs are restic options that can't be set as extra arguments, since
+// the exporter manages them itself or relies on their absence.
+var deniedArgs = []string{
+	"-r", "--repo", "--repository-file",
+	"-p", "--password-file", "--password-command", "--key-hint", "--insecure-no-password",
+	"--cache-dir", "--no-cache", "--cleanup-cache",
+	"--json", "-q", "--quiet", "-v", "--verbose",
+}
+
+// deniedArg reports whether arg is one of deniedArgs, with or without a
+// value attached by "=".
+func deniedArg(arg string) bool {
+	name, _, _ := strings.Cut(arg, "=")
+	return slices.Contains(deniedArgs, name)
+}
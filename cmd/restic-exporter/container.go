@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Running restic in a container, for hosts where restic can't be installed
+// but Docker or Podman is. Disabled unless a container runtime is set.
+var (
+	envContainerRuntime string
+	envContainerImage   string
+	// envContainerMounts are volumes in the form of --volume, e.g.
+	// /etc/restic:/etc/restic:ro. The cache directory is always mounted.
+	envContainerMounts []string
+	// envContainerArgs are options of the run command in the form
+	// --name=value, e.g. --network=host.
+	envContainerArgs []string
+)
+
+// containerEnvPrefixes are the variables of restic and its backends passed
+// into the container, next to those configured for the repository.
+var containerEnvPrefixes = []string{
+	"RESTIC_", "AWS_", "B2_", "AZURE_", "GOOGLE_", "OS_", "ST_", "RCLONE_",
+	"GOGC=", "GOMEMLIMIT=", "HTTP_PROXY=", "HTTPS_PROXY=", "NO_PROXY=",
+}
+
+// loadContainerEnv reads the settings of the container restic is run in.
+func loadContainerEnv() {
+
+	envContainerImage = getEnv("RESTIC_EXPORTER_CONTAINER_IMAGE", "docker.io/restic/restic")
+	if mounts := os.Getenv("RESTIC_EXPORTER_CONTAINER_MOUNTS"); mounts != "" {
+		envContainerMounts = strings.Split(mounts, ",")
+	}
+	envContainerArgs = strings.Fields(os.Getenv("RESTIC_EXPORTER_CONTAINER_ARGS"))
+	for _, arg := range envContainerArgs {
+		// an argument not starting with - would be taken for the image
+		if !strings.HasPrefix(arg, "-") {
+			panic("RESTIC_EXPORTER_CONTAINER_ARGS: " + arg + " is not an option in the form --name=value")
+		}
+	}
+}
+
+// inContainer returns cmd, a restic invocation, run in a container instead.
+// Options of the run command are single arguments, so that resticArgs finds
+// those of restic following the image.
+func inContainer(ctx context.Context, cmd *exec.Cmd) *exec.Cmd {
+
+	run := []string{"run", "--rm", "--volume=" + envCacheDir + ":" + envCacheDir}
+	for _, mount := range envContainerMounts {
+		run = append(run, "--volume="+mount)
+	}
+	for _, name := range containerEnv(cmd.Env) {
+		// passed without value, so it doesn't show in the process list
+		run = append(run, "--env="+name)
+	}
+	if envResticBin != "" {
+		run = append(run, "--entrypoint="+envResticBin)
+	}
+	run = append(run, envContainerArgs...)
+	run = append(run, envContainerImage)
+
+	c := exec.CommandContext(ctx, envContainerRuntime, append(run, cmd.Args[1:]...)...)
+	c.Env = cmd.Env
+
+	return c
+}
+
+// containerEnv returns the names of the variables of env, or the exporter's
+// environment if nil, to pass into the container: those of restic and its
+// backends, and those set for the repository.
+func containerEnv(env []string) []string {
+
+	own := os.Environ()
+	if env == nil {
+		env = own
+	}
+
+	var names []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "RESTIC_EXPORTER_") || slices.Contains(names, name) {
+			continue
+		}
+		restic := slices.ContainsFunc(containerEnvPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(kv, prefix)
+		})
+		if restic || !slices.Contains(own, kv) {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// resticArgs returns the arguments cmd passes to restic, which follow the
+// image if restic is run in a container.
+func resticArgs(cmd *exec.Cmd) []string {
+
+	args := cmd.Args[1:]
+	if envContainerRuntime != "" {
+		// the first argument of the run command not being an option
+		image := slices.IndexFunc(args[1:], func(arg string) bool { return !strings.HasPrefix(arg, "-") })
+		args = args[image+2:]
+	}
+
+	return args
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "* * * * *"},
+		{spec: "0 3 * * *"},
+		{spec: "*/15 1-5,22 1,15 jan-mar mon-fri"},
+		{spec: "0 0 * * 7"},
+		{spec: "@daily"},
+		{spec: "CRON_TZ=UTC 0 3 * * *"},
+		{spec: "TZ=Europe/Berlin @weekly"},
+		{spec: "* * * *", wantErr: true},
+		{spec: "* * * * * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "* 24 * * *", wantErr: true},
+		{spec: "* * 0 * *", wantErr: true},
+		{spec: "* * * 13 *", wantErr: true},
+		{spec: "* * * * 8", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "* * * foo *", wantErr: true},
+		{spec: "CRON_TZ=Nowhere/Nothing * * * * *", wantErr: true},
+		{spec: "@fortnightly", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseCron(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCron(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronNextPrev(t *testing.T) {
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		t    time.Time
+		next time.Time
+		prev time.Time
+	}{
+		{
+			name: "every minute",
+			spec: "CRON_TZ=UTC * * * * *",
+			t:    utc("2024-05-10T12:30:45Z"),
+			next: utc("2024-05-10T12:31:00Z"),
+			prev: utc("2024-05-10T12:30:00Z"),
+		},
+		{
+			name: "daily",
+			spec: "CRON_TZ=UTC 0 3 * * *",
+			t:    utc("2024-05-10T12:00:00Z"),
+			next: utc("2024-05-11T03:00:00Z"),
+			prev: utc("2024-05-10T03:00:00Z"),
+		},
+		{
+			name: "at the time",
+			spec: "CRON_TZ=UTC 0 3 * * *",
+			t:    utc("2024-05-10T03:00:00Z"),
+			next: utc("2024-05-11T03:00:00Z"),
+			prev: utc("2024-05-10T03:00:00Z"),
+		},
+		{
+			name: "steps and lists",
+			spec: "CRON_TZ=UTC */20 1,13 * * *",
+			t:    utc("2024-05-10T13:45:00Z"),
+			next: utc("2024-05-11T01:00:00Z"),
+			prev: utc("2024-05-10T13:40:00Z"),
+		},
+		{
+			name: "month rollover",
+			spec: "CRON_TZ=UTC 0 0 31 * *",
+			t:    utc("2024-04-15T00:00:00Z"),
+			next: utc("2024-05-31T00:00:00Z"),
+			prev: utc("2024-03-31T00:00:00Z"),
+		},
+		{
+			name: "year rollover",
+			spec: "CRON_TZ=UTC @yearly",
+			t:    utc("2024-12-31T23:59:00Z"),
+			next: utc("2025-01-01T00:00:00Z"),
+			prev: utc("2024-01-01T00:00:00Z"),
+		},
+		{
+			name: "leap day",
+			spec: "CRON_TZ=UTC 0 0 29 feb *",
+			t:    utc("2024-03-01T00:00:00Z"),
+			next: utc("2028-02-29T00:00:00Z"),
+			prev: utc("2024-02-29T00:00:00Z"),
+		},
+		{
+			name: "day names",
+			spec: "CRON_TZ=UTC 0 0 * * sat,sun",
+			// a Wednesday
+			t:    utc("2024-05-15T12:00:00Z"),
+			next: utc("2024-05-18T00:00:00Z"),
+			prev: utc("2024-05-12T00:00:00Z"),
+		},
+		{
+			name: "Sunday as 7",
+			spec: "CRON_TZ=UTC 0 0 * * 7",
+			t:    utc("2024-05-15T12:00:00Z"),
+			next: utc("2024-05-19T00:00:00Z"),
+			prev: utc("2024-05-12T00:00:00Z"),
+		},
+		{
+			name: "day of month or week",
+			spec: "CRON_TZ=UTC 0 0 1 * mon",
+			// a Wednesday, the following Monday is the 20th
+			t:    utc("2024-05-15T12:00:00Z"),
+			next: utc("2024-05-20T00:00:00Z"),
+			prev: utc("2024-05-13T00:00:00Z"),
+		},
+		{
+			name: "day of month and stepped day of week",
+			spec: "CRON_TZ=UTC 0 0 1-7 * */2",
+			// */2 is Sunday, Tuesday, Thursday and Saturday; the 1st of
+			// June is a Saturday, the 7th of May a Tuesday
+			t:    utc("2024-05-15T12:00:00Z"),
+			next: utc("2024-06-01T00:00:00Z"),
+			prev: utc("2024-05-07T00:00:00Z"),
+		},
+		{
+			name: "stepped day of month and day of week",
+			spec: "CRON_TZ=UTC 0 0 */2 * mon",
+			// Mondays on odd days, the 20th is skipped
+			t:    utc("2024-05-15T12:00:00Z"),
+			next: utc("2024-05-27T00:00:00Z"),
+			prev: utc("2024-05-13T00:00:00Z"),
+		},
+		{
+			name: "never",
+			spec: "CRON_TZ=UTC 0 0 30 feb *",
+			t:    utc("2024-05-15T12:00:00Z"),
+		},
+		{
+			name: "time zone",
+			spec: "CRON_TZ=Europe/Berlin 0 3 * * *",
+			t:    utc("2024-05-10T12:00:00Z"),
+			next: utc("2024-05-11T01:00:00Z"),
+			prev: utc("2024-05-10T01:00:00Z"),
+		},
+		{
+			// 02:00 to 03:00 doesn't exist on the 31st of March
+			name: "daylight saving time gap",
+			spec: "CRON_TZ=Europe/Berlin 30 2 * * *",
+			t:    time.Date(2024, 3, 31, 12, 0, 0, 0, berlin),
+			next: time.Date(2024, 4, 1, 2, 30, 0, 0, berlin),
+			prev: time.Date(2024, 3, 30, 2, 30, 0, 0, berlin),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(tt.t); !got.Equal(tt.next) {
+				t.Errorf("next(%v) = %v, want %v", tt.t, got, tt.next)
+			}
+			if got := s.prev(tt.t); !got.Equal(tt.prev) {
+				t.Errorf("prev(%v) = %v, want %v", tt.t, got, tt.prev)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"restic-exporter/pkg/collector"
+)
+
+// envDiffMaxChanges limits the changed paths returned by /api/v1/diff.
+var envDiffMaxChanges = getEnvInt("RESTIC_EXPORTER_DIFF_MAX_CHANGES", 10000)
+
+var (
+	errUnknownSnapshot   = errors.New("unknown snapshot")
+	errAmbiguousSnapshot = errors.New("ambiguous snapshot ID")
+)
+
+// snapshotIDRe matches snapshot IDs and their prefixes as restic accepts
+// them.
+var snapshotIDRe = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+
+// resticDiffMessage is a line of `restic diff --json` output, either a
+// change or the final statistics.
+type resticDiffMessage struct {
+	MessageType string `json:"message_type"`
+
+	// change
+	Path     string `json:"path,omitempty"`
+	Modifier string `json:"modifier,omitempty"`
+
+	// statistics
+	SourceSnapshot string           `json:"source_snapshot,omitempty"`
+	TargetSnapshot string           `json:"target_snapshot,omitempty"`
+	ChangedFiles   int              `json:"changed_files"`
+	Added          *resticDiffStats `json:"added,omitempty"`
+	Removed        *resticDiffStats `json:"removed,omitempty"`
+}
+
+type resticDiffStats struct {
+	Files     int   `json:"files"`
+	Dirs      int   `json:"dirs"`
+	Others    int   `json:"others"`
+	DataBlobs int   `json:"data_blobs"`
+	TreeBlobs int   `json:"tree_blobs"`
+	Bytes     int64 `json:"bytes"`
+}
+
+type apiDiffChange struct {
+	Path     string `json:"path"`
+	Modifier string `json:"modifier"`
+}
+
+type apiDiffResponse struct {
+	Repository string             `json:"repository"`
+	From       string             `json:"from"`
+	To         string             `json:"to"`
+	Changes    []apiDiffChange    `json:"changes"`
+	Truncated  bool               `json:"truncated"`
+	Statistics *resticDiffMessage `json:"statistics"`
+}
+
+// diffHandler serves the changes between two snapshots of a repository as
+// JSON. Without from and to, the latest snapshot, optionally of host, is
+// compared to the one before it.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	from, to, host := query.Get("from"), query.Get("to"), query.Get("host")
+
+	cfg := currentConfig.Load()
+	if err := cfg.ProbeParams.check(host, "", nil); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid parameter: "+err.Error())
+		return
+	}
+	if (from == "") != (to == "") {
+		writeAPIError(w, http.StatusBadRequest, "invalid parameter: from and to must be given together")
+		return
+	}
+	for _, id := range []string{from, to} {
+		if id != "" && id != "latest" && !snapshotIDRe.MatchString(id) {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid parameter: %q is no snapshot ID", id))
+			return
+		}
+	}
+
+	repo := cfg.repository(query.Get("repo"))
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown repository")
+		return
+	}
+
+	// the snapshots are resolved first, as restic failing on unknown ones
+	// would count towards opening the circuit breaker
+	args := []string{"snapshots", "--json"}
+	if host != "" && from == "" {
+		args = append(args, "--host", host)
+	}
+	var snapshots []collector.Snapshot
+	if err := unmarshallFromRestic(r.Context(), repo, &snapshots, args...); err != nil {
+		writeResticError(w, repo, err)
+		return
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+
+	if from == "" {
+		if len(snapshots) < 2 {
+			writeAPIError(w, http.StatusNotFound, "fewer than two snapshots")
+			return
+		}
+		from, to = snapshots[len(snapshots)-2].ID, snapshots[len(snapshots)-1].ID
+	} else {
+		for _, id := range []*string{&from, &to} {
+			resolved, err := resolveSnapshot(snapshots, *id)
+			if errors.Is(err, errAmbiguousSnapshot) {
+				writeAPIError(w, http.StatusBadRequest, "invalid parameter: "+err.Error())
+				return
+			}
+			if err != nil {
+				writeAPIError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			*id = resolved
+		}
+	}
+
+	out, err := runRestic(r.Context(), repo, "diff", "--json", from, to)
+	if err != nil {
+		writeResticError(w, repo, err)
+		return
+	}
+
+	resp := apiDiffResponse{Repository: repo.Name, From: from, To: to, Changes: []apiDiffChange{}}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var msg resticDiffMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			writeAPIError(w, http.StatusBadGateway, "parsing restic output: "+err.Error())
+			return
+		}
+		switch msg.MessageType {
+		case "change":
+			if len(resp.Changes) < envDiffMaxChanges {
+				resp.Changes = append(resp.Changes, apiDiffChange{Path: msg.Path, Modifier: msg.Modifier})
+			} else {
+				resp.Truncated = true
+			}
+		case "statistics":
+			resp.Statistics = &msg
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		writeAPIError(w, http.StatusBadGateway, "parsing restic output: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// resolveSnapshot returns the full ID of the snapshot among snapshots,
+// sorted by time, that id refers to: "latest" or a prefix of its ID.
+func resolveSnapshot(snapshots []collector.Snapshot, id string) (string, error) {
+
+	if id == "latest" {
+		if len(snapshots) == 0 {
+			return "", fmt.Errorf("%w: no snapshots", errUnknownSnapshot)
+		}
+		return snapshots[len(snapshots)-1].ID, nil
+	}
+
+	var resolved string
+	for _, s := range snapshots {
+		if !strings.HasPrefix(s.ID, id) {
+			continue
+		}
+		if resolved != "" {
+			return "", fmt.Errorf("%w %q", errAmbiguousSnapshot, id)
+		}
+		resolved = s.ID
+	}
+	if resolved == "" {
+		return "", fmt.Errorf("%w %q", errUnknownSnapshot, id)
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// discoveryConfig configures the discovery of targets registered in Consul
+// KV or etcd. Backup clients register themselves with a key below the
+// prefix named after their host name. Its value is empty or a JSON object
+// naming the repository, which defaults to the first one, and the tags of
+// the probe, e.g. {"repository": "nas", "tags": ["daily"]}.
+type discoveryConfig struct {
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	Consul *consulDiscovery `yaml:"consul"`
+	Etcd   *etcdDiscovery   `yaml:"etcd"`
+}
+
+type consulDiscovery struct {
+	// Address defaults to CONSUL_HTTP_ADDR.
+	Address    string `yaml:"address"`
+	Datacenter string `yaml:"datacenter"`
+	Prefix     string `yaml:"prefix"`
+	// TokenFile defaults to CONSUL_HTTP_TOKEN.
+	TokenFile string `yaml:"token_file"`
+}
+
+type etcdDiscovery struct {
+	Endpoints    []string `yaml:"endpoints"`
+	Prefix       string   `yaml:"prefix"`
+	Username     string   `yaml:"username"`
+	PasswordFile string   `yaml:"password_file"`
+}
+
+// discoveredValue is the value of a registered target.
+type discoveredValue struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+}
+
+// probeTarget is a host probed for a repository.
+type probeTarget struct {
+	Host string
+	Tags []string
+}
+
+// targets returns the configured and discovered targets of r.
+func (r *repository) targets() []probeTarget {
+
+	targets := make([]probeTarget, 0, len(r.Targets))
+	for _, host := range r.Targets {
+		targets = append(targets, probeTarget{Host: host})
+	}
+	if discovered := r.discovered.Load(); discovered != nil {
+		targets = append(targets, *discovered...)
+	}
+
+	return targets
+}
+
+func (d *discoveryConfig) validate() error {
+
+	if d.Consul == nil && d.Etcd == nil {
+		return nil
+	}
+
+	if d.RefreshInterval == 0 {
+		d.RefreshInterval = time.Minute
+	}
+
+	if c := d.Consul; c != nil {
+		if c.Address == "" {
+			c.Address = os.Getenv("CONSUL_HTTP_ADDR")
+		}
+		if c.Address == "" {
+			return errors.New("consul: address or CONSUL_HTTP_ADDR required")
+		}
+		if !strings.Contains(c.Address, "://") {
+			c.Address = "http://" + c.Address
+		}
+		if c.Prefix == "" {
+			return errors.New("consul: prefix required")
+		}
+	}
+
+	if e := d.Etcd; e != nil {
+		if len(e.Endpoints) == 0 {
+			return errors.New("etcd: endpoints required")
+		}
+		if e.Prefix == "" {
+			return errors.New("etcd: prefix required")
+		}
+		if e.PasswordFile != "" && e.Username == "" {
+			return errors.New("etcd: password_file requires username")
+		}
+	}
+
+	return nil
+}
+
+// discoveryDo sends req and decodes the JSON response into out. A 404 leaves
+// out untouched.
+func discoveryDo(req *http.Request, out interface{}) error {
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list returns the values of the keys below the prefix by host name.
+func (c *consulDiscovery) list(ctx context.Context) (map[string][]byte, error) {
+
+	u := strings.TrimSuffix(c.Address, "/") + "/v1/kv/" + strings.Trim(c.Prefix, "/") + "/?recurse=true"
+	if c.Datacenter != "" {
+		u += "&dc=" + url.QueryEscape(c.Datacenter)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is read every time, so that a rotated token is picked up
+	token := os.Getenv("CONSUL_HTTP_TOKEN")
+	if c.TokenFile != "" {
+		if token, err = readSecretFile(c.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	var kvs []struct {
+		Key   string
+		Value []byte
+	}
+	if err := discoveryDo(req, &kvs); err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+
+	values := map[string][]byte{}
+	for _, kv := range kvs {
+		if host := path.Base(kv.Key); !strings.HasSuffix(kv.Key, "/") && host != "" {
+			values[host] = kv.Value
+		}
+	}
+
+	return values, nil
+}
+
+// list returns the values of the keys below the prefix by host name. It
+// uses the JSON gateway of etcd's v3 API, trying the endpoints in order.
+func (e *etcdDiscovery) list(ctx context.Context) (map[string][]byte, error) {
+
+	prefix := strings.TrimSuffix(e.Prefix, "/") + "/"
+	// the range ending after all keys with the prefix
+	end := []byte(prefix)
+	end[len(end)-1]++
+
+	var errs []error
+	for _, endpoint := range e.Endpoints {
+		values, err := e.listFrom(ctx, strings.TrimSuffix(endpoint, "/"), prefix, end)
+		if err == nil {
+			return values, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("etcd: %w", errors.Join(errs...))
+}
+
+func (e *etcdDiscovery) listFrom(ctx context.Context, endpoint, prefix string, end []byte) (map[string][]byte, error) {
+
+	post := func(api string, body, out interface{}, token string) error {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+api, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		return discoveryDo(req, out)
+	}
+
+	var token string
+	if e.Username != "" {
+		password, err := readSecretFile(e.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		var auth struct {
+			Token string `json:"token"`
+		}
+		if err := post("/v3/auth/authenticate", map[string]string{"name": e.Username, "password": password}, &auth, ""); err != nil {
+			return nil, err
+		}
+		token = auth.Token
+	}
+
+	var resp struct {
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	rangeReq := map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	}
+	if err := post("/v3/kv/range", rangeReq, &resp, token); err != nil {
+		return nil, err
+	}
+
+	values := map[string][]byte{}
+	for _, kv := range resp.Kvs {
+		if host := strings.TrimPrefix(string(kv.Key), prefix); host != "" && !strings.Contains(host, "/") {
+			values[host] = kv.Value
+		}
+	}
+
+	return values, nil
+}
+
+// discoverTargets reads the registered targets and assigns them to the
+// repositories of c. Hosts that are configured as targets are skipped.
+func (c *config) discoverTargets(ctx context.Context) error {
+
+	values := map[string]string{}
+	if c.Discovery.Consul != nil {
+		v, err := c.Discovery.Consul.list(ctx)
+		if err != nil {
+			return err
+		}
+		for host, value := range v {
+			values[host] = string(value)
+		}
+	}
+	if c.Discovery.Etcd != nil {
+		v, err := c.Discovery.Etcd.list(ctx)
+		if err != nil {
+			return err
+		}
+		for host, value := range v {
+			values[host] = string(value)
+		}
+	}
+
+	configured := map[string]bool{}
+	for _, repo := range c.Repositories {
+		for _, host := range repo.Targets {
+			configured[host] = true
+		}
+	}
+
+	discovered := map[*repository][]probeTarget{}
+	for _, host := range sortedKeys(values) {
+		if configured[host] {
+			continue
+		}
+
+		var v discoveredValue
+		if strings.TrimSpace(values[host]) != "" {
+			if err := json.Unmarshal([]byte(values[host]), &v); err != nil {
+				slog.Warn("Ignoring invalid discovered target", "target", host, "err", err)
+				continue
+			}
+		}
+
+		repo := c.repository(v.Repository)
+		if repo == nil && v.Repository != "" && !ownsRepository(v.Repository) {
+			// collected by another shard
+			continue
+		}
+		if repo == nil {
+			slog.Warn("Ignoring discovered target of unknown repository", "target", host, "repository", v.Repository)
+			continue
+		}
+		if err := c.ProbeParams.check(host, "", v.Tags); err != nil {
+			slog.Warn("Ignoring discovered target", "target", host, "err", err)
+			continue
+		}
+		discovered[repo] = append(discovered[repo], probeTarget{Host: host, Tags: v.Tags})
+	}
+
+	for _, repo := range c.Repositories {
+		targets := discovered[repo]
+		repo.discovered.Store(&targets)
+	}
+
+	return nil
+}
+
+// refreshDiscoveredTargets discovers the targets of c every refresh
+// interval until ctx is done. The previous targets are kept on failures.
+func (c *config) refreshDiscoveredTargets(ctx context.Context) {
+
+	ticker := time.NewTicker(c.Discovery.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.discoverTargets(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Discovering targets failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
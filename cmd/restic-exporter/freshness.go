@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"restic-exporter/pkg/collector"
+)
+
+// freshnessDescs describe the metrics telling whether hosts back up as
+// expected.
+type freshnessDescs struct {
+	missed       *prometheus.Desc
+	expectedNext *prometheus.Desc
+	slaBreached  *prometheus.Desc
+	slaOver      *prometheus.Desc
+}
+
+func newFreshnessDescs(labels []string, constLabels prometheus.Labels) *freshnessDescs {
+	return &freshnessDescs{
+		missed:       prometheus.NewDesc("restic_backup_missed", "Whether the latest snapshot is older than the last scheduled backup", labels, constLabels),
+		expectedNext: prometheus.NewDesc("restic_backup_expected_next_timestamp", "Time of the next scheduled backup", labels, constLabels),
+		slaBreached:  prometheus.NewDesc("restic_backup_sla_breached", "Whether the latest snapshot is older than the maximum age of the SLA", labels, constLabels),
+		slaOver:      prometheus.NewDesc("restic_backup_sla_seconds_over", "Seconds the latest snapshot is older than the maximum age of the SLA", labels, constLabels),
+	}
+}
+
+// probeFreshnessDescs are used in the registries of probes.
+var probeFreshnessDescs = newFreshnessDescs([]string{"hostname"}, nil)
+
+func (d *freshnessDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.missed
+	ch <- d.expectedNext
+	ch <- d.slaBreached
+	ch <- d.slaOver
+}
+
+// collect sends the metrics of f labelled with labelValues.
+func (d *freshnessDescs) collect(ch chan<- prometheus.Metric, f freshness, labelValues ...string) {
+
+	if s := f.schedule; s != nil {
+		ch <- prometheus.MustNewConstMetric(d.missed, prometheus.GaugeValue, boolToFloat(s.missed), labelValues...)
+		if !s.next.IsZero() {
+			ch <- prometheus.MustNewConstMetric(d.expectedNext, prometheus.GaugeValue, float64(s.next.Unix()), labelValues...)
+		}
+	}
+
+	if s := f.sla; s != nil {
+		ch <- prometheus.MustNewConstMetric(d.slaBreached, prometheus.GaugeValue, boolToFloat(s.breached), labelValues...)
+		// hosts without snapshots are breached by an unknown amount
+		if s.hasSnapshot {
+			ch <- prometheus.MustNewConstMetric(d.slaOver, prometheus.GaugeValue, s.over.Seconds(), labelValues...)
+		}
+	}
+}
+
+// backupScheduleConfig declares when the targets of a repository are
+// expected to back up, so that missed backups can be detected.
+type backupScheduleConfig struct {
+	// Cron is the schedule of all targets, unless Targets has one for the
+	// target.
+	Cron    string            `yaml:"cron"`
+	Targets map[string]string `yaml:"targets"`
+	// Grace is how long a backup may take after its scheduled time before
+	// it counts as missed. It defaults to an hour.
+	Grace time.Duration `yaml:"grace"`
+
+	cron    *cronSchedule
+	targets map[string]*cronSchedule
+}
+
+func (b *backupScheduleConfig) validate() error {
+
+	if b.Cron == "" && len(b.Targets) == 0 {
+		return nil
+	}
+
+	if b.Grace == 0 {
+		b.Grace = time.Hour
+	}
+	if b.Grace < 0 {
+		return fmt.Errorf("backup_schedule: negative grace")
+	}
+
+	if b.Cron != "" {
+		s, err := parseCron(b.Cron)
+		if err != nil {
+			return fmt.Errorf("backup_schedule: %w", err)
+		}
+		b.cron = s
+	}
+
+	b.targets = map[string]*cronSchedule{}
+	for target, spec := range b.Targets {
+		s, err := parseCron(spec)
+		if err != nil {
+			return fmt.Errorf("backup_schedule: target %q: %w", target, err)
+		}
+		b.targets[target] = s
+	}
+
+	return nil
+}
+
+// backupScheduleState is how a host keeps to its backup schedule.
+type backupScheduleState struct {
+	missed bool
+	next   time.Time
+}
+
+// evaluate returns the state of host with its latest snapshot taken at
+// latest, the zero time if there is none. ok is false if no schedule is
+// configured for host.
+func (b *backupScheduleConfig) evaluate(host string, latest, now time.Time) (state backupScheduleState, ok bool) {
+
+	s := b.targets[host]
+	if s == nil {
+		s = b.cron
+	}
+	if s == nil {
+		return state, false
+	}
+
+	// the backup of the last window is due once its grace period is over
+	if due := s.prev(now.Add(-b.Grace)); !due.IsZero() {
+		state.missed = latest.Before(due)
+	}
+	state.next = s.next(now)
+
+	return state, true
+}
+
+// slaConfig declares the maximum age of the latest snapshot of the targets
+// of a repository. The first rule matching a target applies, and MaxAge
+// otherwise.
+type slaConfig struct {
+	MaxAge model.Duration `yaml:"max_age"`
+	Rules  []slaRule      `yaml:"rules"`
+}
+
+type slaRule struct {
+	// Match is a target name or a pattern as understood by path.Match,
+	// e.g. laptop-*.
+	Match  string         `yaml:"match"`
+	MaxAge model.Duration `yaml:"max_age"`
+}
+
+func (c *slaConfig) validate() error {
+
+	if c.MaxAge < 0 {
+		return fmt.Errorf("sla: negative max_age")
+	}
+	for i, r := range c.Rules {
+		if _, err := path.Match(r.Match, ""); err != nil || r.Match == "" {
+			return fmt.Errorf("sla: rule %d: invalid match %q", i, r.Match)
+		}
+		if r.MaxAge <= 0 {
+			return fmt.Errorf("sla: rule %d: max_age required", i)
+		}
+	}
+
+	return nil
+}
+
+// slaState is how a host keeps to its SLA.
+type slaState struct {
+	breached    bool
+	hasSnapshot bool
+	over        time.Duration
+}
+
+// evaluate returns the state of host with its latest snapshot taken at
+// latest, the zero time if there is none. ok is false if no SLA applies to
+// host.
+func (c *slaConfig) evaluate(host string, latest, now time.Time) (state slaState, ok bool) {
+
+	maxAge := time.Duration(c.MaxAge)
+	for _, r := range c.Rules {
+		if matched, _ := path.Match(r.Match, host); matched {
+			maxAge = time.Duration(r.MaxAge)
+			break
+		}
+	}
+	if maxAge <= 0 {
+		return state, false
+	}
+
+	if latest.IsZero() {
+		return slaState{breached: true}, true
+	}
+	state.hasSnapshot = true
+	state.over = max(now.Sub(latest)-maxAge, 0)
+	state.breached = state.over > 0
+
+	return state, true
+}
+
+// freshness is how a host keeps to its backup schedule and SLA. Either is
+// nil if not configured for the host.
+type freshness struct {
+	schedule *backupScheduleState
+	sla      *slaState
+}
+
+// freshnessOf returns the freshness of host of repo with its latest
+// snapshot taken at latest. ok is false if neither a schedule nor an SLA
+// applies to host.
+func freshnessOf(repo *repository, host string, latest time.Time) (f freshness, ok bool) {
+
+	now := time.Now()
+	if s, ok := repo.BackupSchedule.evaluate(host, latest, now); ok {
+		f.schedule = &s
+	}
+	if s, ok := repo.SLA.evaluate(host, latest, now); ok {
+		f.sla = &s
+	}
+
+	return f, f.schedule != nil || f.sla != nil
+}
+
+// freshnessCollector exports the freshness of a probed host.
+type freshnessCollector struct {
+	host      string
+	freshness freshness
+}
+
+// newFreshnessCollector returns a collector for the freshness of host with
+// its latest snapshot taken at latest, or nil if repo has neither a schedule
+// nor an SLA for it.
+func newFreshnessCollector(repo *repository, host string, latest time.Time) *freshnessCollector {
+
+	f, ok := freshnessOf(repo, host, latest)
+	if !ok {
+		return nil
+	}
+
+	return &freshnessCollector{host: host, freshness: f}
+}
+
+func (c *freshnessCollector) Describe(ch chan<- *prometheus.Desc) {
+	probeFreshnessDescs.describe(ch)
+}
+
+func (c *freshnessCollector) Collect(ch chan<- prometheus.Metric) {
+	probeFreshnessDescs.collect(ch, c.freshness, c.host)
+}
+
+// freshnessCollectors export the freshness of several probed hosts.
+type freshnessCollectors []*freshnessCollector
+
+func (c freshnessCollectors) Describe(ch chan<- *prometheus.Desc) {
+	probeFreshnessDescs.describe(ch)
+}
+
+func (c freshnessCollectors) Collect(ch chan<- prometheus.Metric) {
+	for _, f := range c {
+		f.Collect(ch)
+	}
+}
+
+// latestSnapshotTime returns the time of the latest snapshot of a probe, or
+// the zero time if there is none.
+func latestSnapshotTime(rd *collector.Result) time.Time {
+	if len(rd.Snapshots) == 0 {
+		return time.Time{}
+	}
+	return rd.Snapshots[0].Time
+}
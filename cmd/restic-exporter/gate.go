@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errRepositoryBusy is returned when another operation holds the gate of a
+// repository.
+var errRepositoryBusy = errors.New("repository busy")
+
+// repositoryGate lets one of the operations the exporter starts on its own
+// run against a repository at a time: maintenance, backups, restore tests
+// and stale lock removal. They write to the repository or would fail on the
+// exclusive lock of prune, so the API refuses to start them concurrently
+// instead of leaving restic to fail.
+type repositoryGate struct {
+	sem chan struct{}
+
+	mu     sync.Mutex
+	holder string
+}
+
+var (
+	gatesMu sync.Mutex
+	gates   = map[string]*repositoryGate{}
+)
+
+func gateFor(repository string) *repositoryGate {
+
+	gatesMu.Lock()
+	defer gatesMu.Unlock()
+
+	g, ok := gates[repository]
+	if !ok {
+		g = &repositoryGate{sem: make(chan struct{}, 1)}
+		gates[repository] = g
+	}
+
+	return g
+}
+
+// tryAcquire takes g for op. It returns errRepositoryBusy, naming the
+// operation holding g, if g is taken.
+func (g *repositoryGate) tryAcquire(op string) error {
+	select {
+	case g.sem <- struct{}{}:
+		g.setHolder(op)
+		return nil
+	default:
+		return fmt.Errorf("%w: %s running", errRepositoryBusy, g.heldBy())
+	}
+}
+
+// acquire waits until g is free and takes it for op, or until ctx is done.
+func (g *repositoryGate) acquire(ctx context.Context, op string) error {
+	select {
+	case g.sem <- struct{}{}:
+		g.setHolder(op)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *repositoryGate) release() {
+	g.setHolder("")
+	<-g.sem
+}
+
+// heldBy returns the operation holding g, "" if it is free.
+func (g *repositoryGate) heldBy() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.holder
+}
+
+func (g *repositoryGate) setHolder(op string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.holder = op
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"restic-exporter/pkg/collector"
+)
+
+// envGroupsInterval enables the snapshot group metrics, listing the
+// snapshots of every repository at most once per interval.
+var envGroupsInterval = getEnvDuration("RESTIC_EXPORTER_GROUPS_INTERVAL", 0)
+
+// envGroupsByUsername adds the number and latest time of the snapshots of
+// every host and user to the group metrics.
+var envGroupsByUsername = os.Getenv("RESTIC_EXPORTER_GROUPS_BY_USERNAME") == "true"
+
+// envGroupsVanishedRetention is how long groups that vanished from a
+// repository, e.g. because forget removed their last snapshot, are reported
+// as vanished.
+var envGroupsVanishedRetention = getEnvDuration("RESTIC_EXPORTER_GROUPS_VANISHED_RETENTION", 24*time.Hour)
+
+// envGroupsStatsTimeout bounds the restic stats runs estimating the data
+// added by snapshots without summary each time the snapshots are listed.
+var envGroupsStatsTimeout = getEnvDuration("RESTIC_EXPORTER_GROUPS_STATS_TIMEOUT", time.Minute)
+
+// defaultExpectedHostsInterval is how often the snapshots of repositories
+// with expected hosts are listed if the group metrics are disabled.
+const defaultExpectedHostsInterval = 5 * time.Minute
+
+var (
+	groupLatestTimeDesc = prometheus.NewDesc(
+		"restic_group_latest_time",
+		"Time of the latest snapshot of the group",
+		[]string{"repository", "hostname", "paths", "tags"}, nil,
+	)
+	groupLatestSizeDesc = prometheus.NewDesc(
+		"restic_group_latest_total_size",
+		"Bytes processed by the backup creating the latest snapshot of the group, as recorded by restic 0.17 and later",
+		[]string{"repository", "hostname", "paths", "tags"}, nil,
+	)
+	groupLatestFilesDesc = prometheus.NewDesc(
+		"restic_group_latest_total_nfiles",
+		"Files processed by the backup creating the latest snapshot of the group, as recorded by restic 0.17 and later",
+		[]string{"repository", "hostname", "paths", "tags"}, nil,
+	)
+	groupLatestDataAddedDesc = prometheus.NewDesc(
+		"restic_group_latest_data_added",
+		"Bytes the backup creating the latest snapshot of the group added to the repository, before compression",
+		[]string{"repository", "hostname", "paths", "tags"}, nil,
+	)
+	groupSnapshotsDesc = prometheus.NewDesc(
+		"restic_group_snapshots",
+		"Number of snapshots of the group",
+		[]string{"repository", "hostname", "paths", "tags"}, nil,
+	)
+	groupVanishedDesc = prometheus.NewDesc(
+		"restic_group_vanished_timestamp_seconds",
+		"Time the group was first found missing from the repository",
+		[]string{"repository", "hostname", "paths", "tags"}, nil,
+	)
+	userLatestTimeDesc = prometheus.NewDesc(
+		"restic_user_latest_time",
+		"Time of the latest snapshot of the host taken by the user",
+		[]string{"repository", "hostname", "username"}, nil,
+	)
+	userSnapshotsDesc = prometheus.NewDesc(
+		"restic_user_snapshots",
+		"Number of snapshots of the host taken by the user",
+		[]string{"repository", "hostname", "username"}, nil,
+	)
+	hostUntaggedSnapshotsDesc = prometheus.NewDesc(
+		"restic_host_untagged_snapshots",
+		"Number of snapshots of the host without tags",
+		[]string{"repository", "hostname"}, nil,
+	)
+	expectedHostPresentDesc = prometheus.NewDesc(
+		"restic_expected_host_present",
+		"Whether the expected host has snapshots in the repository",
+		[]string{"repository", "hostname"}, nil,
+	)
+)
+
+// groupsCollector exports metrics for the latest snapshot of every host,
+// paths and tags combination present in the repositories, so that new hosts
+// are monitored without probes being configured for them. It also reports
+// whether the expected hosts of the repositories have snapshots.
+type groupsCollector struct {
+	mu sync.Mutex
+	// groups caches the groups by repository name and location, so that
+	// restic runs at most once per interval.
+	groups map[[2]string]cachedGroups
+	// vanished holds the time groups were found missing by repository name
+	// and location, and group labels.
+	vanished map[[2]string]map[[3]string]time.Time
+	// rawSizes caches the raw data size of snapshots by repository name and
+	// location, and snapshot ID, which never changes.
+	rawSizes map[[2]string]map[string]int64
+	// refreshing holds the lock listing the snapshots of a repository by
+	// name and location.
+	refreshing map[[2]string]*sync.Mutex
+}
+
+type cachedGroups struct {
+	listed time.Time
+	groups []*collector.Group
+	// users is only set with envGroupsByUsername.
+	users []*collector.UserGroup
+	// added holds the bytes added by the latest snapshot of the groups by
+	// snapshot ID, if known.
+	added map[string]int64
+}
+
+func (c *groupsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- groupLatestTimeDesc
+	ch <- groupLatestSizeDesc
+	ch <- groupLatestFilesDesc
+	ch <- groupLatestDataAddedDesc
+	ch <- groupSnapshotsDesc
+	ch <- groupVanishedDesc
+	ch <- userLatestTimeDesc
+	ch <- userSnapshotsDesc
+	ch <- hostUntaggedSnapshotsDesc
+	ch <- expectedHostPresentDesc
+}
+
+func (c *groupsCollector) Collect(ch chan<- prometheus.Metric) {
+
+	ctx := context.Background()
+
+	for _, repo := range currentConfig.Load().Repositories {
+		if envGroupsInterval == 0 && len(repo.ExpectedHosts) == 0 {
+			continue
+		}
+
+		listing, err := c.snapshotGroups(ctx, repo)
+		if err != nil {
+			slog.Error("Listing snapshot groups failed", "repository", repo.Name, "err", err)
+			if envGroupsInterval != 0 {
+				collectHistoryGroups(repo, ch)
+			}
+			continue
+		}
+
+		present := map[string]bool{}
+		for _, g := range listing.groups {
+			present[g.Hostname] = true
+		}
+		for _, host := range repo.ExpectedHosts {
+			ch <- prometheus.MustNewConstMetric(expectedHostPresentDesc, prometheus.GaugeValue, boolToFloat(present[host]), repo.Name, host)
+		}
+
+		if envGroupsInterval == 0 {
+			continue
+		}
+		// hosts without untagged snapshots are reported with 0, so that
+		// alerts on stray snapshots resolve once they are tagged or
+		// forgotten
+		untagged := map[string]int{}
+		for _, g := range listing.groups {
+			labels := []string{repo.Name, g.Hostname, g.Paths, g.Tags}
+			n := untagged[g.Hostname]
+			if g.Tags == "" {
+				n += g.Snapshots
+			}
+			untagged[g.Hostname] = n
+			ch <- prometheus.MustNewConstMetric(groupLatestTimeDesc, prometheus.GaugeValue, float64(g.Latest.Time.Unix()), labels...)
+			ch <- prometheus.MustNewConstMetric(groupSnapshotsDesc, prometheus.GaugeValue, float64(g.Snapshots), labels...)
+			if s := g.Latest.Summary; s != nil {
+				ch <- prometheus.MustNewConstMetric(groupLatestSizeDesc, prometheus.GaugeValue, float64(s.TotalBytesProcessed), labels...)
+				ch <- prometheus.MustNewConstMetric(groupLatestFilesDesc, prometheus.GaugeValue, float64(s.TotalFilesProcessed), labels...)
+			}
+			if added, ok := listing.added[g.Latest.ID]; ok {
+				ch <- prometheus.MustNewConstMetric(groupLatestDataAddedDesc, prometheus.GaugeValue, float64(added), labels...)
+			}
+		}
+		for host, n := range untagged {
+			ch <- prometheus.MustNewConstMetric(hostUntaggedSnapshotsDesc, prometheus.GaugeValue, float64(n), repo.Name, host)
+		}
+		for _, u := range listing.users {
+			labels := []string{repo.Name, u.Hostname, u.Username}
+			ch <- prometheus.MustNewConstMetric(userLatestTimeDesc, prometheus.GaugeValue, float64(u.Latest.Time.Unix()), labels...)
+			ch <- prometheus.MustNewConstMetric(userSnapshotsDesc, prometheus.GaugeValue, float64(u.Snapshots), labels...)
+		}
+		for g, at := range c.vanishedGroups(repo) {
+			ch <- prometheus.MustNewConstMetric(groupVanishedDesc, prometheus.GaugeValue, float64(at.Unix()), repo.Name, g[0], g[1], g[2])
+		}
+	}
+}
+
+// collectHistoryGroups exports the latest snapshots of the groups of repo as
+// recorded in the history, so that they don't go missing while restic fails,
+// e.g. after the exporter restarted. Numbers of snapshots are left out, the
+// history holds forgotten ones as well.
+func collectHistoryGroups(repo *repository, ch chan<- prometheus.Metric) {
+
+	if history == nil {
+		return
+	}
+
+	records, err := history.snapshots(repo.Name)
+	if err != nil {
+		slog.Error("Reading history failed", "repository", repo.Name, "err", err)
+		return
+	}
+
+	snapshots := make([]collector.Snapshot, 0, len(records))
+	for _, r := range records {
+		s := collector.Snapshot{ID: r.ID, Time: r.Time, Hostname: r.Hostname, Paths: r.Paths, Tags: r.Tags, Username: r.Username}
+		if r.Size > 0 {
+			s.Summary = &collector.SnapshotSummary{TotalBytesProcessed: r.Size, TotalFilesProcessed: int(r.Files), DataAdded: r.DataAdded}
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	for _, g := range collector.GroupSnapshots(snapshots) {
+		labels := []string{repo.Name, g.Hostname, g.Paths, g.Tags}
+		ch <- prometheus.MustNewConstMetric(groupLatestTimeDesc, prometheus.GaugeValue, float64(g.Latest.Time.Unix()), labels...)
+		if s := g.Latest.Summary; s != nil {
+			ch <- prometheus.MustNewConstMetric(groupLatestSizeDesc, prometheus.GaugeValue, float64(s.TotalBytesProcessed), labels...)
+			ch <- prometheus.MustNewConstMetric(groupLatestFilesDesc, prometheus.GaugeValue, float64(s.TotalFilesProcessed), labels...)
+			if s.DataAdded > 0 {
+				ch <- prometheus.MustNewConstMetric(groupLatestDataAddedDesc, prometheus.GaugeValue, float64(s.DataAdded), labels...)
+			}
+		}
+	}
+}
+
+// vanishedGroups returns the groups of repo that vanished within
+// envGroupsVanishedRetention, and when.
+func (c *groupsCollector) vanishedGroups(repo *repository) map[[3]string]time.Time {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vanished := map[[3]string]time.Time{}
+	for g, at := range c.vanished[[2]string{repo.Name, repo.Repository}] {
+		if time.Since(at) < envGroupsVanishedRetention {
+			vanished[g] = at
+		}
+	}
+
+	return vanished
+}
+
+// snapshotGroups returns the snapshot groups of repo, and those by user with
+// envGroupsByUsername, listing its snapshots if the cached groups are older
+// than envGroupsInterval, or defaultExpectedHostsInterval if the group
+// metrics are disabled. restic runs holding only the refresh lock of repo,
+// so scrapes of other repositories don't wait for it.
+func (c *groupsCollector) snapshotGroups(ctx context.Context, repo *repository) (cachedGroups, error) {
+
+	interval := envGroupsInterval
+	if interval == 0 {
+		interval = defaultExpectedHostsInterval
+	}
+
+	key := [2]string{repo.Name, repo.Repository}
+	refresh := c.refreshLock(key)
+	refresh.Lock()
+	defer refresh.Unlock()
+
+	c.mu.Lock()
+	cached, ok := c.groups[key]
+	knownSizes := c.rawSizes[key]
+	c.mu.Unlock()
+	if ok && time.Since(cached.listed) < interval {
+		return cached, nil
+	}
+
+	var snapshots []collector.Snapshot
+	if err := unmarshallFromRestic(ctx, repo, &snapshots, "snapshots", "--json"); err != nil {
+		return cachedGroups{}, err
+	}
+	recordHistory(repo.Name, snapshots)
+	groups := collector.GroupSnapshots(snapshots)
+	var users []*collector.UserGroup
+	if envGroupsByUsername {
+		users = collector.GroupSnapshotsByUser(snapshots)
+	}
+	var added, rawSizes map[string]int64
+	if envGroupsInterval != 0 {
+		added, rawSizes = dataAdded(ctx, repo, knownSizes, groups)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.groups == nil {
+		c.groups = map[[2]string]cachedGroups{}
+		c.vanished = map[[2]string]map[[3]string]time.Time{}
+		c.rawSizes = map[[2]string]map[string]int64{}
+	}
+	if cached, ok := c.groups[key]; ok {
+		c.trackVanished(key, cached.groups, groups)
+	}
+	if rawSizes != nil {
+		// sizes of snapshots no longer latest or previous are forgotten
+		c.rawSizes[key] = rawSizes
+	}
+	c.groups[key] = cachedGroups{listed: time.Now(), groups: groups, users: users, added: added}
+
+	return c.groups[key], nil
+}
+
+// refreshLock returns the lock held while listing the snapshots of the
+// repository key, so that concurrent scrapes list them once.
+func (c *groupsCollector) refreshLock(key [2]string) *sync.Mutex {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refreshing == nil {
+		c.refreshing = map[[2]string]*sync.Mutex{}
+	}
+	l, ok := c.refreshing[key]
+	if !ok {
+		l = &sync.Mutex{}
+		c.refreshing[key] = l
+	}
+
+	return l
+}
+
+// dataAdded returns the bytes added by the latest snapshot of each group by
+// snapshot ID. They are taken from the snapshot summary restic 0.17 and
+// later record. For older snapshots, they are estimated by the growth of the
+// raw data referenced by the latest snapshot over the previous one, which
+// omits data the latest snapshot no longer references. The raw sizes are
+// taken from known, or from restic within envGroupsStatsTimeout, and
+// returned for the next listing; groups whose sizes aren't known by then
+// are left out until it.
+func dataAdded(ctx context.Context, repo *repository, known map[string]int64, groups []*collector.Group) (added, rawSizes map[string]int64) {
+
+	ctx, cancel := context.WithTimeout(ctx, envGroupsStatsTimeout)
+	defer cancel()
+
+	rawSizes = map[string]int64{}
+	rawSize := func(id string) (int64, bool) {
+		if size, ok := known[id]; ok {
+			rawSizes[id] = size
+			return size, true
+		}
+		if ctx.Err() != nil {
+			return 0, false
+		}
+		var stats resticRepoStatsData
+		if err := unmarshallFromRestic(ctx, repo, &stats, "stats", "--json", "--mode", "raw-data", id); err != nil {
+			slog.Error("Getting snapshot stats failed", "repository", repo.Name, "snapshot", id, "err", err)
+			return 0, false
+		}
+		size := stats.TotalUncompressedSize
+		if size == 0 {
+			// repositories of format version 1 are not compressed
+			size = stats.TotalSize
+		}
+		rawSizes[id] = size
+		return size, true
+	}
+
+	added = map[string]int64{}
+	for _, g := range groups {
+		if s := g.Latest.Summary; s != nil {
+			added[g.Latest.ID] = s.DataAdded
+			continue
+		}
+		if g.Previous == nil {
+			continue
+		}
+		latest, ok := rawSize(g.Latest.ID)
+		if !ok {
+			continue
+		}
+		previous, ok := rawSize(g.Previous.ID)
+		if !ok {
+			continue
+		}
+		added[g.Latest.ID] = max(latest-previous, 0)
+	}
+
+	return added, rawSizes
+}
+
+// trackVanished records the groups missing from the current listing of a
+// repository that were in the previous one. Groups that reappear, and those
+// vanished longer than envGroupsVanishedRetention ago, are forgotten.
+func (c *groupsCollector) trackVanished(key [2]string, previous, current []*collector.Group) {
+
+	vanished := c.vanished[key]
+	if vanished == nil {
+		vanished = map[[3]string]time.Time{}
+		c.vanished[key] = vanished
+	}
+
+	now := time.Now()
+	present := map[[3]string]bool{}
+	for _, g := range current {
+		present[[3]string{g.Hostname, g.Paths, g.Tags}] = true
+	}
+	for _, g := range previous {
+		k := [3]string{g.Hostname, g.Paths, g.Tags}
+		if _, ok := vanished[k]; !ok && !present[k] {
+			vanished[k] = now
+		}
+	}
+	for k, at := range vanished {
+		if present[k] || now.Sub(at) >= envGroupsVanishedRetention {
+			delete(vanished, k)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var repositoryGrowthDesc = prometheus.NewDesc(
+	"restic_repository_growth_bytes_per_day",
+	"Growth of the raw data size of the repository per day, fitted over the window",
+	[]string{"repository", "window"}, nil,
+)
+
+// growthWindows are the windows growth rates are exported for.
+var growthWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+const (
+	// growthSampleInterval is the minimum time between the raw size
+	// samples kept for a repository.
+	growthSampleInterval = time.Hour
+	// growthMinCoverage is the share of a window the samples must span
+	// before its growth rate is reported, so that e.g. the 30 day rate
+	// isn't fitted over a single day.
+	growthMinCoverage = 0.75
+)
+
+type sizeSample struct {
+	at   time.Time
+	size int64
+}
+
+var (
+	growthMu sync.Mutex
+	// growthSamples holds the raw size samples of the last 30 days by
+	// repository name and location, oldest first.
+	growthSamples = map[[2]string][]sizeSample{}
+	// growthLoaded tells which repositories' samples were read from the
+	// history.
+	growthLoaded = map[[2]string]bool{}
+)
+
+// growthHistoryKey identifies the samples of a repository in the history.
+// The location is hashed, as it may contain credentials.
+func growthHistoryKey(key [2]string) string {
+	sum := sha256.Sum256([]byte(key[1]))
+	return key[0] + "@" + hex.EncodeToString(sum[:8])
+}
+
+// samplesOf returns the raw size samples of the repository key, which are
+// read from the history the first time if it is enabled, so they survive
+// restarts. growthMu must be held.
+func samplesOf(key [2]string) []sizeSample {
+
+	if history != nil && !growthLoaded[key] {
+		growthLoaded[key] = true
+		samples, err := history.sizes(growthHistoryKey(key))
+		if err != nil {
+			slog.Error("Reading history failed", "repository", key[0], "err", err)
+		}
+		growthSamples[key] = append(samples, growthSamples[key]...)
+	}
+
+	return growthSamples[key]
+}
+
+// recordRawSize adds a raw size sample of repo, unless the last one is
+// more recent than growthSampleInterval. The sample is also recorded in the
+// history, if enabled.
+func recordRawSize(repo *repository, size int64, at time.Time) {
+
+	growthMu.Lock()
+	defer growthMu.Unlock()
+
+	key := [2]string{repo.Name, repo.Repository}
+	samples := samplesOf(key)
+	if n := len(samples); n > 0 && at.Sub(samples[n-1].at) < growthSampleInterval {
+		return
+	}
+
+	sample := sizeSample{at: at, size: size}
+	samples = append(samples, sample)
+	oldest := at.Add(-growthWindows[len(growthWindows)-1].duration)
+	for len(samples) > 0 && samples[0].at.Before(oldest) {
+		samples = samples[1:]
+	}
+	growthSamples[key] = samples
+
+	if history != nil {
+		if err := history.recordSize(growthHistoryKey(key), sample, oldest); err != nil {
+			slog.Error("Recording history failed", "repository", repo.Name, "err", err)
+		}
+	}
+}
+
+// growthRate returns the growth of the raw size of repo in bytes per day
+// within window before now. It is the slope of a least squares fit, so
+// irregular gaps between samples don't skew it. ok is false if the samples
+// span less than growthMinCoverage of window.
+func growthRate(repo *repository, window time.Duration, now time.Time) (rate float64, ok bool) {
+
+	growthMu.Lock()
+	defer growthMu.Unlock()
+
+	var in []sizeSample
+	for _, s := range samplesOf([2]string{repo.Name, repo.Repository}) {
+		if now.Sub(s.at) <= window {
+			in = append(in, s)
+		}
+	}
+	if len(in) < 2 || in[len(in)-1].at.Sub(in[0].at) < time.Duration(growthMinCoverage*float64(window)) {
+		return 0, false
+	}
+
+	// days and sizes are taken relative to the first sample for precision
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range in {
+		x := s.at.Sub(in[0].at).Hours() / 24
+		y := float64(s.size - in[0].size)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(in))
+
+	return (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX), true
+}
+
+// collectGrowth exports the growth rates of repo.
+func collectGrowth(repo *repository, ch chan<- prometheus.Metric) {
+
+	now := time.Now()
+	for _, w := range growthWindows {
+		if rate, ok := growthRate(repo, w.duration, now); ok {
+			ch <- prometheus.MustNewConstMetric(repositoryGrowthDesc, prometheus.GaugeValue, rate, repo.Name, w.name)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGrowthRate(t *testing.T) {
+
+	now := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		days   int
+		want7  bool
+		want30 bool
+	}{
+		{name: "a day", days: 1},
+		{name: "most of a week", days: 6, want7: true},
+		{name: "most of a month", days: 25, want7: true, want30: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &repository{Name: tt.name, Repository: "/srv/restic"}
+			// 1 GB a day
+			for h := tt.days * 24; h >= 0; h-- {
+				recordRawSize(repo, int64(100e9-float64(h)*1e9/24), now.Add(-time.Duration(h)*time.Hour))
+			}
+
+			for _, w := range []struct {
+				window time.Duration
+				want   bool
+			}{{7 * 24 * time.Hour, tt.want7}, {30 * 24 * time.Hour, tt.want30}} {
+				rate, ok := growthRate(repo, w.window, now)
+				if ok != w.want {
+					t.Fatalf("growthRate(%v) reported %v, want %v", w.window, ok, w.want)
+				}
+				if ok && math.Abs(rate-1e9) > 1e3 {
+					t.Errorf("growthRate(%v) = %v, want 1e9", w.window, rate)
+				}
+			}
+		})
+	}
+}
+
+func TestGrowthHistory(t *testing.T) {
+
+	store, err := openHistory(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history = store
+	defer func() {
+		history = nil
+		store.close()
+	}()
+
+	repo := &repository{Name: "persisted", Repository: "/srv/restic"}
+	now := time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)
+	for d := 40; d >= 0; d-- {
+		recordRawSize(repo, int64(100e9-float64(d)*1e9), now.Add(-time.Duration(d)*24*time.Hour))
+	}
+
+	// a restart forgets the samples in memory
+	growthMu.Lock()
+	growthSamples, growthLoaded = map[[2]string][]sizeSample{}, map[[2]string]bool{}
+	growthMu.Unlock()
+
+	rate, ok := growthRate(repo, 30*24*time.Hour, now)
+	if !ok || math.Abs(rate-1e9) > 1e3 {
+		t.Errorf("growthRate() after restart = %v, %v, want 1e9", rate, ok)
+	}
+
+	samples, err := store.sizes(growthHistoryKey([2]string{repo.Name, repo.Repository}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 31 {
+		t.Errorf("history holds %d samples, want those of the last 30 days", len(samples))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// envReadyRequiresRepository makes the exporter report ready only once a
+// repository responded to restic.
+var envReadyRequiresRepository = os.Getenv("RESTIC_EXPORTER_READY_REQUIRES_REPOSITORY") == "true"
+
+// envReadyPingInterval is how long readiness checks reuse the result of
+// pinging the repositories.
+var envReadyPingInterval = getEnvDuration("RESTIC_EXPORTER_READY_PING_INTERVAL", 30*time.Second)
+
+var configLoaded atomic.Bool
+
+// readyPing is the result of the latest ping of the repositories.
+var readyPing struct {
+	sync.Mutex
+	at time.Time
+	ok bool
+}
+
+// healthzHandler reports the exporter as alive as long as it serves HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// readyzHandler reports whether the exporter is able to serve probes.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !configLoaded.Load() {
+		http.Error(w, "configuration not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	bin := envResticBin
+	if envContainerRuntime != "" {
+		bin = envContainerRuntime
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		http.Error(w, "restic binary not found: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if envReadyRequiresRepository && !anyRepositoryResponded() && !pingRepositoriesCached(r.Context()) {
+		http.Error(w, "no repository responded", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+// pingRepositories reports whether any repository responds to restic. Nothing
+// may have run restic yet, e.g. because no traffic is routed to the exporter
+// until it is ready, so readiness checks run it themselves.
+func pingRepositories(ctx context.Context) bool {
+	for _, repo := range currentConfig.Load().Repositories {
+		if _, err := runRestic(ctx, repo, "cat", "config"); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// pingRepositoriesCached pings the repositories at most once per
+// envReadyPingInterval, so requests to the unauthenticated /readyz can't
+// make the exporter run restic at will. Concurrent checks wait for the
+// running ping.
+func pingRepositoriesCached(ctx context.Context) bool {
+
+	readyPing.Lock()
+	defer readyPing.Unlock()
+
+	if !readyPing.at.IsZero() && time.Since(readyPing.at) < envReadyPingInterval {
+		return readyPing.ok
+	}
+
+	ok := pingRepositories(ctx)
+	if ctx.Err() == nil {
+		// a cancelled check says nothing about the repositories
+		readyPing.at, readyPing.ok = time.Now(), ok
+	}
+
+	return ok
+}
+
+func anyRepositoryResponded() bool {
+	for _, name := range configuredRepositories() {
+		if !statusOf(name).LastSuccess.IsZero() {
+			return true
+		}
+	}
+	return false
+}
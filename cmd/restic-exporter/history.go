@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"restic-exporter/pkg/collector"
+)
+
+var (
+	historySnapshotsDesc = prometheus.NewDesc(
+		"restic_history_snapshots",
+		"Number of snapshots of the host recorded in the history, including forgotten ones",
+		[]string{"repository", "hostname"}, nil,
+	)
+	historyFirstSnapshotDesc = prometheus.NewDesc(
+		"restic_history_first_snapshot_time",
+		"Time of the first snapshot of the host recorded in the history",
+		[]string{"repository", "hostname"}, nil,
+	)
+	historyBackupsPerWeekDesc = prometheus.NewDesc(
+		"restic_history_backups_per_week",
+		"Average number of snapshots of the host per week since the first one recorded",
+		[]string{"repository", "hostname"}, nil,
+	)
+	historyAverageSizeDesc = prometheus.NewDesc(
+		"restic_history_average_size_bytes",
+		"Average size of the snapshots of the host recorded in the history",
+		[]string{"repository", "hostname"}, nil,
+	)
+	historyLongestGapDesc = prometheus.NewDesc(
+		"restic_history_longest_gap_seconds",
+		"Longest time between snapshots of the host recorded in the history, or since the latest one",
+		[]string{"repository", "hostname"}, nil,
+	)
+)
+
+var historyDataGap = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "restic_exporter",
+		Name:      "data_gap_seconds",
+		Help:      "Time the exporter was down before it started, as recorded in the history",
+	},
+)
+
+// historyAliveInterval is how often the exporter records in the history
+// that it is running, bounding how much a data gap is underestimated.
+const historyAliveInterval = time.Minute
+
+// history records the snapshots the exporter observes, so that they can be
+// aggregated after they were forgotten and Prometheus dropped their series.
+// It is nil unless RESTIC_EXPORTER_HISTORY_PATH is set.
+var history historyStore
+
+// historyStore keeps the snapshots of repositories by ID.
+type historyStore interface {
+	// record adds snapshots of repository, merging them with those
+	// recorded already.
+	record(repository string, records []historyRecord) error
+	// snapshots returns all recorded snapshots of repository.
+	snapshots(repository string) ([]historyRecord, error)
+	// recordSize adds a raw size sample of the repository identified by
+	// key, dropping those taken before oldest.
+	recordSize(key string, sample sizeSample, oldest time.Time) error
+	// sizes returns the raw size samples of key, oldest first.
+	sizes(key string) ([]sizeSample, error)
+	// alive returns when the exporter was last recorded to be running, zero
+	// if never.
+	alive() (time.Time, error)
+	setAlive(at time.Time) error
+	close() error
+}
+
+// stopHistoryAlive stops recording that the exporter is running.
+var stopHistoryAlive func()
+
+// historyRecord is a snapshot in the history. Sizes are zero if unknown.
+type historyRecord struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Hostname  string    `json:"hostname"`
+	Paths     []string  `json:"paths,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Files     int64     `json:"files,omitempty"`
+	DataAdded int64     `json:"data_added,omitempty"`
+}
+
+// merge returns r with the unknown sizes taken from other, a record of the
+// same snapshot.
+func (r historyRecord) merge(other historyRecord) historyRecord {
+
+	if r.Size == 0 {
+		r.Size = other.Size
+	}
+	if r.Files == 0 {
+		r.Files = other.Files
+	}
+	if r.DataAdded == 0 {
+		r.DataAdded = other.DataAdded
+	}
+
+	return r
+}
+
+// newHistoryRecord returns the record of s. Sizes are taken from the
+// snapshot summary, if restic recorded one.
+func newHistoryRecord(s collector.Snapshot) historyRecord {
+
+	r := historyRecord{ID: s.ID, Time: s.Time, Hostname: s.Hostname, Paths: s.Paths, Tags: s.Tags, Username: s.Username}
+	if sum := s.Summary; sum != nil {
+		r.Size = sum.TotalBytesProcessed
+		r.Files = int64(sum.TotalFilesProcessed)
+		r.DataAdded = sum.DataAdded
+	}
+
+	return r
+}
+
+// setupHistory opens the history store at RESTIC_EXPORTER_HISTORY_PATH,
+// exports for how long the exporter was down since it last ran, and starts
+// recording that it is running.
+func setupHistory() error {
+
+	path := getEnv("RESTIC_EXPORTER_HISTORY_PATH", "")
+	if path == "" {
+		return nil
+	}
+
+	store, err := openHistory(path)
+	if err != nil {
+		return fmt.Errorf("RESTIC_EXPORTER_HISTORY_PATH: %w", err)
+	}
+	history = store
+
+	now := time.Now()
+	alive, err := history.alive()
+	if err != nil {
+		return fmt.Errorf("RESTIC_EXPORTER_HISTORY_PATH: %w", err)
+	}
+	if !alive.IsZero() && now.After(alive) {
+		historyDataGap.Set(now.Sub(alive).Seconds())
+		slog.Info("Exporter was down", "since", alive, "gap", now.Sub(alive).Round(time.Second))
+	}
+	if err := history.setAlive(now); err != nil {
+		return fmt.Errorf("RESTIC_EXPORTER_HISTORY_PATH: %w", err)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(historyAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				if err := history.setAlive(now); err != nil {
+					slog.Error("Recording history failed", "err", err)
+				}
+			}
+		}
+	}()
+	stopHistoryAlive = func() {
+		close(stop)
+		<-done
+	}
+
+	return nil
+}
+
+// closeHistory records when the exporter stopped and closes the history
+// store, if any.
+func closeHistory() {
+	if history == nil {
+		return
+	}
+	stopHistoryAlive()
+	if err := history.setAlive(time.Now()); err != nil {
+		slog.Error("Recording history failed", "err", err)
+	}
+	if err := history.close(); err != nil {
+		slog.Error("Closing history failed", "err", err)
+	}
+}
+
+// recordHistory adds snapshots of repository to the history, if enabled.
+// Failures are logged only, the history is not essential.
+func recordHistory(repository string, snapshots []collector.Snapshot) {
+
+	if history == nil || len(snapshots) == 0 {
+		return
+	}
+
+	records := make([]historyRecord, 0, len(snapshots))
+	for _, s := range snapshots {
+		if s.ID != "" {
+			records = append(records, newHistoryRecord(s))
+		}
+	}
+	if err := history.record(repository, records); err != nil {
+		slog.Error("Recording history failed", "repository", repository, "err", err)
+	}
+}
+
+// recordProbeHistory adds the latest snapshot of a probe result to the
+// history, with the size and file count of its stats.
+func recordProbeHistory(repository string, res *collector.Result) {
+
+	if history == nil || len(res.Snapshots) == 0 || res.Snapshots[0].ID == "" {
+		return
+	}
+
+	r := newHistoryRecord(res.Snapshots[0])
+	r.Size, r.Files = int64(res.Stats.TotalSize), int64(res.Stats.TotalFileCount)
+	if err := history.record(repository, []historyRecord{r}); err != nil {
+		slog.Error("Recording history failed", "repository", repository, "err", err)
+	}
+}
+
+// hostHistory aggregates the recorded snapshots of a host.
+type hostHistory struct {
+	Hostname       string    `json:"hostname"`
+	Snapshots      int       `json:"snapshots"`
+	First          time.Time `json:"first"`
+	Last           time.Time `json:"last"`
+	BackupsPerWeek float64   `json:"backups_per_week"`
+	// AverageSize is that of the snapshots whose size is known.
+	AverageSize int64 `json:"average_size"`
+	// LongestGap includes the time since the last snapshot.
+	LongestGapSeconds float64 `json:"longest_gap_seconds"`
+}
+
+// aggregateHistory aggregates records by host, ordered by host name.
+func aggregateHistory(records []historyRecord, now time.Time) []hostHistory {
+
+	byHost := map[string][]historyRecord{}
+	for _, r := range records {
+		byHost[r.Hostname] = append(byHost[r.Hostname], r)
+	}
+
+	hosts := make([]hostHistory, 0, len(byHost))
+	for host, records := range byHost {
+		slices.SortFunc(records, func(a, b historyRecord) int { return a.Time.Compare(b.Time) })
+
+		h := hostHistory{Hostname: host, Snapshots: len(records), First: records[0].Time, Last: records[len(records)-1].Time}
+
+		// spans shorter than a week would inflate the rate
+		weeks := max(now.Sub(h.First).Hours()/(24*7), 1)
+		h.BackupsPerWeek = float64(len(records)) / weeks
+
+		var sum, sized int64
+		gap := now.Sub(h.Last)
+		for i, r := range records {
+			if r.Size > 0 {
+				sum += r.Size
+				sized++
+			}
+			if i > 0 {
+				gap = max(gap, r.Time.Sub(records[i-1].Time))
+			}
+		}
+		if sized > 0 {
+			h.AverageSize = sum / sized
+		}
+		h.LongestGapSeconds = gap.Seconds()
+
+		hosts = append(hosts, h)
+	}
+	slices.SortFunc(hosts, func(a, b hostHistory) int { return strings.Compare(a.Hostname, b.Hostname) })
+
+	return hosts
+}
+
+// historyCollector exports the aggregated history of all repositories. It
+// is registered only if the history is enabled.
+type historyCollector struct{}
+
+func (historyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- historySnapshotsDesc
+	ch <- historyFirstSnapshotDesc
+	ch <- historyBackupsPerWeekDesc
+	ch <- historyAverageSizeDesc
+	ch <- historyLongestGapDesc
+}
+
+func (historyCollector) Collect(ch chan<- prometheus.Metric) {
+
+	now := time.Now()
+	for _, repo := range currentConfig.Load().Repositories {
+		records, err := history.snapshots(repo.Name)
+		if err != nil {
+			slog.Error("Reading history failed", "repository", repo.Name, "err", err)
+			continue
+		}
+
+		for _, h := range aggregateHistory(records, now) {
+			ch <- prometheus.MustNewConstMetric(historySnapshotsDesc, prometheus.GaugeValue, float64(h.Snapshots), repo.Name, h.Hostname)
+			ch <- prometheus.MustNewConstMetric(historyFirstSnapshotDesc, prometheus.GaugeValue, float64(h.First.Unix()), repo.Name, h.Hostname)
+			ch <- prometheus.MustNewConstMetric(historyBackupsPerWeekDesc, prometheus.GaugeValue, h.BackupsPerWeek, repo.Name, h.Hostname)
+			if h.AverageSize > 0 {
+				ch <- prometheus.MustNewConstMetric(historyAverageSizeDesc, prometheus.GaugeValue, float64(h.AverageSize), repo.Name, h.Hostname)
+			}
+			ch <- prometheus.MustNewConstMetric(historyLongestGapDesc, prometheus.GaugeValue, h.LongestGapSeconds, repo.Name, h.Hostname)
+		}
+	}
+}
+
+type apiHistoryResponse struct {
+	Repository string        `json:"repository"`
+	Hosts      []hostHistory `json:"hosts"`
+	// Snapshots are only listed for a single host.
+	Snapshots []historyRecord `json:"snapshots,omitempty"`
+}
+
+// historyHandler serves the aggregated history of a repository, and the
+// recorded snapshots if a host is given.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+
+	if history == nil {
+		writeAPIError(w, http.StatusNotFound, "history not enabled")
+		return
+	}
+
+	repo := currentConfig.Load().repository(r.URL.Query().Get("repo"))
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown repository")
+		return
+	}
+
+	records, err := history.snapshots(repo.Name)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "reading history failed: "+err.Error())
+		return
+	}
+
+	resp := apiHistoryResponse{Repository: repo.Name, Hosts: aggregateHistory(records, time.Now())}
+	if host := r.URL.Query().Get("host"); host != "" {
+		resp.Hosts = slices.DeleteFunc(resp.Hosts, func(h hostHistory) bool { return h.Hostname != host })
+		resp.Snapshots = slices.DeleteFunc(records, func(r historyRecord) bool { return r.Hostname != host })
+		slices.SortFunc(resp.Snapshots, func(a, b historyRecord) int { return a.Time.Compare(b.Time) })
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,195 @@
+//go:build !js
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// snapshotsBucket holds a bucket per repository, with the snapshots as
+	// JSON by ID.
+	snapshotsBucket = []byte("snapshots")
+	// sizesBucket holds a bucket per repository, with the raw size samples
+	// by time.
+	sizesBucket = []byte("sizes")
+	// metaBucket holds the state of the exporter.
+	metaBucket = []byte("meta")
+	aliveKey   = []byte("alive")
+)
+
+// boltHistory keeps the history in a bbolt database.
+type boltHistory struct {
+	db *bolt.DB
+}
+
+func openHistory(path string) (historyStore, error) {
+
+	// a second exporter on the same file fails instead of waiting forever
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltHistory{db: db}, nil
+}
+
+func (h *boltHistory) record(repository string, records []historyRecord) error {
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		snapshots, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		if err != nil {
+			return err
+		}
+		b, err := snapshots.CreateBucketIfNotExists([]byte(repository))
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			if old := b.Get([]byte(r.ID)); old != nil {
+				var recorded historyRecord
+				if err := json.Unmarshal(old, &recorded); err == nil {
+					r = r.merge(recorded)
+				}
+			}
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(r.ID), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (h *boltHistory) snapshots(repository string) ([]historyRecord, error) {
+
+	var records []historyRecord
+	err := h.db.View(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(snapshotsBucket)
+		if snapshots == nil {
+			return nil
+		}
+		b := snapshots.Bucket([]byte(repository))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var r historyRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+			return nil
+		})
+	})
+
+	return records, err
+}
+
+// sizeSampleKey orders the samples of a bucket by time.
+func sizeSampleKey(at time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))
+}
+
+func (h *boltHistory) recordSize(key string, sample sizeSample, oldest time.Time) error {
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		sizes, err := tx.CreateBucketIfNotExists(sizesBucket)
+		if err != nil {
+			return err
+		}
+		b, err := sizes.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put(sizeSampleKey(sample.at), binary.BigEndian.AppendUint64(nil, uint64(sample.size))); err != nil {
+			return err
+		}
+
+		// deleting moves the cursor, so each iteration starts over
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, sizeSampleKey(oldest)) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (h *boltHistory) sizes(key string) ([]sizeSample, error) {
+
+	var samples []sizeSample
+	err := h.db.View(func(tx *bolt.Tx) error {
+		sizes := tx.Bucket(sizesBucket)
+		if sizes == nil {
+			return nil
+		}
+		b := sizes.Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(k) != 8 || len(v) != 8 {
+				return fmt.Errorf("invalid size sample in %s", key)
+			}
+			samples = append(samples, sizeSample{
+				at:   time.Unix(0, int64(binary.BigEndian.Uint64(k))),
+				size: int64(binary.BigEndian.Uint64(v)),
+			})
+			return nil
+		})
+	})
+
+	return samples, err
+}
+
+func (h *boltHistory) alive() (time.Time, error) {
+
+	var alive time.Time
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(aliveKey); v != nil {
+			return alive.UnmarshalText(v)
+		}
+		return nil
+	})
+
+	return alive, err
+}
+
+func (h *boltHistory) setAlive(at time.Time) error {
+
+	v, err := at.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(aliveKey, v)
+	})
+}
+
+func (h *boltHistory) close() error {
+	return h.db.Close()
+}
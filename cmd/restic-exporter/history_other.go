@@ -0,0 +1,10 @@
+//go:build js
+
+package main
+
+import "errors"
+
+// openHistory fails, bbolt needs memory mapped files.
+func openHistory(path string) (historyStore, error) {
+	return nil, errors.New("history not supported on this platform")
+}
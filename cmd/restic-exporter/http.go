@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "restic_exporter",
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests served by the exporter",
+		},
+		[]string{"handler", "code", "method"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		withNativeHistogram(prometheus.HistogramOpts{
+			Namespace: "restic_exporter",
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests served by the exporter",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		}),
+		[]string{"handler", "code", "method"},
+	)
+)
+
+// envAccessLog enables logging every HTTP request.
+var envAccessLog = os.Getenv("RESTIC_EXPORTER_ACCESS_LOG") == "true"
+
+// HTTP server timeouts. Probes can take minutes, so responses aren't limited
+// by default; slow clients are cut off while sending their request.
+var (
+	envHTTPReadHeaderTimeout = getEnvDuration("RESTIC_EXPORTER_HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	envHTTPReadTimeout       = getEnvDuration("RESTIC_EXPORTER_HTTP_READ_TIMEOUT", time.Minute)
+	envHTTPWriteTimeout      = getEnvDuration("RESTIC_EXPORTER_HTTP_WRITE_TIMEOUT", 0)
+	envHTTPIdleTimeout       = getEnvDuration("RESTIC_EXPORTER_HTTP_IDLE_TIMEOUT", 2*time.Minute)
+)
+
+// newHTTPServer returns a server for h on address with the configured
+// timeouts.
+func newHTTPServer(address string, h http.Handler) *http.Server {
+
+	if envHTTPWriteTimeout > 0 {
+		h = withDeadline(envHTTPWriteTimeout, h)
+	}
+
+	return &http.Server{
+		Addr:              address,
+		Handler:           h,
+		ReadHeaderTimeout: envHTTPReadHeaderTimeout,
+		ReadTimeout:       envHTTPReadTimeout,
+		WriteTimeout:      envHTTPWriteTimeout,
+		IdleTimeout:       envHTTPIdleTimeout,
+	}
+}
+
+// withDeadline cancels requests to h after timeout. The server drops the
+// response once its write timeout passes, so restic is stopped instead of
+// running on for nobody.
+func withDeadline(timeout time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// instrumentHandler records metrics for requests to the handler registered
+// as name, and logs them if access logging is enabled. The client address is
+// passed on in the request context for the audit log.
+func instrumentHandler(name string, h http.Handler) http.Handler {
+
+	next := h
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withClient(r.Context(), r.RemoteAddr)))
+	})
+
+	labels := prometheus.Labels{"handler": name}
+	h = promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels), h)
+	h = promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), h)
+
+	if envAccessLog {
+		h = accessLog(h)
+	}
+
+	return h
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes of streaming responses on.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+
+		slog.Info("HTTP request",
+			"client", r.RemoteAddr,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"params", r.URL.RawQuery,
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// validateStaticLabels checks the names of static labels.
+func validateStaticLabels(labels map[string]string) error {
+
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// labelsGatherer adds the static labels of repositories and targets to the
+// metrics gathered from g, renames them as configured, then applies the
+// metric relabeling rules. Metrics belong to the repository and target named
+// by their repository and target or hostname labels. Non-empty labels
+// metrics already have are kept.
+type labelsGatherer struct {
+	g prometheus.Gatherer
+	// repo and target are set for probes, whose metrics don't name them.
+	repo   *repository
+	target string
+	// self is set for the metrics about the exporter added to probes,
+	// which are not filtered like those on /metrics.
+	self bool
+}
+
+// withLabels returns g adding the static labels of repositories and
+// targets, and relabeling metrics.
+func withLabels(g prometheus.Gatherer) prometheus.Gatherer {
+	return labelsGatherer{g: g}
+}
+
+// withProbeLabels returns g adding the static labels of repo and target to
+// the metrics of a probe, and relabeling them.
+func withProbeLabels(g prometheus.Gatherer, repo *repository, target string) prometheus.Gatherer {
+	return labelsGatherer{g: g, repo: repo, target: target}
+}
+
+func (l labelsGatherer) Gather() ([]*dto.MetricFamily, error) {
+
+	mfs, err := l.g.Gather()
+
+	cfg := currentConfig.Load()
+	if l.repo == nil && !l.self {
+		mfs = filterSelf(mfs, cfg.Metrics.metricsSelfGroups())
+	}
+	addStaticLabels(mfs, cfg, l.repo, l.target)
+
+	mfs, renameErr := cfg.Metrics.rename(mfs)
+
+	return relabel(mfs, cfg.MetricRelabelConfigs), errors.Join(err, renameErr)
+}
+
+// addStaticLabels adds the static labels of the repositories and targets of
+// cfg to mfs. repo and target are set for probes.
+func addStaticLabels(mfs []*dto.MetricFamily, cfg *config, repo *repository, target string) {
+
+	repos := map[string]*repository{}
+	labeled := false
+	for _, repo := range cfg.Repositories {
+		repos[repo.Name] = repo
+		labeled = labeled || len(repo.Labels) > 0 || len(repo.TargetLabels) > 0
+	}
+	if !labeled {
+		return
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			repo, target, hostname := repo, target, ""
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "repository":
+					if repo == nil {
+						repo = repos[lp.GetValue()]
+					}
+				case "target":
+					if target == "" {
+						target = lp.GetValue()
+					}
+				case "hostname":
+					hostname = lp.GetValue()
+				}
+			}
+			if target == "" {
+				target = hostname
+			}
+			if repo == nil {
+				continue
+			}
+
+			addLabels(m, repo.TargetLabels[target])
+			addLabels(m, repo.Labels)
+		}
+	}
+}
+
+// addLabels adds labels to m, keeping the non-empty labels of the same name
+// m has.
+func addLabels(m *dto.Metric, labels map[string]string) {
+
+	if len(labels) == 0 {
+		return
+	}
+
+	for _, name := range sortedKeys(labels) {
+		i := slices.IndexFunc(m.Label, func(lp *dto.LabelPair) bool { return lp.GetName() == name })
+		switch {
+		case i < 0:
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+		case m.Label[i].GetValue() == "":
+			// empty labels are the same as missing ones
+			m.Label[i].Value = proto.String(labels[name])
+		}
+	}
+	slices.SortFunc(m.Label, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Restic Exporter</title></head>
+<body>
+<h1>Restic Exporter</h1>
+<p>Version {{.Version}} (commit {{.Commit}}, built {{.Date}})</p>
+<h2>Endpoints</h2>
+<ul>
+<li><a href="metrics">/metrics</a> &ndash; repository and exporter metrics</li>
+<li><a href="ui">/ui</a> &ndash; dashboard of backup freshness</li>
+<li><a href="probe?target=myhost">/probe?target=myhost&amp;path=/home&amp;tags=daily</a> &ndash; latest snapshot of a host, path and/or tags</li>
+<li><a href="healthz">/healthz</a>, <a href="readyz">/readyz</a> &ndash; health checks</li>
+</ul>
+<h2>Repositories</h2>
+<table>
+<tr><th>Repository</th><th>Last run</th><th>Last success</th><th>Last error</th></tr>
+{{range .Repositories}}<tr>
+<td>{{.Name}}</td>
+<td>{{if .Status.LastRun.IsZero}}never{{else}}{{.Status.LastRun.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{if .Status.LastSuccess.IsZero}}never{{else}}{{.Status.LastSuccess.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{.Status.LastError}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type landingRepository struct {
+	Name   string
+	Status repositoryStatus
+}
+
+// landingHandler serves an overview of the exporter at /.
+func landingHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var repos []landingRepository
+	for _, name := range configuredRepositories() {
+		repos = append(repos, landingRepository{Name: name, Status: statusOf(name)})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := landingTemplate.Execute(w, struct {
+		Version, Commit, Date string
+		Repositories          []landingRepository
+	}{version, commit, date, repos})
+	if err != nil {
+		slog.Error("Rendering landing page failed", "err", err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var leaderGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "restic_exporter",
+		Name:      "leader",
+		Help:      "Whether this replica is the leader running scheduled jobs",
+	},
+)
+
+// envLeaseDuration is how long a leader holds the lease without renewing it.
+var envLeaseDuration = getEnvDuration("RESTIC_EXPORTER_LEADER_ELECTION_LEASE", 15*time.Second)
+
+// leading tells whether this replica runs scheduled jobs. Without leader
+// election it always does.
+var leading atomic.Bool
+
+// isLeader reports whether scheduled jobs, such as restore tests and stale
+// lock removal, should run on this replica.
+func isLeader() bool {
+	return leading.Load()
+}
+
+// leaseLock is a lease only one replica holds at a time.
+type leaseLock interface {
+	// acquire takes or renews the lease for identity and tells whether
+	// identity holds it afterwards.
+	acquire(ctx context.Context, identity string) (bool, error)
+	// release gives up the lease if identity holds it.
+	release(ctx context.Context, identity string) error
+}
+
+// elector holds the lease while this replica is the leader. It is nil
+// unless leader election is enabled.
+var elector *leaderElector
+
+type leaderElector struct {
+	lock     leaseLock
+	identity string
+}
+
+// setupLeaderElection enables leader election if
+// RESTIC_EXPORTER_LEADER_ELECTION is kubernetes or file.
+func setupLeaderElection() error {
+
+	mode := os.Getenv("RESTIC_EXPORTER_LEADER_ELECTION")
+	if mode == "" {
+		leading.Store(true)
+		leaderGauge.Set(1)
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	identity := getEnv("RESTIC_EXPORTER_LEADER_ELECTION_IDENTITY", fmt.Sprintf("%s-%d", hostname, os.Getpid()))
+
+	var lock leaseLock
+	switch mode {
+	case "kubernetes":
+		lock, err = kubernetesLeaseFromEnv()
+		if err != nil {
+			return err
+		}
+	case "file":
+		path := os.Getenv("RESTIC_EXPORTER_LEADER_ELECTION_FILE")
+		if path == "" {
+			return errors.New("RESTIC_EXPORTER_LEADER_ELECTION_FILE not set")
+		}
+		if !fileLocking {
+			return errors.New("file leader election not supported on this platform")
+		}
+		lock = fileLease{path: path}
+	default:
+		return fmt.Errorf("unknown leader election %q", mode)
+	}
+
+	elector = &leaderElector{lock: lock, identity: identity}
+
+	return nil
+}
+
+// run tries to acquire or renew the lease several times per lease duration
+// until ctx is done, and then releases it.
+func (e *leaderElector) run(ctx context.Context) {
+
+	ticker := time.NewTicker(envLeaseDuration / 3)
+	defer ticker.Stop()
+
+	var renewed time.Time
+	for {
+		ok, err := e.lock.acquire(ctx, e.identity)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				slog.Error("Renewing leader lease failed", "err", err)
+			}
+			// a leader that can't renew in time has to assume it lost the lease
+			if time.Since(renewed) >= envLeaseDuration {
+				e.setLeading(false)
+			}
+		case ok:
+			renewed = time.Now()
+			e.setLeading(true)
+		default:
+			e.setLeading(false)
+		}
+
+		select {
+		case <-ctx.Done():
+			if leading.Load() {
+				e.setLeading(false)
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := e.lock.release(ctx, e.identity); err != nil {
+					slog.Error("Releasing leader lease failed", "err", err)
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaderElector) setLeading(l bool) {
+	if leading.Swap(l) != l {
+		if l {
+			slog.Info("Became leader", "identity", e.identity)
+		} else {
+			slog.Info("Lost leadership", "identity", e.identity)
+		}
+	}
+	leaderGauge.Set(boolToFloat(l))
+}
+
+// fileLease is a lease stored in a file on storage shared by the replicas,
+// which needs to support atomic renames and file locks. The lease is read
+// and written holding an exclusive lock on a file next to it, so that only
+// one replica at a time can take over an expired lease.
+type fileLease struct {
+	path string
+}
+
+type fileLeaseData struct {
+	Holder    string    `json:"holder"`
+	RenewTime time.Time `json:"renew_time"`
+}
+
+func (f fileLease) read() (*fileLeaseData, error) {
+
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &fileLeaseData{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lease fileLeaseData
+	if err := json.Unmarshal(data, &lease); err != nil {
+		// a corrupt lease is taken over like an expired one
+		return &fileLeaseData{}, nil
+	}
+
+	return &lease, nil
+}
+
+func (f fileLease) acquire(ctx context.Context, identity string) (bool, error) {
+
+	unlock, err := lockFile(ctx, f.path+".lock")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	lease, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	if lease.Holder != identity && lease.Holder != "" && time.Since(lease.RenewTime) < envLeaseDuration {
+		return false, nil
+	}
+
+	data, err := json.Marshal(fileLeaseData{Holder: identity, RenewTime: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".restic-exporter-lease-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (f fileLease) release(ctx context.Context, identity string) error {
+
+	unlock, err := lockFile(ctx, f.path+".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	lease, err := f.read()
+	if err != nil || lease.Holder != identity {
+		return err
+	}
+
+	return os.Remove(f.path)
+}
+
+// kubernetesLease is a coordination.k8s.io/v1 Lease, accessed with the
+// service account of the pod.
+type kubernetesLease struct {
+	client    *http.Client
+	url       string
+	name      string
+	namespace string
+	tokenFile string
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type kubernetesLeaseObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// kubernetesMicroTime is the format of MicroTime fields.
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func kubernetesLeaseFromEnv() (*kubernetesLease, error) {
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes leader election requires running in a pod")
+	}
+
+	namespace := os.Getenv("RESTIC_EXPORTER_LEADER_ELECTION_NAMESPACE")
+	if namespace == "" {
+		data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in service account ca.crt")
+	}
+
+	return &kubernetesLease{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:       "https://" + net.JoinHostPort(host, port),
+		name:      getEnv("RESTIC_EXPORTER_LEADER_ELECTION_NAME", "restic-exporter"),
+		namespace: namespace,
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}, nil
+}
+
+// do sends a request to the API server and decodes the response into out.
+// It returns the response status.
+func (k *kubernetesLease) do(ctx context.Context, method, path string, body, out interface{}) (int, error) {
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.url+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// the file is read every time, as the kubelet rotates the token
+	token, err := readSecretFile(k.tokenFile)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("kubernetes: %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *kubernetesLease) acquire(ctx context.Context, identity string) (bool, error) {
+
+	leases := "/apis/coordination.k8s.io/v1/namespaces/" + k.namespace + "/leases"
+
+	var lease kubernetesLeaseObject
+	status, err := k.do(ctx, http.MethodGet, leases+"/"+k.name, nil, &lease)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if status == http.StatusNotFound {
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name, lease.Metadata.Namespace = k.name, k.namespace
+	} else if holder := lease.Spec.HolderIdentity; holder != identity && holder != "" {
+		renewed, err := time.Parse(kubernetesMicroTime, lease.Spec.RenewTime)
+		duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+		if err == nil && now.Sub(renewed) < duration {
+			return false, nil
+		}
+	}
+
+	if lease.Spec.HolderIdentity != identity {
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(envLeaseDuration.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(kubernetesMicroTime)
+
+	// the resource version makes the update fail with a conflict if
+	// another replica changed the lease in the meantime
+	if status == http.StatusNotFound {
+		status, err = k.do(ctx, http.MethodPost, leases, lease, &lease)
+	} else {
+		status, err = k.do(ctx, http.MethodPut, leases+"/"+k.name, lease, &lease)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return status != http.StatusConflict && status != http.StatusNotFound, nil
+}
+
+func (k *kubernetesLease) release(ctx context.Context, identity string) error {
+
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + k.namespace + "/leases/" + k.name
+
+	var lease kubernetesLeaseObject
+	status, err := k.do(ctx, http.MethodGet, path, nil, &lease)
+	if err != nil || status == http.StatusNotFound || lease.Spec.HolderIdentity != identity {
+		return err
+	}
+
+	// a released lease is taken over by the next replica trying
+	lease.Spec.HolderIdentity = ""
+	_, err = k.do(ctx, http.MethodPut, path, lease, &lease)
+
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// fileLocking tells whether file leases can be locked on this platform.
+const fileLocking = false
+
+// lockFile fails on platforms without flock, leader election has to use a
+// Kubernetes lease.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	return nil, errors.New("file locking not supported on this platform")
+}
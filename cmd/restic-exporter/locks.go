@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	locksDesc = prometheus.NewDesc(
+		"restic_locks",
+		"Number of locks held on the repository",
+		[]string{"repository", "hostname", "username", "pid", "exclusive"}, nil,
+	)
+	locksOldestAgeDesc = prometheus.NewDesc(
+		"restic_locks_oldest_age_seconds",
+		"Age of the oldest lock held on the repository",
+		[]string{"repository", "hostname", "username", "pid", "exclusive"}, nil,
+	)
+)
+
+var locksRemoved = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "restic",
+		Subsystem: "locks",
+		Name:      "removed_total",
+		Help:      "Number of stale locks removed by the exporter",
+	},
+	[]string{"repository"},
+)
+
+// envUnlockAfter enables running `restic unlock` once a lock is older than
+// the given duration.
+var envUnlockAfter = getEnvDuration("RESTIC_EXPORTER_UNLOCK_AFTER", 0)
+
+var unlockRemovedRe = regexp.MustCompile(`removed (\d+) locks`)
+
+type resticLockData struct {
+	Time      time.Time `json:"time"`
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	Username  string    `json:"username"`
+	PID       int       `json:"pid"`
+}
+
+// lockOwner groups locks by the process holding them.
+type lockOwner struct {
+	hostname  string
+	username  string
+	pid       int
+	exclusive bool
+}
+
+// listLocks returns all locks of the repository. The exporter must not lock
+// the repository itself while doing so, or it would show up in the result.
+func listLocks(ctx context.Context, repo *repository) ([]resticLockData, error) {
+
+	out, err := runRestic(ctx, repo, "list", "locks", "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []resticLockData
+	for _, id := range strings.Fields(string(out)) {
+		var lock resticLockData
+		if err := unmarshallFromRestic(ctx, repo, &lock, "cat", "lock", id, "--no-lock"); err != nil {
+			// the lock may have been released in the meantime
+			continue
+		}
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
+func collectLocks(ctx context.Context, repo *repository, ch chan<- prometheus.Metric) error {
+
+	locks, err := listLocks(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	var (
+		count  = map[lockOwner]int{}
+		oldest = map[lockOwner]time.Time{}
+	)
+	for _, l := range locks {
+		o := lockOwner{l.Hostname, l.Username, l.PID, l.Exclusive}
+		count[o]++
+		if t, ok := oldest[o]; !ok || l.Time.Before(t) {
+			oldest[o] = l.Time
+		}
+	}
+
+	now := time.Now()
+
+	// only the leader removes locks, so that replicas don't race
+	if envUnlockAfter > 0 && isLeader() {
+		for _, t := range oldest {
+			if now.Sub(t) > envUnlockAfter {
+				if err := unlock(ctx, repo); err != nil {
+					slog.Error("Removing stale locks failed", "repository", repo.Name, "err", err)
+				}
+				break
+			}
+		}
+	}
+
+	for o, n := range count {
+		labels := []string{repo.Name, o.hostname, o.username, strconv.Itoa(o.pid), strconv.FormatBool(o.exclusive)}
+		ch <- prometheus.MustNewConstMetric(locksDesc, prometheus.GaugeValue, float64(n), labels...)
+		ch <- prometheus.MustNewConstMetric(locksOldestAgeDesc, prometheus.GaugeValue, now.Sub(oldest[o]).Seconds(), labels...)
+	}
+
+	return nil
+}
+
+// unlock removes stale locks. Without --remove-all restic only removes locks
+// whose owner is gone, so locks of running processes are left alone. It is
+// skipped until the next collection while another operation of the exporter
+// holds the gate of repo.
+func unlock(ctx context.Context, repo *repository) error {
+
+	gate := gateFor(repo.Name)
+	if err := gate.tryAcquire("unlock"); err != nil {
+		slog.Debug("Stale lock removal postponed", "repository", repo.Name, "err", err)
+		return nil
+	}
+	defer gate.release()
+
+	out, err := runRestic(ctx, repo, "unlock")
+	if err != nil {
+		return err
+	}
+
+	if m := unlockRemovedRe.FindSubmatch(out); m != nil {
+		n, _ := strconv.Atoi(string(m[1]))
+		locksRemoved.WithLabelValues(repo.Name).Add(float64(n))
+		slog.Info("Removed stale locks", "repository", repo.Name, "count", n)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogging configures the default logger from RESTIC_EXPORTER_LOG_LEVEL
+// (debug, info, warn, error) and RESTIC_EXPORTER_LOG_FORMAT (text, json).
+func setupLogging() error {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("RESTIC_EXPORTER_LOG_LEVEL", "info"))); err != nil {
+		return fmt.Errorf("RESTIC_EXPORTER_LOG_LEVEL: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch format := getEnv("RESTIC_EXPORTER_LOG_FORMAT", "text"); format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("RESTIC_EXPORTER_LOG_FORMAT: unknown format %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// kitLogger passes the log lines of libraries using go-kit/log, such as the
+// exporter toolkit, on to the default logger.
+type kitLogger struct{}
+
+func (kitLogger) Log(keyvals ...interface{}) error {
+
+	var (
+		level = slog.LevelInfo
+		msg   string
+		args  []any
+	)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key, val := fmt.Sprint(keyvals[i]), keyvals[i+1]
+		switch key {
+		case "level":
+			switch fmt.Sprint(val) {
+			case "debug":
+				level = slog.LevelDebug
+			case "warn":
+				level = slog.LevelWarn
+			case "error":
+				level = slog.LevelError
+			}
+		case "msg":
+			msg = fmt.Sprint(val)
+		default:
+			args = append(args, key, val)
+		}
+	}
+	slog.Log(context.Background(), level, msg, args...)
+
+	return nil
+}
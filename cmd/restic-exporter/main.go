@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"restic-exporter/pkg/collector"
+)
+
+var (
+	envResticBin string
+	envPort      string
+	envAddress   string
+	envCacheDir  string
+)
+
+// envProbeErrorStatus is the HTTP status returned when a probe fails. If
+// unset, the probe's metrics are served as usual with restic_scrape_error
+// set to 1.
+var envProbeErrorStatus = getEnvInt("RESTIC_EXPORTER_PROBE_ERROR_STATUS", 0)
+
+// loadEnv reads the required settings. It is called after parsing flags, so
+// e.g. --version works without any environment.
+func loadEnv() {
+	envContainerRuntime = getEnv("RESTIC_EXPORTER_CONTAINER_RUNTIME", "")
+	if envContainerRuntime == "" {
+		envResticBin = getEnvNotEmpty("RESTIC_EXPORTER_BIN")
+	} else {
+		// restic in the image, by default its entrypoint
+		envResticBin = getEnv("RESTIC_EXPORTER_BIN", "")
+		loadContainerEnv()
+	}
+	envPort = getEnvNotEmpty("RESTIC_EXPORTER_PORT")
+	envAddress = getEnvNotEmpty("RESTIC_EXPORTER_ADDRESS")
+	envCacheDir = getEnvNotEmpty("RESTIC_EXPORTER_CACHEDIR")
+}
+
+func getEnvNotEmpty(name string) string {
+	if val := os.Getenv(name); len(val) > 0 {
+		return val
+	}
+	panic(name + " not set")
+}
+
+func getEnv(name, def string) string {
+	if val := os.Getenv(name); len(val) > 0 {
+		return val
+	}
+	return def
+}
+
+func getEnvInt(name string, def int) int {
+	val := os.Getenv(name)
+	if len(val) == 0 {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		panic(name + ": " + err.Error())
+	}
+	return n
+}
+
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if len(val) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		panic(name + ": " + err.Error())
+	}
+	return d
+}
+
+func main() {
+
+	// restic is run through the exporter binary to limit its resources
+	if limits := os.Getenv(resourceLimitsEnv); limits != "" {
+		execLimitedRestic(limits)
+	}
+
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	webConfigFile := flag.String("web.config.file", "", "Path to a web configuration file enabling TLS")
+	textfileDir := flag.String("collector.textfile.directory", "", "Write metrics to this node_exporter textfile collector directory instead of serving them")
+	once := flag.Bool("once", false, "Collect metrics once, print them to stdout and exit")
+	var oncep onceParams
+	flag.StringVar(&oncep.repository, "repository", "", "Repository to probe with -once")
+	flag.StringVar(&oncep.target, "target", "", "Host to probe with -once")
+	flag.StringVar(&oncep.path, "path", "", "Path to probe with -once")
+	flag.StringVar(&oncep.tags, "tags", "", "Comma-separated tags to probe with -once")
+	flag.IntVar(&shardIndex, "shard.index", 0, "Index of the shard of repositories collected by this replica")
+	flag.IntVar(&shardTotal, "shard.total", 1, "Number of shards the repositories are split into")
+	flag.BoolVar(&enablePprof, "web.enable-pprof", false, "Serve the profiles of the Go runtime on /debug/pprof/")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("restic-exporter %s (commit %s, built %s)\n", version, commit, date)
+		return
+	}
+
+	if err := setupLogging(); err != nil {
+		fatal("Invalid logging configuration", "err", err)
+	}
+
+	if err := checkShard(); err != nil {
+		fatal("Invalid sharding", "err", err)
+	}
+
+	if err := setupAuditLog(); err != nil {
+		fatal("Invalid audit log configuration", "err", err)
+	}
+
+	if err := setupTracing(); err != nil {
+		fatal("Invalid tracing configuration", "err", err)
+	}
+
+	if err := setupLeaderElection(); err != nil {
+		fatal("Invalid leader election configuration", "err", err)
+	}
+
+	if err := setupSharedCache(); err != nil {
+		fatal("Invalid shared cache configuration", "err", err)
+	}
+
+	if err := setupHistory(); err != nil {
+		fatal("Invalid history configuration", "err", err)
+	}
+
+	loadEnv()
+	registerExporterMetrics(buildInfo, commandDuration, commandFailures, commandSuccesses, commandRetries, circuitOpen, httpRequests, httpRequestDuration, httpRequestsRejected)
+	prometheus.MustRegister(restoreTestSuccess, restoreTestDuration, restoreTestLastRun)
+	registerExporterMetrics(configReloadSuccessful, configReloadSuccessTime, secretReloadTime, leaderGauge, sharedCacheRequests)
+	prometheus.MustRegister(backupInProgress, backupPercentDone, backupBytes, backupFiles, backupETA, backupRuns, backupDuration, backupDataAdded, backupLastFiles, backupLastDataAdded, backupLastDuration, backupLastSuccess)
+	prometheus.MustRegister(backupJobRunning, backupJobSuccess, backupJobLastRun)
+	prometheus.MustRegister(maintenanceRunning, maintenanceQueued, maintenanceSuccess, maintenanceLastRun, maintenanceDuration)
+	registerExporterMetrics(notificationsSent, alertmanagerRequests)
+
+	resticVersion, err := checkResticVersion(context.Background())
+	if err != nil {
+		fatal("Unusable restic binary", "err", err)
+	}
+	prometheus.MustRegister(resticVersionInfo(resticVersion))
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+
+	prometheus.MustRegister(&repositoryCollector{}, &cacheCollector{}, &alertsCollector{})
+	if envUnlockAfter > 0 {
+		prometheus.MustRegister(locksRemoved)
+	}
+	prometheus.MustRegister(&groupsCollector{})
+	if history != nil {
+		prometheus.MustRegister(historyCollector{})
+		registerExporterMetrics(historyDataGap)
+	}
+
+	if *once {
+		if err := oncep.restrict(cfg); err != nil {
+			fatal("Invalid parameter", "err", err)
+		}
+		// no background jobs are started for a single collection
+		currentConfig.Store(cfg)
+		if envCollectTargets {
+			registerTargetCollectors(cfg)
+		}
+		err := collectOnce(context.Background(), cfg, oncep, os.Stdout)
+		revokeVaultLeases()
+		flushSpans()
+		closeHistory()
+		if err != nil {
+			fatal("Collection failed", "err", err)
+		}
+		return
+	}
+
+	applyConfig(cfg)
+	go reloadOnSIGHUP()
+
+	sinks, err := sinksFromEnv(*webConfigFile, *textfileDir)
+	if err != nil {
+		fatal("Invalid sink configuration", "err", err)
+	}
+
+	configLoaded.Store(true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var elected sync.WaitGroup
+	if elector != nil {
+		elected.Add(1)
+		go func() {
+			defer elected.Done()
+			elector.run(ctx)
+		}()
+	}
+
+	err = runSinks(ctx, prometheus.DefaultGatherer, sinks)
+
+	stopConfigJobs()
+	killRestic()
+	revokeVaultLeases()
+	stop()
+	elected.Wait()
+	flushSpans()
+	closeHistory()
+
+	if err != nil {
+		fatal("Sink failed", "err", err)
+	}
+	slog.Info("Exporter stopped")
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithCancel(contextWithTraceparent(r.Context(), r.Header.Get("traceparent")))
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// get ?target=<ip> parameter from request, which may list several
+	// targets separated by commas or be repeated
+	var targets []string
+	for _, param := range r.URL.Query()["target"] {
+		for _, target := range strings.Split(param, ",") {
+			if target != "" && !slices.Contains(targets, target) {
+				targets = append(targets, target)
+			}
+		}
+	}
+	tags := r.URL.Query().Get("tags")
+	path := r.URL.Query().Get("path")
+	groupBy, err := parseGroupBy(r.URL.Query().Get("group_by"))
+	if err != nil {
+		http.Error(w, "Invalid parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(targets) == 0 && tags == "" && path == "" && groupBy == nil {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	var tagList []string
+	if tags != "" {
+		tagList = strings.Split(tags, ",")
+	}
+
+	if len(targets) > 1 && groupBy != nil {
+		http.Error(w, "Invalid parameter: group_by takes a single target", http.StatusBadRequest)
+		return
+	}
+	if len(targets) > 1 {
+		probeTargetsHandler(w, r, targets, path, tagList)
+		return
+	}
+
+	var target string
+	if len(targets) == 1 {
+		target = targets[0]
+	}
+
+	cfg := currentConfig.Load()
+	if err := cfg.ProbeParams.check(target, path, tagList); err != nil {
+		http.Error(w, "Invalid parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo := cfg.probeRepository(r.URL.Query().Get("repository"), target)
+	if repo == nil {
+		http.Error(w, "Unknown repository", http.StatusBadRequest)
+		return
+	}
+
+	var registry *prometheus.Registry
+	if groupBy != nil {
+		registry, err = probeGroups(ctx, repo, target, path, tagList, groupBy)
+	} else {
+		registry, err = probe(ctx, repo, target, path, tagList, nil)
+	}
+	if err != nil && envProbeErrorStatus != 0 {
+		http.Error(w, err.Error(), envProbeErrorStatus)
+		return
+	}
+
+	h := promhttp.HandlerFor(withProbeSelf(withProbeLabels(registry, repo, target)), promhttp.HandlerOpts{EnableOpenMetrics: true})
+	h.ServeHTTP(w, r)
+
+}
+
+// probe runs restic against repo for the latest snapshot matching target,
+// path and tags, and returns a registry holding the results with labels
+// added. If restic fails, the registry reports it in restic_scrape_error.
+func probe(ctx context.Context, repo *repository, target, path string, tags []string, labels prometheus.Labels) (registry *prometheus.Registry, err error) {
+
+	ctx, sp := startSpan(ctx, "probe", spanKindServer, true)
+	sp.set("restic.repository", repo.Name)
+	sp.set("probe.target", target)
+	sp.set("probe.path", path)
+	sp.set("probe.tags", strings.Join(tags, ","))
+	defer func() { sp.finish(err) }()
+
+	metrics := &currentConfig.Load().Metrics
+	labels = metrics.probeLabels(repo, labels)
+	registry, m, err := collector.NewProbeRegistry(labels, metrics.snapshotLabels()...)
+	if err != nil {
+		return prometheus.NewRegistry(), err
+	}
+	m.SplitPaths = metrics.SplitPaths
+
+	rd, err := collector.Latest(ctx, repo.runner(), collector.Filter{Host: target, Path: path, Tags: tags})
+
+	host := target
+	if host == "" && len(rd.Snapshots) != 0 {
+		host = rd.Snapshots[0].Hostname
+	}
+	if host != "" {
+		recordProbe(repo.Name, host, rd, err)
+	}
+
+	if err != nil {
+		slog.Error("Probe failed", "target", target, "path", path, "tags", strings.Join(tags, ","), "repository", repo.Name, "err", err)
+	}
+	m.Set(rd, err)
+
+	if host != "" && err == nil {
+		if c := newFreshnessCollector(repo, host, latestSnapshotTime(rd)); c != nil {
+			prometheus.WrapRegistererWith(labels, registry).MustRegister(c)
+		}
+	}
+
+	return registry, err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maintenanceRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "maintenance",
+			Name:      "running",
+			Help:      "Whether a maintenance operation started by the exporter is running",
+		},
+		[]string{"repository", "operation"},
+	)
+	maintenanceQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "maintenance",
+			Name:      "queued",
+			Help:      "Number of maintenance operations waiting for the repository",
+		},
+		[]string{"repository"},
+	)
+	maintenanceSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "maintenance",
+			Name:      "last_success",
+			Help:      "Whether the last maintenance operation succeeded",
+		},
+		[]string{"repository", "operation"},
+	)
+	maintenanceLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "maintenance",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time the last maintenance operation finished",
+		},
+		[]string{"repository", "operation"},
+	)
+	maintenanceDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "maintenance",
+			Name:      "last_duration_seconds",
+			Help:      "Duration of the last maintenance operation",
+		},
+		[]string{"repository", "operation"},
+	)
+)
+
+// maintenanceOperations are the operations POST /api/v1/maintenance/ can
+// run.
+var maintenanceOperations = []string{"forget", "prune", "check"}
+
+// maxQueuedMaintenance limits the operations waiting per repository.
+const maxQueuedMaintenance = 8
+
+// maintenanceConfig configures the maintenance operations POST
+// /api/v1/maintenance/ can run. Only operations listed in Operations are
+// allowed, with the given arguments, e.g. the retention policy of forget.
+type maintenanceConfig struct {
+	// TokenFile holds the bearer token requests have to present.
+	TokenFile  string              `yaml:"token_file"`
+	Operations map[string][]string `yaml:"operations"`
+
+	token string
+}
+
+func (m *maintenanceConfig) validate() error {
+
+	if len(m.Operations) == 0 {
+		return nil
+	}
+
+	if m.TokenFile == "" {
+		return errors.New("token_file required")
+	}
+	token, err := readSecretFile(m.TokenFile)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("%s is empty", m.TokenFile)
+	}
+	m.token = token
+
+	for op, args := range m.Operations {
+		if !slices.Contains(maintenanceOperations, op) {
+			return fmt.Errorf("unknown operation %q", op)
+		}
+		for _, arg := range args {
+			if deniedArg(arg) {
+				return fmt.Errorf("%s: argument %q not allowed", op, arg)
+			}
+		}
+	}
+
+	return nil
+}
+
+// maintenanceJob is a maintenance operation requested of the exporter.
+type maintenanceJob struct {
+	ID         int        `json:"id"`
+	Repository string     `json:"repository"`
+	Operation  string     `json:"operation"`
+	State      string     `json:"state"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	repo *repository
+	args []string
+}
+
+// maintenanceQueue runs the maintenance operations of a repository one
+// after another, each holding the gate of the repository.
+type maintenanceQueue struct {
+	pending chan *maintenanceJob
+}
+
+var (
+	maintenanceMu     sync.Mutex
+	maintenanceQueues = map[string]*maintenanceQueue{}
+	// maintenanceJobs are the recent jobs, oldest first.
+	maintenanceJobs  []*maintenanceJob
+	maintenanceJobID int
+)
+
+// errTooManyQueued is returned if too many maintenance operations are
+// waiting for a repository already.
+var errTooManyQueued = errors.New("too many operations queued for the repository")
+
+// queueMaintenance queues op with args for repo. It fails with
+// errRepositoryBusy if an operation other than maintenance holds the gate
+// of the repository, and with errTooManyQueued if too many operations are
+// waiting already.
+func queueMaintenance(repo *repository, op string, args []string) (maintenanceJob, error) {
+
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	// maintenance operations wait for each other in the queue
+	if holder := gateFor(repo.Name).heldBy(); holder != "" && !slices.Contains(maintenanceOperations, holder) {
+		return maintenanceJob{}, fmt.Errorf("%w: %s running", errRepositoryBusy, holder)
+	}
+
+	q, ok := maintenanceQueues[repo.Name]
+	if !ok {
+		q = &maintenanceQueue{pending: make(chan *maintenanceJob, maxQueuedMaintenance)}
+		maintenanceQueues[repo.Name] = q
+		go q.run()
+	}
+
+	maintenanceJobID++
+	job := &maintenanceJob{
+		ID:         maintenanceJobID,
+		Repository: repo.Name,
+		Operation:  op,
+		State:      "queued",
+		QueuedAt:   time.Now(),
+		repo:       repo,
+		args:       args,
+	}
+
+	select {
+	case q.pending <- job:
+	default:
+		return maintenanceJob{}, errTooManyQueued
+	}
+	maintenanceQueued.WithLabelValues(repo.Name).Inc()
+
+	maintenanceJobs = append(maintenanceJobs, job)
+	if len(maintenanceJobs) > 100 {
+		maintenanceJobs = maintenanceJobs[1:]
+	}
+
+	return *job, nil
+}
+
+func (q *maintenanceQueue) run() {
+	for job := range q.pending {
+		gate := gateFor(job.Repository)
+		if err := gate.acquire(resticCtx, job.Operation); err != nil {
+			// the exporter is stopping
+			return
+		}
+		maintenanceQueued.WithLabelValues(job.Repository).Dec()
+		runMaintenance(resticCtx, job)
+		gate.release()
+	}
+}
+
+func runMaintenance(ctx context.Context, job *maintenanceJob) {
+
+	start := time.Now()
+	maintenanceMu.Lock()
+	job.State, job.StartedAt = "running", &start
+	maintenanceMu.Unlock()
+	maintenanceRunning.WithLabelValues(job.Repository, job.Operation).Set(1)
+
+	args := append([]string{job.Operation}, job.args...)
+	_, err := runCmd(ctx, job.repo, resticCommand(ctx, job.repo, args...))
+
+	finished := time.Now()
+	maintenanceMu.Lock()
+	job.FinishedAt = &finished
+	job.State = "succeeded"
+	if err != nil {
+		job.State, job.Error = "failed", err.Error()
+	}
+	maintenanceMu.Unlock()
+	if job.Operation == "check" {
+		recordCheck(job.Repository, finished, err)
+	}
+
+	maintenanceRunning.WithLabelValues(job.Repository, job.Operation).Set(0)
+	maintenanceSuccess.WithLabelValues(job.Repository, job.Operation).Set(boolToFloat(err == nil))
+	maintenanceLastRun.WithLabelValues(job.Repository, job.Operation).Set(float64(finished.Unix()))
+	maintenanceDuration.WithLabelValues(job.Repository, job.Operation).Set(finished.Sub(start).Seconds())
+}
+
+// maintenanceHandler queues the operation named by the last path element
+// for the repository named by the repo parameter on POST. GET on
+// /api/v1/maintenance/ lists the recent operations. Requests need the
+// configured maintenance token.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+
+	cfg := currentConfig.Load()
+	if len(cfg.Maintenance.Operations) == 0 {
+		writeAPIError(w, http.StatusNotFound, "no maintenance operations configured")
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Maintenance.token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	op := strings.TrimPrefix(r.URL.Path, "/api/v1/maintenance/")
+
+	if op == "" && r.Method == http.MethodGet {
+		maintenanceMu.Lock()
+		jobs := []maintenanceJob{}
+		for _, job := range maintenanceJobs {
+			jobs = append(jobs, *job)
+		}
+		maintenanceMu.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	args, ok := cfg.Maintenance.Operations[op]
+	if !ok {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("operation %q not allowed", op))
+		return
+	}
+
+	repo := cfg.repository(r.URL.Query().Get("repo"))
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown repository")
+		return
+	}
+
+	job, err := queueMaintenance(repo, op, args)
+	if errors.Is(err, errRepositoryBusy) {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	slog.Info("Maintenance queued", "repository", repo.Name, "operation", op, "client", r.RemoteAddr)
+
+	writeJSON(w, http.StatusAccepted, job)
+}
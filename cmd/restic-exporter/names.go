@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+
+	"restic-exporter/pkg/collector"
+)
+
+// metricsConfig configures the names and labels of the exported metrics.
+type metricsConfig struct {
+	// Namespace replaces the restic prefix of the metrics about backups,
+	// and ExporterNamespace the restic_exporter prefix of those about the
+	// exporter itself.
+	Namespace         string `yaml:"namespace"`
+	ExporterNamespace string `yaml:"exporter_namespace"`
+	// Subsystems renames the part of metric names following the namespace,
+	// up to the next underscore, e.g. snapshots in
+	// restic_snapshots_latest_time.
+	Subsystems map[string]string `yaml:"subsystems"`
+
+	// SnapshotLabels are the labels of the snapshot and stats metrics of
+	// probes, from hostname, paths, tags, username, id, short_id and
+	// repository. They default to hostname, paths and tags. repository
+	// labels probes, which name no repository unless collected on /metrics.
+	SnapshotLabels []string `yaml:"snapshot_labels"`
+	// SplitPaths reports snapshots of several paths as a series for each
+	// path, instead of one with all paths joined by ":".
+	SplitPaths bool `yaml:"split_paths"`
+
+	// MetricsInclude are the groups of metrics about the exporter itself
+	// served on /metrics, from runtime and exporter. It defaults to both.
+	// ProbeInclude are those added to probes, by default none, as they
+	// would be duplicated for every target scraped.
+	MetricsInclude []string `yaml:"metrics_include"`
+	ProbeInclude   []string `yaml:"probe_include"`
+}
+
+func (m *metricsConfig) validate() error {
+
+	for _, ns := range []string{m.Namespace, m.ExporterNamespace} {
+		if ns != "" && !model.IsValidMetricName(model.LabelValue(ns)) {
+			return fmt.Errorf("invalid namespace %q", ns)
+		}
+	}
+	for from, to := range m.Subsystems {
+		if from == "" || strings.Contains(from, "_") || !model.IsValidMetricName(model.LabelValue("x_"+to)) {
+			return fmt.Errorf("invalid subsystem rename %q to %q", from, to)
+		}
+	}
+	if err := m.validateNames(); err != nil {
+		return err
+	}
+
+	for i, name := range m.SnapshotLabels {
+		if name != "repository" && !collector.IsSnapshotLabel(name) {
+			return fmt.Errorf("unknown snapshot label %q", name)
+		}
+		if slices.Contains(m.SnapshotLabels[:i], name) {
+			return fmt.Errorf("snapshot label %q listed twice", name)
+		}
+	}
+
+	if err := validateSelfGroups(m.MetricsInclude); err != nil {
+		return fmt.Errorf("metrics_include: %w", err)
+	}
+	if err := validateSelfGroups(m.ProbeInclude); err != nil {
+		return fmt.Errorf("probe_include: %w", err)
+	}
+
+	return nil
+}
+
+// validateNames checks that the namespaces and subsystems keep the names of
+// different metrics apart.
+func (m *metricsConfig) validateNames() error {
+
+	namespace, exporterNamespace := "restic", "restic_exporter"
+	if m.Namespace != "" {
+		namespace = m.Namespace
+	}
+	if m.ExporterNamespace != "" {
+		exporterNamespace = m.ExporterNamespace
+	}
+
+	renamedTo := map[string]string{}
+	for _, name := range sortedKeys(m.Subsystems) {
+		to := m.Subsystems[name]
+		if other, ok := renamedTo[to]; ok {
+			return fmt.Errorf("subsystems %q and %q both renamed to %q", other, name, to)
+		}
+		renamedTo[to] = name
+	}
+
+	switch {
+	case namespace == exporterNamespace:
+		return fmt.Errorf("namespace and exporter_namespace are both %q", namespace)
+	case strings.HasPrefix(exporterNamespace, namespace+"_"):
+		// like restic_exporter, the exporter's metrics look like backup
+		// metrics of the subsystem exporter, which none has unless renamed
+		if sub := strings.TrimPrefix(exporterNamespace, namespace+"_"); sub != "exporter" {
+			return fmt.Errorf("exporter_namespace %q overlaps namespace %q", exporterNamespace, namespace)
+		}
+		if name, ok := renamedTo["exporter"]; ok {
+			return fmt.Errorf("subsystem %q renamed to exporter overlaps exporter_namespace %q", name, exporterNamespace)
+		}
+	case strings.HasPrefix(namespace, exporterNamespace+"_"):
+		return fmt.Errorf("namespace %q overlaps exporter_namespace %q", namespace, exporterNamespace)
+	}
+
+	return nil
+}
+
+// snapshotLabels returns the labels of the snapshot metrics other than
+// repository.
+func (m *metricsConfig) snapshotLabels() []string {
+
+	if len(m.SnapshotLabels) == 0 {
+		return collector.DefaultSnapshotLabels
+	}
+
+	var labels []string
+	for _, name := range m.SnapshotLabels {
+		if name != "repository" {
+			labels = append(labels, name)
+		}
+	}
+	return labels
+}
+
+// probeLabels returns the labels of the probe metrics of repo, labels with
+// repository added if configured.
+func (m *metricsConfig) probeLabels(repo *repository, labels prometheus.Labels) prometheus.Labels {
+
+	if !slices.Contains(m.SnapshotLabels, "repository") {
+		return labels
+	}
+	if _, ok := labels["repository"]; ok {
+		return labels
+	}
+
+	withRepo := prometheus.Labels{"repository": repo.Name}
+	for name, value := range labels {
+		withRepo[name] = value
+	}
+
+	return withRepo
+}
+
+// metricName returns the configured name of the metric called name by the
+// exporter.
+func (m *metricsConfig) metricName(name string) string {
+
+	namespace, rest := "", ""
+	switch {
+	case strings.HasPrefix(name, "restic_exporter_"):
+		namespace, rest = "restic_exporter", strings.TrimPrefix(name, "restic_exporter_")
+		if m.ExporterNamespace != "" {
+			namespace = m.ExporterNamespace
+		}
+	case strings.HasPrefix(name, "restic_"):
+		namespace, rest = "restic", strings.TrimPrefix(name, "restic_")
+		if m.Namespace != "" {
+			namespace = m.Namespace
+		}
+	default:
+		return name
+	}
+
+	subsystem, suffix, ok := strings.Cut(rest, "_")
+	if to, renamed := m.Subsystems[subsystem]; renamed && ok {
+		subsystem = to
+	}
+	if !ok {
+		return namespace + "_" + subsystem
+	}
+	if subsystem == "" {
+		return namespace + "_" + suffix
+	}
+
+	return namespace + "_" + subsystem + "_" + suffix
+}
+
+// rename gives the families of mfs their configured names. Families that
+// end up with the same name despite the validation of the configuration,
+// e.g. a subsystem renamed to one already in use, are an error, and only the
+// first of them is kept.
+func (m *metricsConfig) rename(mfs []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+
+	if m.Namespace == "" && m.ExporterNamespace == "" && len(m.Subsystems) == 0 {
+		return mfs, nil
+	}
+
+	var errs []error
+	byName := map[string]string{}
+	renamed := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		name := m.metricName(mf.GetName())
+		if other, ok := byName[name]; ok {
+			errs = append(errs, fmt.Errorf("metrics %s and %s both renamed to %s", other, mf.GetName(), name))
+			continue
+		}
+		byName[name] = mf.GetName()
+		mf.Name = proto.String(name)
+		renamed = append(renamed, mf)
+	}
+	slices.SortFunc(renamed, func(a, b *dto.MetricFamily) int { return strings.Compare(a.GetName(), b.GetName()) })
+
+	return renamed, errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMetricsConfigValidateNames(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		m       metricsConfig
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "namespaces", m: metricsConfig{Namespace: "backup", ExporterNamespace: "backup_exporter"}},
+		{name: "subsystems", m: metricsConfig{Subsystems: map[string]string{"snapshots": "snapshot", "stats": "statistics"}}},
+		{name: "swapped subsystems", m: metricsConfig{Subsystems: map[string]string{"snapshots": "stats", "stats": "snapshots"}}},
+		{name: "same namespace", m: metricsConfig{Namespace: "backup", ExporterNamespace: "backup"}, wantErr: true},
+		{name: "namespace of the exporter", m: metricsConfig{Namespace: "restic_exporter"}, wantErr: true},
+		{name: "exporter namespace in the namespace", m: metricsConfig{ExporterNamespace: "restic_snapshots"}, wantErr: true},
+		{name: "namespace below the exporter namespace", m: metricsConfig{Namespace: "backup_exporter_restic", ExporterNamespace: "backup_exporter"}, wantErr: true},
+		{name: "subsystems renamed alike", m: metricsConfig{Subsystems: map[string]string{"snapshots": "backup", "stats": "backup"}}, wantErr: true},
+		{name: "subsystem renamed to exporter", m: metricsConfig{Subsystems: map[string]string{"snapshots": "exporter"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.m.validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetricsConfigRename(t *testing.T) {
+
+	family := func(name string, typ dto.MetricType) *dto.MetricFamily {
+		return &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum(), Metric: []*dto.Metric{{}}}
+	}
+
+	m := metricsConfig{Namespace: "backup", Subsystems: map[string]string{"snapshots": "stats"}}
+	mfs, err := m.rename([]*dto.MetricFamily{
+		family("restic_snapshots_total", dto.MetricType_GAUGE),
+		family("restic_stats_total", dto.MetricType_COUNTER),
+		family("restic_exporter_command_failures_total", dto.MetricType_COUNTER),
+	})
+	if err == nil {
+		t.Error("rename() of colliding families succeeded")
+	}
+
+	var names []string
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	want := []string{"backup_stats_total", "restic_exporter_command_failures_total"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("rename() = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var notificationsSent = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "restic_exporter",
+		Subsystem: "notifications",
+		Name:      "sent_total",
+		Help:      "Webhook notifications sent by result",
+	},
+	[]string{"result"},
+)
+
+// notificationsConfig configures webhooks notified when a probed host
+// becomes stale or failed, and when it recovers.
+type notificationsConfig struct {
+	// Interval is how often the hosts are checked. It defaults to a minute.
+	Interval time.Duration `yaml:"interval"`
+	// RepeatInterval is how often hosts that stay stale or failed are
+	// notified again. It defaults to four hours, 0 never repeats.
+	RepeatInterval *time.Duration `yaml:"repeat_interval"`
+	// StaleAfter is the age of the latest snapshot making hosts stale
+	// that have neither a backup schedule nor an SLA.
+	StaleAfter time.Duration `yaml:"stale_after"`
+	Webhooks   []webhook     `yaml:"webhooks"`
+}
+
+// webhook is an HTTP endpoint notifications are posted to, as generic JSON
+// or formatted for Slack or Discord.
+type webhook struct {
+	URL     string `yaml:"url"`
+	URLFile string `yaml:"url_file"`
+	Type    string `yaml:"type"`
+	// Template formats the message of Slack and Discord webhooks with
+	// text/template, given the notification.
+	Template string `yaml:"template"`
+
+	template *template.Template
+}
+
+const defaultNotificationTemplate = `{{ if eq .Status "resolved" }}✅ Backup of {{ .Host }} in {{ .Repository }} recovered{{ else }}❌ Backup of {{ .Host }} in {{ .Repository }} is {{ .State }}{{ if .Error }}: {{ .Error }}{{ else if .Latest }}, latest snapshot {{ .Age }} ago{{ else }}, no snapshot{{ end }}{{ end }}`
+
+func (n *notificationsConfig) validate() error {
+
+	if len(n.Webhooks) == 0 {
+		return nil
+	}
+
+	if n.Interval == 0 {
+		n.Interval = time.Minute
+	}
+	if n.RepeatInterval == nil {
+		d := 4 * time.Hour
+		n.RepeatInterval = &d
+	}
+
+	for i := range n.Webhooks {
+		w := &n.Webhooks[i]
+		if (w.URL == "") == (w.URLFile == "") {
+			return fmt.Errorf("webhook %d: exactly one of url and url_file required", i)
+		}
+		switch w.Type {
+		case "":
+			w.Type = "json"
+		case "json", "slack", "discord":
+		default:
+			return fmt.Errorf("webhook %d: unknown type %q", i, w.Type)
+		}
+		text := w.Template
+		if text == "" {
+			text = defaultNotificationTemplate
+		}
+		t, err := template.New("webhook").Parse(text)
+		if err != nil {
+			return fmt.Errorf("webhook %d: %w", i, err)
+		}
+		w.template = t
+	}
+
+	return nil
+}
+
+// notification is the generic JSON payload of webhooks.
+type notification struct {
+	// Status is firing or resolved.
+	Status     string `json:"status"`
+	State      string `json:"state"`
+	Previous   string `json:"previous_state"`
+	Repository string `json:"repository"`
+	Host       string `json:"host"`
+	// Latest is the time of the latest snapshot, if any.
+	Latest *time.Time `json:"latest,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+// Age returns the age of the latest snapshot for templates.
+func (n notification) Age() string {
+	if n.Latest == nil {
+		return ""
+	}
+	return formatAge(*n.Latest)
+}
+
+// hostState is the state of a host as notified.
+type hostState struct {
+	state    string
+	notified time.Time
+}
+
+var (
+	notifyMu sync.Mutex
+	// notified are the states of the hosts by repository and host name.
+	// They survive configuration reloads, so that a reload notifies only
+	// changes.
+	notified = map[[2]string]*hostState{}
+)
+
+// healthOf returns the state of a probed host: failed if the latest probe
+// failed, stale if the latest snapshot misses its schedule or SLA, or is
+// older than staleAfter if neither is configured, and ok otherwise.
+func healthOf(repo *repository, h hostStatus, staleAfter time.Duration) string {
+
+	if h.LastError != "" {
+		return "failed"
+	}
+
+	if f, ok := freshnessOf(repo, h.Host, h.Latest); ok {
+		if (f.schedule != nil && f.schedule.missed) || (f.sla != nil && f.sla.breached) {
+			return "stale"
+		}
+		return "ok"
+	}
+
+	if staleAfter > 0 && (h.Latest.IsZero() || time.Since(h.Latest) > staleAfter) {
+		return "stale"
+	}
+
+	return "ok"
+}
+
+// runNotifications checks the hosts of cfg every interval until ctx is
+// done. Only the leader notifies.
+func runNotifications(ctx context.Context, cfg *config) {
+
+	n := cfg.Notifications
+
+	ticker := time.NewTicker(n.Interval)
+	defer ticker.Stop()
+
+	for {
+		if isLeader() {
+			notifyChanges(ctx, cfg)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notifyChanges notifies hosts that changed state since they were last
+// notified, and repeats notifications of hosts that stay unhealthy.
+func notifyChanges(ctx context.Context, cfg *config) {
+
+	n := cfg.Notifications
+	now := time.Now()
+
+	for _, repo := range cfg.Repositories {
+		for _, h := range hostStatusesOf(repo.Name) {
+			state := healthOf(repo, h, n.StaleAfter)
+
+			notifyMu.Lock()
+			key := [2]string{repo.Name, h.Host}
+			prev, ok := notified[key]
+			if !ok {
+				// hosts start out healthy, so that only problems notify
+				prev = &hostState{state: "ok"}
+				notified[key] = prev
+			}
+			changed := prev.state != state
+			repeat := !changed && state != "ok" && *n.RepeatInterval > 0 && now.Sub(prev.notified) >= *n.RepeatInterval
+			previous := prev.state
+			if changed || repeat {
+				prev.state, prev.notified = state, now
+			}
+			notifyMu.Unlock()
+
+			if !changed && !repeat {
+				continue
+			}
+
+			msg := notification{
+				Status:     "firing",
+				State:      state,
+				Previous:   previous,
+				Repository: repo.Name,
+				Host:       h.Host,
+				Error:      h.LastError,
+				Time:       now,
+			}
+			if state == "ok" {
+				msg.Status = "resolved"
+			}
+			if !h.Latest.IsZero() {
+				latest := h.Latest
+				msg.Latest = &latest
+			}
+
+			for _, w := range n.Webhooks {
+				err := w.send(ctx, msg)
+				if err != nil {
+					slog.Error("Sending notification failed", "repository", repo.Name, "host", h.Host, "type", w.Type, "err", err)
+					notificationsSent.WithLabelValues("error").Inc()
+				} else {
+					notificationsSent.WithLabelValues("success").Inc()
+				}
+			}
+		}
+	}
+}
+
+// send posts msg to w.
+func (w *webhook) send(ctx context.Context, msg notification) error {
+
+	url := w.URL
+	if w.URLFile != "" {
+		var err error
+		if url, err = readSecretFile(w.URLFile); err != nil {
+			return err
+		}
+	}
+
+	var payload interface{} = msg
+	if w.Type != "json" {
+		var text strings.Builder
+		if err := w.template.Execute(&text, msg); err != nil {
+			return err
+		}
+		if w.Type == "slack" {
+			payload = map[string]string{"text": text.String()}
+		} else {
+			payload = map[string]string{"content": text.String()}
+		}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		// the URL may be secret
+		return errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "restic-exporter/"+version)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting to webhook: %w", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
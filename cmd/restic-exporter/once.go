@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// onceParams are the probe parameters of a one-shot collection. Without
+// target, path and tags, all metrics of /metrics and the probes of all
+// repository targets are collected, only of repository if given.
+type onceParams struct {
+	repository, target, path, tags string
+}
+
+// probe tells whether p are the parameters of a single probe.
+func (p onceParams) probe() bool {
+	return p.target != "" || p.path != "" || p.tags != ""
+}
+
+// restrict drops all repositories but the one p collects from cfg if only a
+// repository is given.
+func (p onceParams) restrict(cfg *config) error {
+
+	if p.repository == "" || p.probe() {
+		return nil
+	}
+
+	repo := cfg.repository(p.repository)
+	if repo == nil {
+		return fmt.Errorf("unknown repository %q", p.repository)
+	}
+	cfg.Repositories = []*repository{repo}
+
+	return nil
+}
+
+// onceErrors holds the first error of restic or a probe during a one-shot
+// collection, which the collectors only log.
+var onceErrors struct {
+	sync.Mutex
+	enabled bool
+	first   error
+}
+
+// recordOnceError keeps err, if set, as the cause of a failed one-shot
+// collection.
+func recordOnceError(err error) {
+
+	if err == nil {
+		return
+	}
+
+	onceErrors.Lock()
+	defer onceErrors.Unlock()
+
+	if onceErrors.enabled && onceErrors.first == nil {
+		onceErrors.first = err
+	}
+}
+
+// recordOnceResticError keeps err, if set, of running restic with args
+// against repo. Invocations not concerning a repository, such as `restic
+// version` with a nil repo, report their errors themselves.
+func recordOnceResticError(repo *repository, args []string, err error) {
+	if err != nil && repo != nil {
+		recordOnceError(fmt.Errorf("restic %s on repository %s: %w", subcommand(args), repo.Name, err))
+	}
+}
+
+// collectOnce collects metrics a single time with cfg and writes them to w
+// in the text exposition format. It returns an error if restic or the probe
+// failed.
+func collectOnce(ctx context.Context, cfg *config, p onceParams, w io.Writer) error {
+
+	onceErrors.Lock()
+	onceErrors.enabled = true
+	onceErrors.Unlock()
+
+	var (
+		g        prometheus.Gatherer
+		probeErr error
+	)
+	if !p.probe() {
+		g = withTargets(prometheus.DefaultGatherer)
+	} else {
+		var tagList []string
+		if p.tags != "" {
+			tagList = strings.Split(p.tags, ",")
+		}
+		if err := cfg.ProbeParams.check(p.target, p.path, tagList); err != nil {
+			return fmt.Errorf("invalid parameter: %w", err)
+		}
+		repo := cfg.probeRepository(p.repository, p.target)
+		if repo == nil {
+			return fmt.Errorf("unknown repository %q", p.repository)
+		}
+		var registry *prometheus.Registry
+		registry, probeErr = probe(ctx, repo, p.target, p.path, tagList, nil)
+		g = withProbeLabels(registry, repo, p.target)
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	if probeErr != nil {
+		return probeErr
+	}
+
+	onceErrors.Lock()
+	defer onceErrors.Unlock()
+
+	return onceErrors.first
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpClient sends OTLP export requests, encoded as protobuf, to an
+// OpenTelemetry collector with gRPC or HTTP.
+type otlpClient struct {
+	protocol string
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// otlpClientFromEnv configures an otlpClient from RESTIC_EXPORTER_OTLP_*,
+// falling back to the standard OTEL_EXPORTER_OTLP_* variables.
+func otlpClientFromEnv() (*otlpClient, error) {
+
+	c := &otlpClient{
+		protocol: getEnv("RESTIC_EXPORTER_OTLP_PROTOCOL", getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")),
+		headers:  map[string]string{},
+	}
+
+	switch c.protocol {
+	case "grpc":
+		c.endpoint = getEnv("RESTIC_EXPORTER_OTLP_ENDPOINT", getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317"))
+	case "http/protobuf":
+		c.endpoint = getEnv("RESTIC_EXPORTER_OTLP_ENDPOINT", getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"))
+	default:
+		return nil, fmt.Errorf("RESTIC_EXPORTER_OTLP_PROTOCOL: unknown protocol %q, want grpc or http/protobuf", c.protocol)
+	}
+	c.endpoint = strings.TrimSuffix(c.endpoint, "/")
+
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("RESTIC_EXPORTER_OTLP_ENDPOINT: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("RESTIC_EXPORTER_OTLP_ENDPOINT: unsupported scheme %q", u.Scheme)
+	}
+
+	if headers := getEnv("RESTIC_EXPORTER_OTLP_HEADERS", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")); headers != "" {
+		for _, pair := range strings.Split(headers, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("RESTIC_EXPORTER_OTLP_HEADERS: invalid header %q, want name=value", pair)
+			}
+			value, err := url.QueryUnescape(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("RESTIC_EXPORTER_OTLP_HEADERS: %w", err)
+			}
+			c.headers[strings.TrimSpace(name)] = value
+		}
+	}
+
+	c.client = http.DefaultClient
+	if c.protocol == "grpc" {
+		t := &http2.Transport{}
+		if u.Scheme == "http" {
+			// gRPC without TLS needs HTTP/2 with prior knowledge
+			t.AllowHTTP = true
+			t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+		c.client = &http.Client{Transport: t}
+	}
+
+	return c, nil
+}
+
+// export sends msg, an export request of the given signal ("metrics" or
+// "traces"), to the collector.
+func (c *otlpClient) export(ctx context.Context, signal string, msg []byte) error {
+
+	var (
+		target = c.endpoint + "/v1/" + signal
+		body   = msg
+	)
+	if c.protocol == "grpc" {
+		service := map[string]string{
+			"metrics": "opentelemetry.proto.collector.metrics.v1.MetricsService",
+			"traces":  "opentelemetry.proto.collector.trace.v1.TraceService",
+		}[signal]
+		target = c.endpoint + "/" + service + "/Export"
+
+		// a gRPC message is prefixed by its compression flag and length
+		body = make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		body = append(body, msg...)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+	if c.protocol == "grpc" {
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the trailers are only available after reading the body
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	if c.protocol == "grpc" {
+		status, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			// trailers-only responses carry the status in the headers
+			status, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		if status == "" {
+			return errors.New("otlp: gRPC response without status")
+		}
+		if status != "0" {
+			msg, _ = url.PathUnescape(msg)
+			return fmt.Errorf("otlp: gRPC status %s: %s", status, msg)
+		}
+	}
+
+	return nil
+}
+
+// protoMessage appends the length-delimited field num holding msg to b.
+func protoMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// protoString appends the string field num to b, unless s is empty.
+func protoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// protoFixed64 appends the fixed64 or double field num to b.
+func protoFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// otlpAttributes appends the string attributes in attrs as field num of
+// KeyValue messages to b, in the order of their keys.
+func otlpAttributes(b []byte, num protowire.Number, attrs map[string]string) []byte {
+	for _, key := range sortedKeys(attrs) {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, attrs[key])
+
+		var kv []byte
+		kv = protoString(kv, 1, key)
+		kv = protoMessage(kv, 2, value)
+
+		b = protoMessage(b, num, kv)
+	}
+	return b
+}
+
+// otlpResource returns a Resource message describing this exporter on this
+// host, with extra attributes.
+func otlpResource(extra map[string]string) []byte {
+
+	attrs := map[string]string{
+		"service.name":    "restic-exporter",
+		"service.version": version,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attrs["host.name"] = hostname
+	}
+	for key, value := range extra {
+		attrs[key] = value
+	}
+
+	return otlpAttributes(nil, 1, attrs)
+}
+
+// otlpScope returns the InstrumentationScope message of this exporter.
+func otlpScope() []byte {
+	var b []byte
+	b = protoString(b, 1, "restic-exporter")
+	b = protoString(b, 2, version)
+	return b
+}
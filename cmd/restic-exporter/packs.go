@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	repositoryFilesDesc = prometheus.NewDesc(
+		"restic_repository_files",
+		"Number of files in the index and data directories of the repository",
+		[]string{"repository", "type"}, nil,
+	)
+	repositoryPacksSizeDesc = prometheus.NewDesc(
+		"restic_repository_packs_size_bytes",
+		"Total size of the blobs in the pack files of the repository, as listed by its index",
+		[]string{"repository"}, nil,
+	)
+)
+
+// resticIndexData is the output of `restic cat index`.
+type resticIndexData struct {
+	Packs []struct {
+		ID    string `json:"id"`
+		Blobs []struct {
+			Offset int64 `json:"offset"`
+			Length int64 `json:"length"`
+		} `json:"blobs"`
+	} `json:"packs"`
+}
+
+// cachedPacks are the file counts and the pack size of a repository, and
+// when they were collected. Index files never change, so the pack sizes
+// they list are kept by index ID for as long as the index exists.
+type cachedPacks struct {
+	mu          sync.Mutex
+	files       map[string]int
+	size        int64
+	collectedAt time.Time
+	indexes     map[string]map[string]int64
+}
+
+var (
+	packsCacheMu sync.Mutex
+	// packsCache holds the packs of repositories by name and location.
+	packsCache = map[[2]string]*cachedPacks{}
+)
+
+// repositoryPacks returns the number of index and pack files of repo, and
+// the size of its packs. restic runs only if the cached ones are older than
+// RESTIC_EXPORTER_STATS_CACHE_TTL, and reads only indexes added since.
+func repositoryPacks(ctx context.Context, repo *repository) (map[string]int, int64, error) {
+
+	key := [2]string{repo.Name, repo.Repository}
+
+	packsCacheMu.Lock()
+	c, ok := packsCache[key]
+	if !ok {
+		c = &cachedPacks{indexes: map[string]map[string]int64{}}
+		packsCache[key] = c
+	}
+	packsCacheMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.files != nil && time.Since(c.collectedAt) < envStatsCacheTTL {
+		return c.files, c.size, nil
+	}
+
+	out, err := runRestic(ctx, repo, "list", "index")
+	if err != nil {
+		return nil, 0, err
+	}
+	indexIDs := strings.Fields(string(out))
+
+	out, err = runRestic(ctx, repo, "list", "packs")
+	if err != nil {
+		return nil, 0, err
+	}
+	packIDs := strings.Fields(string(out))
+
+	indexes := make(map[string]map[string]int64, len(indexIDs))
+	for _, id := range indexIDs {
+		if packs, ok := c.indexes[id]; ok {
+			indexes[id] = packs
+			continue
+		}
+
+		var index resticIndexData
+		if err := unmarshallFromRestic(ctx, repo, &index, "cat", "index", id); err != nil {
+			return nil, 0, err
+		}
+		packs := make(map[string]int64, len(index.Packs))
+		for _, p := range index.Packs {
+			for _, b := range p.Blobs {
+				packs[p.ID] = max(packs[p.ID], b.Offset+b.Length)
+			}
+		}
+		indexes[id] = packs
+	}
+
+	// packs listed by several indexes, until prune rewrites them, count once
+	sizes := map[string]int64{}
+	for _, packs := range indexes {
+		for id, size := range packs {
+			sizes[id] = size
+		}
+	}
+	var size int64
+	for _, s := range sizes {
+		size += s
+	}
+
+	c.indexes = indexes
+	c.files = map[string]int{"index": len(indexIDs), "data": len(packIDs)}
+	c.size, c.collectedAt = size, time.Now()
+
+	return c.files, c.size, nil
+}
+
+// collectPacks exports the number of index and pack files of repo, and the
+// size of its packs.
+func collectPacks(ctx context.Context, repo *repository, ch chan<- prometheus.Metric) error {
+
+	files, size, err := repositoryPacks(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for typ, n := range files {
+		ch <- prometheus.MustNewConstMetric(repositoryFilesDesc, prometheus.GaugeValue, float64(n), repo.Name, typ)
+	}
+	ch <- prometheus.MustNewConstMetric(repositoryPacksSizeDesc, prometheus.GaugeValue, float64(size), repo.Name)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// maxProbeParamLength limits the length of a single probe parameter value.
+const maxProbeParamLength = 256
+
+// probeParamsConfig restricts the values of probe parameters, which end up
+// on restic's command line, to regular expressions matching the whole value.
+// Each of the comma separated tags is matched on its own.
+type probeParamsConfig struct {
+	Target string `yaml:"target"`
+	Path   string `yaml:"path"`
+	Tag    string `yaml:"tag"`
+
+	target, path, tag *regexp.Regexp
+}
+
+// validate compiles the regular expressions.
+func (p *probeParamsConfig) validate() error {
+
+	var err error
+	if p.target, err = compileAnchored(p.Target); err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	if p.path, err = compileAnchored(p.Path); err != nil {
+		return fmt.Errorf("path: %w", err)
+	}
+	if p.tag, err = compileAnchored(p.Tag); err != nil {
+		return fmt.Errorf("tag: %w", err)
+	}
+
+	return nil
+}
+
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// check returns an error if one of the probe parameters is malformed or not
+// allowed.
+func (p *probeParamsConfig) check(target, path string, tags []string) error {
+
+	if err := checkProbeParam("target", target, p.target); err != nil {
+		return err
+	}
+	if err := checkProbeParam("path", path, p.path); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := checkProbeParam("tag", tag, p.tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkProbeParam rejects values restic could mistake for an option, values
+// with control characters or overlong ones, and values not matching re.
+// Empty values mean the parameter wasn't given.
+func checkProbeParam(name, value string, re *regexp.Regexp) error {
+
+	if value == "" {
+		return nil
+	}
+	if strings.HasPrefix(value, "-") {
+		return fmt.Errorf("%s must not start with '-'", name)
+	}
+	if len(value) > maxProbeParamLength {
+		return fmt.Errorf("%s longer than %d characters", name, maxProbeParamLength)
+	}
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%s contains control characters", name)
+	}
+	if re != nil && !re.MatchString(value) {
+		return errors.New(name + " not allowed")
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// enablePprof serves the profiles of the Go runtime on /debug/pprof/, to
+// diagnose memory growth and goroutine leaks in place.
+var enablePprof bool
+
+// handlePprof registers the pprof endpoints on mux, protected like the
+// API.
+func handlePprof(mux *http.ServeMux) {
+
+	protect := func(h http.HandlerFunc) http.Handler {
+		return instrumentHandler("/debug/pprof/", allowNetworks("/debug/pprof/", requireClientCert(requireAuth(h))))
+	}
+
+	// pprof.Index serves the named profiles, e.g. heap and goroutine
+	mux.Handle("/debug/pprof/", protect(pprof.Index))
+	mux.Handle("/debug/pprof/cmdline", protect(pprof.Cmdline))
+	mux.Handle("/debug/pprof/profile", protect(pprof.Profile))
+	mux.Handle("/debug/pprof/symbol", protect(pprof.Symbol))
+	mux.Handle("/debug/pprof/trace", protect(pprof.Trace))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"restic-exporter/pkg/collector"
+)
+
+// parseGroupBy parses the group_by probe parameter, a comma separated
+// subset of host, paths and tags.
+func parseGroupBy(param string) ([]string, error) {
+
+	if param == "" {
+		return nil, nil
+	}
+
+	var groupBy []string
+	for _, field := range strings.Split(param, ",") {
+		if !slices.Contains(collector.GroupFields, field) {
+			return nil, fmt.Errorf("group_by: unknown field %q", field)
+		}
+		if slices.Contains(groupBy, field) {
+			return nil, fmt.Errorf("group_by: field %q given twice", field)
+		}
+		groupBy = append(groupBy, field)
+	}
+
+	return groupBy, nil
+}
+
+// probeGroups runs restic against repo for the latest snapshot of each group
+// of the snapshots matching target, path and tags, grouped by the fields of
+// groupBy. The snapshot metrics are labelled with the group fields, and the
+// configured snapshot labels other than hostname, paths and tags.
+func probeGroups(ctx context.Context, repo *repository, target, path string, tags, groupBy []string) (registry *prometheus.Registry, err error) {
+
+	ctx, sp := startSpan(ctx, "probe", spanKindServer, true)
+	sp.set("restic.repository", repo.Name)
+	sp.set("probe.target", target)
+	sp.set("probe.path", path)
+	sp.set("probe.tags", strings.Join(tags, ","))
+	sp.set("probe.group_by", strings.Join(groupBy, ","))
+	defer func() { sp.finish(err) }()
+
+	metrics := &currentConfig.Load().Metrics
+	labels := metrics.probeLabels(repo, nil)
+	snapshotLabels := collector.GroupLabels(groupBy)
+	for _, name := range metrics.snapshotLabels() {
+		if name != "hostname" && name != "paths" && name != "tags" {
+			snapshotLabels = append(snapshotLabels, name)
+		}
+	}
+	registry, m, err := collector.NewProbeRegistry(labels, snapshotLabels...)
+	if err != nil {
+		return prometheus.NewRegistry(), err
+	}
+
+	results, err := collector.LatestByGroup(ctx, repo.runner(), collector.Filter{Host: target, Path: path, Tags: tags}, groupBy)
+	if err != nil {
+		slog.Error("Probe failed", "target", target, "path", path, "tags", strings.Join(tags, ","), "group_by", strings.Join(groupBy, ","), "repository", repo.Name, "err", err)
+		if target != "" {
+			recordProbe(repo.Name, target, nil, err)
+		}
+	}
+	m.SetGroups(results, err)
+	if err != nil {
+		return registry, err
+	}
+
+	// hosts in several groups are recorded with their latest snapshot
+	latest := map[string]*collector.Result{}
+	for i := range results {
+		res := &results[i].Result
+		host := res.Snapshots[0].Hostname
+		if l, ok := latest[host]; !ok || res.Snapshots[0].Time.After(l.Snapshots[0].Time) {
+			latest[host] = res
+		}
+	}
+
+	var freshness freshnessCollectors
+	for host, res := range latest {
+		recordProbe(repo.Name, host, res, nil)
+		if c := newFreshnessCollector(repo, host, latestSnapshotTime(res)); c != nil {
+			freshness = append(freshness, c)
+		}
+	}
+	if len(freshness) > 0 {
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(freshness)
+	}
+
+	return registry, nil
+}
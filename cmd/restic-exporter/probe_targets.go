@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"restic-exporter/pkg/collector"
+)
+
+// probeTargetsHandler probes several targets in one request. The metrics
+// of each target are labelled with it.
+func probeTargetsHandler(w http.ResponseWriter, r *http.Request, targets []string, path string, tags []string) {
+
+	cfg := currentConfig.Load()
+	name := r.URL.Query().Get("repository")
+
+	var (
+		repos   []*repository
+		byRepo  = map[*repository][]string{}
+		invalid []string
+	)
+	for _, target := range targets {
+		if err := cfg.ProbeParams.check(target, path, tags); err != nil {
+			invalid = append(invalid, err.Error())
+			continue
+		}
+		repo := cfg.probeRepository(name, target)
+		if repo == nil {
+			http.Error(w, "Unknown repository", http.StatusBadRequest)
+			return
+		}
+		if _, ok := byRepo[repo]; !ok {
+			repos = append(repos, repo)
+		}
+		byRepo[repo] = append(byRepo[repo], target)
+	}
+	if len(invalid) > 0 {
+		http.Error(w, "Invalid parameter: "+strings.Join(invalid, "; "), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		gatherers prometheus.Gatherers
+		first     error
+	)
+	metrics := &currentConfig.Load().Metrics
+	for _, repo := range repos {
+		results, err := probeTargets(r.Context(), repo, byRepo[repo], path, tags)
+		for _, res := range results {
+			labels := metrics.probeLabels(repo, prometheus.Labels{"target": res.Host})
+			registry, m, err := collector.NewProbeRegistry(labels, metrics.snapshotLabels()...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			m.SplitPaths = metrics.SplitPaths
+			m.Set(&res.Result, res.Err)
+			if res.Err == nil {
+				if c := newFreshnessCollector(repo, res.Host, latestSnapshotTime(&res.Result)); c != nil {
+					prometheus.WrapRegistererWith(labels, registry).MustRegister(c)
+				}
+			}
+			gatherers = append(gatherers, withProbeLabels(registry, repo, res.Host))
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first != nil && envProbeErrorStatus != 0 {
+		http.Error(w, first.Error(), envProbeErrorStatus)
+		return
+	}
+
+	h := promhttp.HandlerFor(withProbeSelf(gatherers), promhttp.HandlerOpts{EnableOpenMetrics: true})
+	h.ServeHTTP(w, r)
+}
+
+// probeTargets probes repo for the latest snapshots of targets matching path
+// and tags, listing the snapshots of all targets with a single restic call.
+// Failures are logged and recorded in the status of the targets.
+func probeTargets(ctx context.Context, repo *repository, targets []string, path string, tags []string) (results []collector.HostResult, err error) {
+
+	ctx, sp := startSpan(ctx, "probe", spanKindServer, true)
+	sp.set("restic.repository", repo.Name)
+	sp.set("probe.target", strings.Join(targets, ","))
+	sp.set("probe.path", path)
+	sp.set("probe.tags", strings.Join(tags, ","))
+	defer func() { sp.finish(err) }()
+
+	results, err = collector.LatestByHost(ctx, repo.runner(), targets, path, tags)
+
+	for _, res := range results {
+		recordProbe(repo.Name, res.Host, &res.Result, res.Err)
+		if res.Err != nil {
+			slog.Error("Probe failed", "target", res.Host, "path", path, "tags", strings.Join(tags, ","), "repository", repo.Name, "err", res.Err)
+		}
+	}
+
+	return results, err
+}
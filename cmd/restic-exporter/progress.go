@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// backupProgress is the state of a backup of host to a repository.
+type backupProgress struct {
+	Repository       string    `json:"repository"`
+	Host             string    `json:"host"`
+	PercentDone      float64   `json:"percent_done"`
+	TotalFiles       int64     `json:"total_files"`
+	FilesDone        int64     `json:"files_done"`
+	TotalBytes       int64     `json:"total_bytes"`
+	BytesDone        int64     `json:"bytes_done"`
+	SecondsElapsed   int64     `json:"seconds_elapsed"`
+	SecondsRemaining int64     `json:"seconds_remaining"`
+	Done             bool      `json:"done"`
+	Error            string    `json:"error,omitempty"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// progressTracker keeps the state of backups in progress and passes
+// updates on to subscribers.
+type progressTracker struct {
+	mu          sync.Mutex
+	backups     map[[2]string]backupProgress
+	subscribers map[chan backupProgress]struct{}
+}
+
+var progress = &progressTracker{
+	backups:     map[[2]string]backupProgress{},
+	subscribers: map[chan backupProgress]struct{}{},
+}
+
+// update records p and sends it to all subscribers. Finished backups are
+// forgotten. Subscribers not keeping up miss updates.
+func (t *progressTracker) update(p backupProgress) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p.UpdatedAt = time.Now()
+	key := [2]string{p.Repository, p.Host}
+	if p.Done {
+		delete(t.backups, key)
+	} else {
+		t.backups[key] = p
+	}
+
+	for ch := range t.subscribers {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// subscribe returns the backups in progress and a channel receiving updates
+// until cancel is called.
+func (t *progressTracker) subscribe() (current []backupProgress, updates <-chan backupProgress, cancel func()) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, p := range t.backups {
+		current = append(current, p)
+	}
+
+	ch := make(chan backupProgress, 64)
+	t.subscribers[ch] = struct{}{}
+
+	return current, ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subscribers, ch)
+	}
+}
+
+// progressStreamHandler streams the progress of backups, optionally of a
+// repository and host only, as Server-Sent Events. Each event carries a
+// backupProgress as JSON.
+func progressStreamHandler(w http.ResponseWriter, r *http.Request) {
+
+	repoName, host := r.URL.Query().Get("repo"), r.URL.Query().Get("host")
+	matches := func(p backupProgress) bool {
+		return (repoName == "" || p.Repository == repoName) && (host == "" || p.Host == host)
+	}
+
+	rc := http.NewResponseController(w)
+
+	current, updates, cancel := progress.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(p backupProgress) error {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for _, p := range current {
+		if matches(p) {
+			if err := send(p); err != nil {
+				return
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// comments keep proxies from closing idle streams
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case p := <-updates:
+			if matches(p) {
+				if err := send(p); err != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// relabelConfig rewrites the labels of metrics like a metric_relabel_configs
+// entry of Prometheus. The metric name is the label __name__, so replacing
+// it renames metrics.
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	// Separator joins the values of the source labels. It defaults to ";".
+	Separator *string `yaml:"separator"`
+	// Regex is anchored at both ends. It defaults to "(.*)".
+	Regex       *string `yaml:"regex"`
+	TargetLabel string  `yaml:"target_label"`
+	// Replacement may refer to groups of Regex. It defaults to "$1".
+	Replacement *string `yaml:"replacement"`
+	// Action is replace, keep, drop, labelmap, labeldrop or labelkeep. It
+	// defaults to replace.
+	Action string `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+func (r *relabelConfig) validate() error {
+
+	if r.Separator == nil {
+		sep := ";"
+		r.Separator = &sep
+	}
+	if r.Regex == nil {
+		re := "(.*)"
+		r.Regex = &re
+	}
+	if r.Replacement == nil {
+		repl := "$1"
+		r.Replacement = &repl
+	}
+	if r.Action == "" {
+		r.Action = "replace"
+	}
+
+	re, err := regexp.Compile("^(?:" + *r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex: %w", err)
+	}
+	r.regex = re
+
+	switch r.Action {
+	case "replace":
+		if r.TargetLabel == "" {
+			return fmt.Errorf("%s requires target_label", r.Action)
+		}
+	case "keep", "drop":
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("%s requires source_labels", r.Action)
+		}
+	case "labelmap", "labeldrop", "labelkeep":
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	return nil
+}
+
+// apply rewrites labels. It returns false if the metric is to be dropped.
+func (r *relabelConfig) apply(labels map[string]string) bool {
+
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, name := range r.SourceLabels {
+		values = append(values, labels[name])
+	}
+	value := strings.Join(values, *r.Separator)
+
+	switch r.Action {
+	case "replace":
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			break
+		}
+		target := string(r.regex.ExpandString(nil, r.TargetLabel, value, match))
+		if !model.LabelName(target).IsValid() {
+			break
+		}
+		if res := string(r.regex.ExpandString(nil, *r.Replacement, value, match)); res != "" {
+			labels[target] = res
+		} else {
+			delete(labels, target)
+		}
+	case "keep":
+		return r.regex.MatchString(value)
+	case "drop":
+		return !r.regex.MatchString(value)
+	case "labelmap":
+		for name, v := range labels {
+			if r.regex.MatchString(name) {
+				labels[r.regex.ReplaceAllString(name, *r.Replacement)] = v
+			}
+		}
+	case "labeldrop", "labelkeep":
+		for name := range labels {
+			if name != "__name__" && r.regex.MatchString(name) == (r.Action == "labeldrop") {
+				delete(labels, name)
+			}
+		}
+	}
+
+	return true
+}
+
+// relabel applies rules to the metrics of mfs. Renamed metrics join the
+// family of their new name, if it has the same type. Metrics that end up
+// with the labels of another one are dropped.
+func relabel(mfs []*dto.MetricFamily, rules []relabelConfig) []*dto.MetricFamily {
+
+	if len(rules) == 0 {
+		return mfs
+	}
+
+	families := map[string]*dto.MetricFamily{}
+	seen := map[string]bool{}
+	for _, mf := range mfs {
+	metrics:
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{"__name__": mf.GetName()}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			for i := range rules {
+				if !rules[i].apply(labels) {
+					continue metrics
+				}
+			}
+
+			name := labels["__name__"]
+			if !model.IsValidMetricName(model.LabelValue(name)) {
+				continue
+			}
+			family, ok := families[name]
+			if !ok {
+				family = &dto.MetricFamily{Name: proto.String(name), Help: mf.Help, Type: mf.Type}
+				families[name] = family
+			} else if family.GetType() != mf.GetType() {
+				continue
+			}
+
+			m.Label = m.Label[:0]
+			key := name
+			for _, n := range sortedKeys(labels) {
+				// labels starting with __ are internal, as in Prometheus
+				if strings.HasPrefix(n, "__") || labels[n] == "" {
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(n), Value: proto.String(labels[n])})
+				key += "\xff" + n + "\xff" + labels[n]
+			}
+			if !seen[key] {
+				seen[key] = true
+				family.Metric = append(family.Metric, m)
+			}
+		}
+	}
+
+	relabeled := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		if len(mf.Metric) > 0 {
+			relabeled = append(relabeled, mf)
+		}
+	}
+	slices.SortFunc(relabeled, func(a, b *dto.MetricFamily) int { return strings.Compare(a.GetName(), b.GetName()) })
+
+	return relabeled
+}
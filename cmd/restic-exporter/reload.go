@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "restic_exporter",
+			Subsystem: "config",
+			Name:      "last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful",
+		},
+	)
+	configReloadSuccessTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "restic_exporter",
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful configuration reload",
+		},
+	)
+)
+
+// envReloadToken enables POST /-/reload for requests bearing it.
+var envReloadToken = os.Getenv("RESTIC_EXPORTER_RELOAD_TOKEN")
+
+var (
+	applyMu  sync.Mutex
+	stopJobs context.CancelFunc
+
+	// targetCollectors are registered for the repositories of the current
+	// configuration with envCollectTargets.
+	targetCollectors []*targetsCollector
+)
+
+// applyConfig makes cfg the current configuration and restarts the
+// background jobs, such as restore tests, to match it.
+func applyConfig(cfg *config) {
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	if stopJobs != nil {
+		stopJobs()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopJobs = cancel
+
+	currentConfig.Store(cfg)
+	if envCollectTargets {
+		registerTargetCollectors(cfg)
+	}
+	configReloadSuccessful.Set(1)
+	configReloadSuccessTime.Set(float64(time.Now().Unix()))
+
+	for _, repo := range cfg.Repositories {
+		if err := os.MkdirAll(repo.cacheDir(), 0o700); err != nil {
+			slog.Error("Creating cache directory failed", "repository", repo.Name, "path", repo.cacheDir(), "err", err)
+		}
+		if repo.RestoreTest.Interval > 0 {
+			go runRestoreTests(ctx, repo)
+		}
+	}
+	if cfg.Vault.client != nil {
+		go cfg.refreshVaultSecrets(ctx)
+	}
+	go cfg.watchSecretFiles(ctx)
+	if cfg.Discovery.Consul != nil || cfg.Discovery.Etcd != nil {
+		go cfg.refreshDiscoveredTargets(ctx)
+	}
+	if envCacheCleanupInterval > 0 {
+		go runCacheCleanup(ctx, cfg)
+	}
+	if envCacheWarmup {
+		go warmCaches(ctx, cfg)
+	}
+	if envFileSDPath != "" {
+		go writeFileSD(ctx, cfg)
+	}
+	if len(cfg.Alerts.Rules) > 0 {
+		go runAlertRules(ctx, cfg)
+	}
+	if len(cfg.Notifications.Webhooks) > 0 {
+		go runNotifications(ctx, cfg)
+	}
+}
+
+// registerTargetCollectors replaces the registered target collectors by
+// ones for the repositories of cfg.
+func registerTargetCollectors(cfg *config) {
+
+	for _, c := range targetCollectors {
+		prometheus.Unregister(c)
+	}
+
+	targetCollectors = nil
+	for _, repo := range cfg.Repositories {
+		c := newTargetsCollector(repo, &cfg.Metrics)
+		prometheus.MustRegister(c)
+		targetCollectors = append(targetCollectors, c)
+	}
+}
+
+// stopConfigJobs stops the background jobs of the current configuration.
+func stopConfigJobs() {
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	if stopJobs != nil {
+		stopJobs()
+		stopJobs = nil
+	}
+}
+
+// reloadConfig loads the configuration again and applies it. The current
+// configuration is kept if the new one is invalid.
+func reloadConfig() error {
+
+	cfg, err := loadConfig()
+	if err != nil {
+		configReloadSuccessful.Set(0)
+		return err
+	}
+	applyConfig(cfg)
+
+	slog.Info("Configuration reloaded", "repositories", len(cfg.Repositories))
+
+	return nil
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(envReloadToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := reloadConfig(); err != nil {
+		slog.Error("Reloading configuration failed", "err", err)
+		http.Error(w, fmt.Sprintf("Reloading configuration failed: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
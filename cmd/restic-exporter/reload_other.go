@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// reloadOnSIGHUP does nothing on platforms without SIGHUP; the configuration
+// can still be reloaded over HTTP.
+func reloadOnSIGHUP() {}
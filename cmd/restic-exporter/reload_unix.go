@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnSIGHUP reloads the configuration whenever the process receives
+// SIGHUP.
+func reloadOnSIGHUP() {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("Reloading configuration failed", "err", err)
+		}
+	}
+}
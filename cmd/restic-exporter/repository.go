@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"restic-exporter/pkg/collector"
+)
+
+var repositoryInfoDesc = prometheus.NewDesc(
+	"restic_repository_info",
+	"Identity and format version of the repository",
+	[]string{"repository", "id", "version", "chunker_polynomial"}, nil,
+)
+
+var repositoryMigrationPendingDesc = prometheus.NewDesc(
+	"restic_repository_migration_pending",
+	"Whether the repository format is outdated or restic reports pending migrations",
+	[]string{"repository"}, nil,
+)
+
+var (
+	repositoryKeysDesc = prometheus.NewDesc(
+		"restic_repository_keys",
+		"Number of keys of the repository",
+		[]string{"repository"}, nil,
+	)
+	repositoryKeysOldestDesc = prometheus.NewDesc(
+		"restic_repository_keys_oldest_timestamp_seconds",
+		"Creation time of the oldest key of the repository",
+		[]string{"repository"}, nil,
+	)
+	repositoryKeysNewestDesc = prometheus.NewDesc(
+		"restic_repository_keys_newest_timestamp_seconds",
+		"Creation time of the newest key of the repository",
+		[]string{"repository"}, nil,
+	)
+)
+
+// envCheckMigrations enables listing migrations with `restic migrate`, which
+// takes an exclusive lock on the repository.
+var envCheckMigrations = os.Getenv("RESTIC_EXPORTER_CHECK_MIGRATIONS") == "true"
+
+type resticKeyData struct {
+	ID       string `json:"id"`
+	Current  bool   `json:"current"`
+	UserName string `json:"userName"`
+	HostName string `json:"hostName"`
+	Created  string `json:"created"`
+}
+
+type resticConfigData struct {
+	Version           int    `json:"version"`
+	ID                string `json:"id"`
+	ChunkerPolynomial string `json:"chunker_polynomial"`
+}
+
+// repositoryCollector exports metrics describing the configured
+// repositories as a whole, as opposed to the per-target snapshot metrics
+// served on /probe.
+type repositoryCollector struct {
+	mu sync.Mutex
+	// configs caches the output of `restic cat config` by repository name
+	// and location, so it survives configuration reloads.
+	configs map[[2]string]*resticConfigData
+}
+
+func (c *repositoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- repositoryInfoDesc
+	ch <- repositoryMigrationPendingDesc
+	ch <- repositoryKeysDesc
+	ch <- repositoryKeysOldestDesc
+	ch <- repositoryKeysNewestDesc
+	ch <- locksDesc
+	ch <- locksOldestAgeDesc
+	ch <- repositoryStatsSizeDesc
+	ch <- repositoryRestoreSizeDesc
+	ch <- repositoryRawSizeDesc
+	ch <- repositoryStatsFilesDesc
+	ch <- repositoryStatsDedupRatioDesc
+	ch <- repositoryStatsCompressionRatioDesc
+	ch <- repositoryGrowthDesc
+	ch <- repositoryBlobsDesc
+	ch <- repositoryFilesDesc
+	ch <- repositoryPacksSizeDesc
+}
+
+func (c *repositoryCollector) Collect(ch chan<- prometheus.Metric) {
+
+	ctx := context.Background()
+
+	for _, repo := range currentConfig.Load().Repositories {
+		c.collectRepository(ctx, repo, ch)
+	}
+}
+
+func (c *repositoryCollector) collectRepository(ctx context.Context, repo *repository, ch chan<- prometheus.Metric) {
+
+	if err := collectKeys(ctx, repo, ch); err != nil {
+		slog.Error("Collecting keys failed", "repository", repo.Name, "err", err)
+	}
+
+	if err := collectLocks(ctx, repo, ch); err != nil {
+		slog.Error("Collecting locks failed", "repository", repo.Name, "err", err)
+	}
+
+	if envRepositoryStats {
+		if err := collectStats(ctx, repo, ch); err != nil {
+			slog.Error("Collecting stats failed", "repository", repo.Name, "err", err)
+		}
+		if err := collectBlobs(ctx, repo, ch); err != nil {
+			slog.Error("Collecting blob counts failed", "repository", repo.Name, "err", err)
+		}
+		if err := collectPacks(ctx, repo, ch); err != nil {
+			slog.Error("Collecting pack files failed", "repository", repo.Name, "err", err)
+		}
+	}
+
+	config, err := c.repositoryConfig(ctx, repo)
+	if err != nil {
+		slog.Error("Reading repository config failed", "repository", repo.Name, "err", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(repositoryInfoDesc, prometheus.GaugeValue, 1,
+		repo.Name, config.ID, strconv.Itoa(config.Version), config.ChunkerPolynomial)
+
+	pending := config.Version < 2
+	if !pending && envCheckMigrations {
+		migrations, err := pendingMigrations(ctx, repo)
+		if err != nil {
+			slog.Error("Listing migrations failed", "repository", repo.Name, "err", err)
+			return
+		}
+		pending = len(migrations) > 0
+	}
+
+	ch <- prometheus.MustNewConstMetric(repositoryMigrationPendingDesc, prometheus.GaugeValue, boolToFloat(pending), repo.Name)
+}
+
+// repositoryConfig returns the output of `restic cat config`. It only changes
+// when the repository is migrated to a new format, so it is fetched once
+// unless the repository still uses format version 1.
+func (c *repositoryCollector) repositoryConfig(ctx context.Context, repo *repository) (*resticConfigData, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := [2]string{repo.Name, repo.Repository}
+	if config, ok := c.configs[key]; ok {
+		return config, nil
+	}
+
+	var config resticConfigData
+	if err := unmarshallFromRestic(ctx, repo, &config, "cat", "config"); err != nil {
+		return nil, err
+	}
+	if config.Version >= 2 {
+		if c.configs == nil {
+			c.configs = map[[2]string]*resticConfigData{}
+		}
+		c.configs[key] = &config
+	}
+
+	return &config, nil
+}
+
+func collectKeys(ctx context.Context, repo *repository, ch chan<- prometheus.Metric) error {
+
+	var keys []resticKeyData
+	if err := unmarshallFromRestic(ctx, repo, &keys, "key", "list", "--json"); err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(repositoryKeysDesc, prometheus.GaugeValue, float64(len(keys)), repo.Name)
+
+	var oldest, newest time.Time
+	for _, k := range keys {
+		created, err := collector.ParseTime(k.Created)
+		if err != nil {
+			return err
+		}
+		if oldest.IsZero() || created.Before(oldest) {
+			oldest = created
+		}
+		if created.After(newest) {
+			newest = created
+		}
+	}
+
+	if len(keys) > 0 {
+		ch <- prometheus.MustNewConstMetric(repositoryKeysOldestDesc, prometheus.GaugeValue, float64(oldest.Unix()), repo.Name)
+		ch <- prometheus.MustNewConstMetric(repositoryKeysNewestDesc, prometheus.GaugeValue, float64(newest.Unix()), repo.Name)
+	}
+
+	return nil
+}
+
+// pendingMigrations returns the names of the migrations `restic migrate`
+// lists as available for the repository.
+func pendingMigrations(ctx context.Context, repo *repository) ([]string, error) {
+
+	out, err := runRestic(ctx, repo, "migrate")
+	if err != nil {
+		return nil, err
+	}
+
+	// restic prints "available migrations:" followed by one indented
+	// "name<TAB>description" line per migration.
+	var (
+		migrations []string
+		listing    bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "available migrations"):
+			listing = true
+		case listing && strings.HasPrefix(line, " "):
+			if fields := strings.Fields(line); len(fields) > 0 {
+				migrations = append(migrations, fields[0])
+			}
+		default:
+			listing = false
+		}
+	}
+
+	return migrations, scanner.Err()
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
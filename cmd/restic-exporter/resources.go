@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// resourceLimitsEnv passes the limits of restic to the exporter binary,
+// which restic is run through to set them before executing it.
+const resourceLimitsEnv = "RESTIC_EXPORTER_RESOURCE_LIMITS"
+
+// exporterExecutable is the path restic is run through to limit it.
+var exporterExecutable = sync.OnceValues(os.Executable)
+
+// resourcesConfig limits the resources of restic, so that e.g. stats of huge
+// repositories can't make the host run out of memory or starve its
+// workloads of disk bandwidth.
+type resourcesConfig struct {
+	// GOGC and MemoryLimit are passed to restic as GOGC and GOMEMLIMIT,
+	// tuning its garbage collector. MemoryLimit is a soft limit in bytes,
+	// optionally with a unit, e.g. 2GiB.
+	GOGC        string `yaml:"gogc"`
+	MemoryLimit string `yaml:"memory_limit"`
+	// AddressSpace is the hard limit of restic's virtual memory
+	// (RLIMIT_AS), optionally with a unit. Allocations beyond it fail.
+	AddressSpace string `yaml:"address_space"`
+	// OpenFiles limits the files restic can open (RLIMIT_NOFILE).
+	OpenFiles uint64 `yaml:"open_files"`
+	// CPUs are the numbers of the CPUs restic may run on.
+	CPUs []int `yaml:"cpus"`
+	// Nice is the nice level of restic, up to 19. IONice is its I/O
+	// scheduling class, idle, best-effort or realtime, optionally with a
+	// level from 0, the highest, to 7, e.g. best-effort:7.
+	Nice   int    `yaml:"nice"`
+	IONice string `yaml:"ionice"`
+
+	memoryLimit uint64
+	limits      resourceLimits
+}
+
+// resourceLimits are set by the exporter binary before executing restic.
+// Zero values leave the limits of the exporter.
+type resourceLimits struct {
+	// Bin is restic, as resolved by the exporter.
+	Bin          string `json:"bin"`
+	AddressSpace uint64 `json:"address_space,omitempty"`
+	OpenFiles    uint64 `json:"open_files,omitempty"`
+	CPUs         []int  `json:"cpus,omitempty"`
+	Nice         int    `json:"nice,omitempty"`
+	// IOClass is an I/O scheduling class of ioprio_set, e.g. 3 for idle,
+	// and IOLevel the level within it.
+	IOClass int `json:"io_class,omitempty"`
+	IOLevel int `json:"io_level,omitempty"`
+}
+
+func (l resourceLimits) empty() bool {
+	return l.AddressSpace == 0 && l.OpenFiles == 0 && len(l.CPUs) == 0 && l.Nice == 0 && l.IOClass == 0
+}
+
+// ioClasses are the I/O scheduling classes by their names in ionice.
+var ioClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+func (r *resourcesConfig) validate() error {
+
+	if r.GOGC != "" && r.GOGC != "off" {
+		if n, err := strconv.Atoi(r.GOGC); err != nil || n < 0 {
+			return fmt.Errorf("invalid gogc %q", r.GOGC)
+		}
+	}
+
+	var err error
+	if r.MemoryLimit != "" {
+		if r.memoryLimit, err = parseBytes(r.MemoryLimit); err != nil {
+			return fmt.Errorf("memory_limit: %w", err)
+		}
+	}
+	if r.AddressSpace != "" {
+		if r.limits.AddressSpace, err = parseBytes(r.AddressSpace); err != nil {
+			return fmt.Errorf("address_space: %w", err)
+		}
+	}
+	r.limits.OpenFiles = r.OpenFiles
+
+	for i, cpu := range r.CPUs {
+		if cpu < 0 || slices.Contains(r.CPUs[:i], cpu) {
+			return fmt.Errorf("invalid or duplicate cpu %d", cpu)
+		}
+	}
+	r.limits.CPUs = r.CPUs
+
+	if r.Nice < -20 || r.Nice > 19 {
+		return fmt.Errorf("invalid nice %d", r.Nice)
+	}
+	r.limits.Nice = r.Nice
+
+	if r.IONice != "" {
+		name, level, hasLevel := strings.Cut(r.IONice, ":")
+		r.limits.IOClass = ioClasses[name]
+		if r.limits.IOClass == 0 {
+			return fmt.Errorf("unknown ionice class %q", name)
+		}
+		if hasLevel {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 0 || n > 7 || name == "idle" {
+				return fmt.Errorf("invalid ionice level %q", r.IONice)
+			}
+			r.limits.IOLevel = n
+		} else if name != "idle" {
+			// the default of the kernel
+			r.limits.IOLevel = 4
+		}
+	}
+
+	if r.limits.empty() {
+		return nil
+	}
+	if envContainerRuntime != "" {
+		return errors.New("address_space, open_files, cpus, nice and ionice are not supported for restic in a container, set them in RESTIC_EXPORTER_CONTAINER_ARGS")
+	}
+	if err := checkResourceLimits(r.limits); err != nil {
+		return err
+	}
+	if _, err := exporterExecutable(); err != nil {
+		return fmt.Errorf("resource limits: %w", err)
+	}
+
+	return nil
+}
+
+// apply makes cmd run restic with the resources limited.
+func (r *resourcesConfig) apply(cmd *exec.Cmd) {
+
+	var env []string
+	if r.GOGC != "" {
+		env = append(env, "GOGC="+r.GOGC)
+	}
+	if r.memoryLimit > 0 {
+		env = append(env, "GOMEMLIMIT="+strconv.FormatUint(r.memoryLimit, 10))
+	}
+	if !r.limits.empty() {
+		limits := r.limits
+		limits.Bin = cmd.Path
+		data, _ := json.Marshal(limits)
+		env = append(env, resourceLimitsEnv+"="+string(data))
+		// checked when the configuration was loaded
+		cmd.Path, _ = exporterExecutable()
+	}
+	if env == nil {
+		return
+	}
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
+}
+
+// execLimitedRestic executes restic with the limits passed in data, if the
+// exporter binary was run to do so. It doesn't return then.
+func execLimitedRestic(data string) {
+
+	var limits resourceLimits
+	err := json.Unmarshal([]byte(data), &limits)
+	if err == nil {
+		env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+			return strings.HasPrefix(kv, resourceLimitsEnv+"=")
+		})
+		err = execLimited(limits, os.Args, env)
+	}
+
+	// restic's standard error is logged if it fails
+	fmt.Fprintln(os.Stderr, "restic-exporter: limiting resources of restic failed:", err)
+	os.Exit(126)
+}
+
+// parseBytes parses a number of bytes with an optional unit of B, KiB,
+// MiB, GiB or TiB, like GOMEMLIMIT.
+func parseBytes(s string) (uint64, error) {
+
+	units := []struct {
+		suffix string
+		factor uint64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"B", 1},
+	}
+
+	num, factor := s, uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			num, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > (1<<64-1)/factor {
+		return 0, errors.New("size too large")
+	}
+
+	return n * factor, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Arguments of ioprio_set, see linux/ioprio.h.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// checkResourceLimits accepts all limits, Linux supports them.
+func checkResourceLimits(limits resourceLimits) error {
+	return nil
+}
+
+// execLimited executes restic as limits.Bin with argv and env, after setting
+// the limits on the exporter process, which restic inherits.
+func execLimited(limits resourceLimits, argv, env []string) error {
+
+	// the CPU affinity is that of the thread executing restic
+	runtime.LockOSThread()
+
+	if limits.AddressSpace > 0 {
+		rlimit := syscall.Rlimit{Cur: limits.AddressSpace, Max: limits.AddressSpace}
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &rlimit); err != nil {
+			return err
+		}
+	}
+	if limits.OpenFiles > 0 {
+		rlimit := syscall.Rlimit{Cur: limits.OpenFiles, Max: limits.OpenFiles}
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+			return err
+		}
+	}
+
+	if len(limits.CPUs) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range limits.CPUs {
+			set.Set(cpu)
+		}
+		if err := unix.SchedSetaffinity(0, &set); err != nil {
+			return err
+		}
+	}
+
+	// both are set for the current thread, which restic inherits
+	if limits.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, limits.Nice); err != nil {
+			return err
+		}
+	}
+	if limits.IOClass != 0 {
+		ioprio := limits.IOClass<<ioprioClassShift | limits.IOLevel
+		if _, _, errno := syscall.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio)); errno != 0 {
+			return errno
+		}
+	}
+
+	return syscall.Exec(limits.Bin, argv, env)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errResourceLimits = errors.New("address_space, open_files, cpus, nice and ionice are only supported on Linux")
+
+// checkResourceLimits rejects all limits, setting them is only implemented
+// for Linux.
+func checkResourceLimits(limits resourceLimits) error {
+	return errResourceLimits
+}
+
+func execLimited(limits resourceLimits, argv, env []string) error {
+	return errResourceLimits
+}
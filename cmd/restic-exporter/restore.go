@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	restoreTestSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "restore_test",
+			Name:      "success",
+			Help:      "Whether the last restore test succeeded",
+		},
+		[]string{"repository"},
+	)
+	restoreTestDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "restore_test",
+			Name:      "duration_seconds",
+			Help:      "Duration of the last restore test",
+		},
+		[]string{"repository"},
+	)
+	restoreTestLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "restic",
+			Subsystem: "restore_test",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time of the last restore test",
+		},
+		[]string{"repository"},
+	)
+)
+
+// restoreTestConfig controls the periodic restore verification. It is
+// disabled unless an interval is set.
+type restoreTestConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Path     string        `yaml:"path"`
+	SHA256   string        `yaml:"sha256"`
+	MaxSize  int64         `yaml:"max_size"`
+}
+
+// resticLsNode is a single line of `restic ls --json` output. The first
+// line describes the snapshot, every following line a node in it.
+type resticLsNode struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+func restoreTestConfigFromEnv() (restoreTestConfig, error) {
+	cfg := restoreTestConfig{
+		Path:   os.Getenv("RESTIC_EXPORTER_RESTORE_TEST_PATH"),
+		SHA256: os.Getenv("RESTIC_EXPORTER_RESTORE_TEST_SHA256"),
+	}
+
+	if val := os.Getenv("RESTIC_EXPORTER_RESTORE_TEST_INTERVAL"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return cfg, fmt.Errorf("RESTIC_EXPORTER_RESTORE_TEST_INTERVAL: %w", err)
+		}
+		cfg.Interval = d
+	}
+
+	if val := os.Getenv("RESTIC_EXPORTER_RESTORE_TEST_MAX_SIZE"); val != "" {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("RESTIC_EXPORTER_RESTORE_TEST_MAX_SIZE: %w", err)
+		}
+		cfg.MaxSize = n
+	}
+
+	return cfg, nil
+}
+
+// validate checks cfg and fills in defaults.
+func (cfg *restoreTestConfig) validate() error {
+
+	if cfg.SHA256 != "" && cfg.Path == "" {
+		return errors.New("restore test checksum requires a path")
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 1 << 20
+	}
+
+	return nil
+}
+
+// runRestoreTests restores a file from the latest snapshot of repo every
+// restore test interval until ctx is done.
+func runRestoreTests(ctx context.Context, repo *repository) {
+
+	cfg := repo.RestoreTest
+	gate := gateFor(repo.Name)
+
+	var last time.Time
+	for {
+		busy := false
+		// only the leader runs restore tests, starting when it takes over
+		if isLeader() && time.Since(last) >= cfg.Interval {
+			if err := gate.tryAcquire("restore test"); err != nil {
+				// tried again shortly, e.g. once a backup finished
+				slog.Info("Restore test postponed", "repository", repo.Name, "err", err)
+				busy = true
+			} else {
+				start := time.Now()
+				last = start
+				err := restoreTest(ctx, repo, cfg)
+				gate.release()
+				if ctx.Err() != nil {
+					// stopped by a configuration reload
+					return
+				}
+				restoreTestDuration.WithLabelValues(repo.Name).Set(time.Since(start).Seconds())
+				restoreTestLastRun.WithLabelValues(repo.Name).Set(float64(start.Unix()))
+				recordRestoreTest(repo.Name, start, err)
+
+				if err != nil {
+					slog.Error("Restore test failed", "repository", repo.Name, "err", err)
+					restoreTestSuccess.WithLabelValues(repo.Name).Set(0)
+				} else {
+					restoreTestSuccess.WithLabelValues(repo.Name).Set(1)
+				}
+			}
+		}
+
+		wait := cfg.Interval - time.Since(last)
+		if busy {
+			wait = time.Minute
+		}
+		if elector != nil {
+			wait = min(wait, envLeaseDuration)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func restoreTest(ctx context.Context, repo *repository, cfg restoreTestConfig) error {
+
+	path := cfg.Path
+	if path == "" {
+		var err error
+		if path, err = pickRestoreTestFile(ctx, repo, cfg.MaxSize); err != nil {
+			return err
+		}
+	}
+
+	// restic in a container can only write to the mounted cache directory
+	parent := ""
+	if envContainerRuntime != "" {
+		parent = envCacheDir
+	}
+	dir, err := os.MkdirTemp(parent, "restic-exporter-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := runRestic(ctx, repo, "restore", "latest", "--target", dir, "--include", path); err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(dir, path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if cfg.SHA256 == "" {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != cfg.SHA256 {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", path, sum, cfg.SHA256)
+	}
+
+	return nil
+}
+
+// pickRestoreTestFile returns the path of a random regular file no larger
+// than maxSize from the latest snapshot.
+func pickRestoreTestFile(ctx context.Context, repo *repository, maxSize int64) (string, error) {
+
+	out, err := runRestic(ctx, repo, "ls", "latest", "--json")
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		path string
+		seen int
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var node resticLsNode
+		if err := json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			return "", err
+		}
+		if node.Type != "file" || node.Size > maxSize {
+			continue
+		}
+		// reservoir sampling picks uniformly in a single pass
+		seen++
+		if rand.Intn(seen) == 0 {
+			path = node.Path
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if path == "" {
+		return "", errors.New("no file suitable for a restore test in latest snapshot")
+	}
+
+	return path, nil
+}
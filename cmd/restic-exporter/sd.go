@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// envSDAddress is the address Prometheus reaches the exporter at, used
+	// in the discovered targets. It defaults to the Host of the request for
+	// /sd, and to the listen address for the file_sd file.
+	envSDAddress = getEnv("RESTIC_EXPORTER_SD_ADDRESS", "")
+
+	// envFileSDPath enables writing the targets to a Prometheus file_sd file
+	// every envFileSDInterval.
+	envFileSDPath     = getEnv("RESTIC_EXPORTER_FILE_SD_PATH", "")
+	envFileSDInterval = getEnvDuration("RESTIC_EXPORTER_FILE_SD_INTERVAL", time.Minute)
+)
+
+// sdGroup is a Prometheus service discovery target group.
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdGroups returns a target group for every target of the repositories of
+// cfg. Each group scrapes /probe on the exporter at address with the target
+// and repository parameters set. The scheme is left to the scrape config if
+// empty.
+func sdGroups(cfg *config, address, scheme string) []sdGroup {
+
+	groups := []sdGroup{}
+	for _, repo := range cfg.Repositories {
+		for _, target := range repo.targets() {
+			g := sdGroup{
+				Targets: []string{address},
+				Labels: map[string]string{
+					"__metrics_path__":   "/probe",
+					"__param_target":     target.Host,
+					"__param_repository": repo.Name,
+					"repository":         repo.Name,
+					"target":             target.Host,
+				},
+			}
+			if scheme != "" {
+				g.Labels["__scheme__"] = scheme
+			}
+			if len(target.Tags) > 0 {
+				g.Labels["__param_tags"] = strings.Join(target.Tags, ",")
+			}
+			groups = append(groups, g)
+		}
+	}
+
+	return groups
+}
+
+// sdHandler implements Prometheus HTTP service discovery, returning the
+// probes of all repository targets.
+func sdHandler(w http.ResponseWriter, r *http.Request) {
+
+	address := envSDAddress
+	if address == "" {
+		address = r.Host
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	writeJSON(w, http.StatusOK, sdGroups(currentConfig.Load(), address, scheme))
+}
+
+// writeFileSD writes the targets of cfg to envFileSDPath every
+// envFileSDInterval until ctx is done.
+func writeFileSD(ctx context.Context, cfg *config) {
+
+	address := envSDAddress
+	if address == "" {
+		address = envAddress + ":" + envPort
+	}
+
+	ticker := time.NewTicker(envFileSDInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeFileSDOnce(sdGroups(cfg, address, "")); err != nil {
+			slog.Error("Writing file_sd file failed", "path", envFileSDPath, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeFileSDOnce replaces envFileSDPath with groups. The file is renamed
+// into place, so that Prometheus never reads it half written.
+func writeFileSDOnce(groups []sdGroup) error {
+
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(envFileSDPath), ".restic-exporter-sd-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), envFileSDPath)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var secretReloadTime = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "restic_exporter",
+		Subsystem: "secret",
+		Name:      "last_reload_timestamp_seconds",
+		Help:      "Time the secrets of the repository were last resolved",
+	},
+	[]string{"repository"},
+)
+
+// Secret references in the secrets of a repository. Secrets are resolved
+// when the configuration is loaded, and when a referenced file changes.
+//
+//	file://<path>                               Contents of a file
+//	aws-sm://<secret name or ARN>[#<JSON key>]  AWS Secrets Manager
+//	aws-ssm://<parameter name>                  AWS SSM Parameter Store
+const (
+	fileScheme              = "file://"
+	awsSecretsManagerScheme = "aws-sm://"
+	awsSSMScheme            = "aws-ssm://"
+)
+
+// loadAWSConfig loads the AWS configuration from the environment, shared
+// files or the instance's IAM role.
+var loadAWSConfig = sync.OnceValues(func() (aws.Config, error) {
+	return awsconfig.LoadDefaultConfig(context.Background())
+})
+
+// validateSecretRef checks that ref uses a supported secret store.
+func validateSecretRef(ref string) error {
+	for _, scheme := range []string{fileScheme, awsSecretsManagerScheme, awsSSMScheme} {
+		if strings.HasPrefix(ref, scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported secret reference %q", ref)
+}
+
+// resolveSecret returns the value ref refers to.
+func resolveSecret(ctx context.Context, ref string) (string, error) {
+
+	if path, ok := strings.CutPrefix(ref, fileScheme); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if id, ok := strings.CutPrefix(ref, awsSecretsManagerScheme); ok {
+		id, key, _ := strings.Cut(id, "#")
+		return awsSecretsManagerSecret(ctx, id, key)
+	}
+	if name, ok := strings.CutPrefix(ref, awsSSMScheme); ok {
+		return awsSSMParameter(ctx, name)
+	}
+
+	return "", fmt.Errorf("unsupported secret reference %q", ref)
+}
+
+// awsSecretsManagerSecret returns the secret string of id, or the value of
+// key in it if the secret is a JSON object.
+func awsSecretsManagerSecret(ctx context.Context, id, key string) (string, error) {
+
+	cfg, err := loadAWSConfig()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s is binary", id)
+	}
+	if key == "" {
+		return *out.SecretString, nil
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(*out.SecretString), &values); err != nil {
+		return "", fmt.Errorf("secret %s: %w", id, err)
+	}
+	val, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("no key %q in secret %s", key, id)
+	}
+
+	return fmt.Sprint(val), nil
+}
+
+// awsSSMParameter returns the value of the parameter called name, decrypted
+// if it is a SecureString.
+func awsSSMParameter(ctx context.Context, name string) (string, error) {
+
+	cfg, err := loadAWSConfig()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return "", errors.New("parameter " + name + " has no value")
+	}
+
+	return *out.Parameter.Value, nil
+}
+
+// resolveSecrets resolves the secrets of all repositories of c, including
+// those read from Vault.
+func (c *config) resolveSecrets(ctx context.Context) error {
+
+	for _, repo := range c.Repositories {
+		if err := repo.resolveSecrets(ctx); err != nil {
+			return fmt.Errorf("repository %q: %w", repo.Name, err)
+		}
+	}
+
+	return c.resolveVaultSecrets(ctx)
+}
+
+// resolveSecrets resolves the secrets of r. They are only replaced if all
+// of them could be resolved.
+func (r *repository) resolveSecrets(ctx context.Context) error {
+
+	if len(r.Secrets) == 0 {
+		return nil
+	}
+
+	var env []string
+	for name, ref := range r.Secrets {
+		val, err := resolveSecret(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", name, err)
+		}
+		env = append(env, name+"="+val)
+	}
+	sort.Strings(env)
+
+	r.resolvedSecrets.Store(&env)
+	secretReloadTime.WithLabelValues(r.Name).Set(float64(time.Now().Unix()))
+
+	return nil
+}
+
+// watchSecretFiles resolves the secrets of repositories again whenever a
+// file they reference changes, until ctx is done. The directories are
+// watched rather than the files, since Kubernetes updates mounted secrets by
+// replacing a symlink.
+func (c *config) watchSecretFiles(ctx context.Context) {
+
+	dirs := map[string][]*repository{}
+	for _, repo := range c.Repositories {
+		for _, ref := range repo.Secrets {
+			if path, ok := strings.CutPrefix(ref, fileScheme); ok {
+				dir := filepath.Dir(path)
+				if !slices.Contains(dirs[dir], repo) {
+					dirs[dir] = append(dirs[dir], repo)
+				}
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Watching secret files failed", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			slog.Error("Watching secret files failed", "path", dir, "err", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.Errors:
+			slog.Error("Watching secret files failed", "err", err)
+		case event := <-watcher.Events:
+			for _, repo := range dirs[filepath.Dir(event.Name)] {
+				if err := repo.resolveSecrets(ctx); err != nil {
+					slog.Error("Reloading secrets failed", "repository", repo.Name, "path", event.Name, "err", err)
+					continue
+				}
+				slog.Debug("Secrets reloaded", "repository", repo.Name, "path", event.Name)
+			}
+		}
+	}
+}
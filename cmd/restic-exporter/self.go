@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The groups of metrics about the exporter itself, which can be included in
+// or excluded from /metrics and probes.
+const (
+	// selfRuntime are the go_ and process_ metrics of the Go runtime.
+	selfRuntime = "runtime"
+	// selfExporter are the restic_exporter_ metrics on the operation of
+	// the exporter, e.g. restic commands and HTTP requests.
+	selfExporter = "exporter"
+)
+
+var (
+	// runtimeRegistry and exporterRegistry hold the metrics of the groups,
+	// to add them to probes without collecting the repositories.
+	runtimeRegistry  = prometheus.NewRegistry()
+	exporterRegistry = prometheus.NewRegistry()
+)
+
+func init() {
+	runtimeRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// registerExporterMetrics registers metrics on the operation of the exporter
+// for /metrics and probes.
+func registerExporterMetrics(cs ...prometheus.Collector) {
+	prometheus.MustRegister(cs...)
+	exporterRegistry.MustRegister(cs...)
+}
+
+// selfGroup returns the group of metrics about the exporter itself name
+// belongs to, "" for the metrics about backups.
+func selfGroup(name string) string {
+	switch {
+	case strings.HasPrefix(name, "go_"), strings.HasPrefix(name, "process_"):
+		return selfRuntime
+	case strings.HasPrefix(name, "restic_exporter_"), strings.HasPrefix(name, "promhttp_"):
+		return selfExporter
+	}
+	return ""
+}
+
+func validateSelfGroups(groups []string) error {
+
+	for i, group := range groups {
+		if group != selfRuntime && group != selfExporter {
+			return fmt.Errorf("unknown group %q", group)
+		}
+		if slices.Contains(groups[:i], group) {
+			return fmt.Errorf("group %q listed twice", group)
+		}
+	}
+
+	return nil
+}
+
+// metricsSelfGroups returns the groups of metrics about the exporter itself
+// served on /metrics, by default all.
+func (m *metricsConfig) metricsSelfGroups() []string {
+	if m.MetricsInclude == nil {
+		return []string{selfRuntime, selfExporter}
+	}
+	return m.MetricsInclude
+}
+
+// filterSelf drops the metrics about the exporter itself of groups not in
+// include from mfs.
+func filterSelf(mfs []*dto.MetricFamily, include []string) []*dto.MetricFamily {
+	return slices.DeleteFunc(mfs, func(mf *dto.MetricFamily) bool {
+		group := selfGroup(mf.GetName())
+		return group != "" && !slices.Contains(include, group)
+	})
+}
+
+// withProbeSelf returns g extended by the metrics about the exporter itself
+// configured to be included in probes, renamed and relabeled like those on
+// /metrics.
+func withProbeSelf(g prometheus.Gatherer) prometheus.Gatherer {
+
+	gatherers := prometheus.Gatherers{g}
+	for _, group := range currentConfig.Load().Metrics.ProbeInclude {
+		switch group {
+		case selfRuntime:
+			gatherers = append(gatherers, labelsGatherer{g: runtimeRegistry, self: true})
+		case selfExporter:
+			gatherers = append(gatherers, labelsGatherer{g: exporterRegistry, self: true})
+		}
+	}
+
+	return gatherers
+}
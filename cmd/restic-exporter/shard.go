@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+)
+
+// shardIndex and shardTotal split the repositories between replicas of the
+// exporter. Each replica collects the repositories whose name hashes to its
+// index.
+var (
+	shardIndex int
+	shardTotal = 1
+)
+
+func checkShard() error {
+	if shardTotal < 1 || shardIndex < 0 || shardIndex >= shardTotal {
+		return fmt.Errorf("shard index %d out of range for %d shards", shardIndex, shardTotal)
+	}
+	return nil
+}
+
+// ownsRepository reports whether the repository called name belongs to this
+// replica's shard.
+func ownsRepository(name string) bool {
+	if shardTotal == 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(shardTotal)) == shardIndex
+}
+
+// shard drops the repositories of other shards from c.
+func (c *config) shard() {
+
+	if shardTotal == 1 {
+		return
+	}
+
+	var owned []*repository
+	for _, repo := range c.Repositories {
+		if ownsRepository(repo.Name) {
+			owned = append(owned, repo)
+		}
+	}
+	slog.Info("Collecting shard of repositories", "shard", shardIndex, "shards", shardTotal, "repositories", len(owned), "configured", len(c.Repositories))
+	c.Repositories = owned
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sharedCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "restic_exporter",
+		Subsystem: "shared_cache",
+		Name:      "requests_total",
+		Help:      "Lookups of restic output in the shared cache by result",
+	},
+	[]string{"result"},
+)
+
+// envSharedCacheTTL is how long restic output is kept in the shared cache.
+var envSharedCacheTTL = getEnvDuration("RESTIC_EXPORTER_SHARED_CACHE_TTL", time.Minute)
+
+// sharedCacheable are the subcommands whose output is shared. They only
+// read the repository, and their output is the same for all replicas.
+var sharedCacheable = []string{"snapshots", "stats", "cat", "key", "ls", "diff"}
+
+// sharedCache holds the output of restic invocations shared by exporter
+// replicas. It is nil unless RESTIC_EXPORTER_SHARED_CACHE is set.
+var sharedCache resultCache
+
+type resultCache interface {
+	get(ctx context.Context, key string) ([]byte, bool, error)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// setupSharedCache connects to the cache RESTIC_EXPORTER_SHARED_CACHE
+// points to, a redis://, rediss:// or memcache:// URL.
+func setupSharedCache() error {
+
+	raw := getEnv("RESTIC_EXPORTER_SHARED_CACHE", "")
+	if raw == "" {
+		return nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("RESTIC_EXPORTER_SHARED_CACHE: %w", err)
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		c := &redisCache{address: u.Host, tls: u.Scheme == "rediss"}
+		if !strings.Contains(c.address, ":") {
+			c.address += ":6379"
+		}
+		if u.User != nil {
+			c.username = u.User.Username()
+			c.password, _ = u.User.Password()
+			if c.password == "" {
+				// redis://:password@host or the password alone
+				c.username, c.password = "", c.username
+			}
+		}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil {
+				return fmt.Errorf("RESTIC_EXPORTER_SHARED_CACHE: invalid database %q", db)
+			}
+		}
+		sharedCache = c
+	case "memcache":
+		address := u.Host
+		if !strings.Contains(address, ":") {
+			address += ":11211"
+		}
+		sharedCache = &memcacheCache{address: address}
+	default:
+		return fmt.Errorf("RESTIC_EXPORTER_SHARED_CACHE: unknown scheme %q", u.Scheme)
+	}
+
+	return nil
+}
+
+// sharedCacheKey returns the cache key of running restic with args against
+// repo, or "" if the output is not shared.
+func sharedCacheKey(repo *repository, args []string) string {
+
+	sub, _, _ := strings.Cut(subcommand(args), " ")
+	if sharedCache == nil || !slices.Contains(sharedCacheable, sub) {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, s := range append([]string{repo.Name, repo.Repository}, append(args, repo.args()...)...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	return "restic-exporter:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedOutput returns the shared output for key. Failures of the cache are
+// logged and treated as misses.
+func cachedOutput(ctx context.Context, key string) ([]byte, bool) {
+
+	out, ok, err := sharedCache.get(ctx, key)
+	switch {
+	case err != nil:
+		slog.Warn("Reading shared cache failed", "err", err)
+		sharedCacheRequests.WithLabelValues("error").Inc()
+	case ok:
+		sharedCacheRequests.WithLabelValues("hit").Inc()
+	default:
+		sharedCacheRequests.WithLabelValues("miss").Inc()
+	}
+
+	return out, ok
+}
+
+func storeOutput(ctx context.Context, key string, out []byte) {
+	if err := sharedCache.set(ctx, key, out, envSharedCacheTTL); err != nil {
+		slog.Warn("Writing shared cache failed", "err", err)
+	}
+}
+
+// cacheConn is a connection to a cache server, opened on first use and
+// after errors.
+type cacheConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+const cacheTimeout = 2 * time.Second
+
+// do runs f on the connection, dialing it with dial if needed. The
+// connection is closed if f fails, as the protocol state is unknown.
+func (c *cacheConn) do(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), f func(w io.Writer, r *bufio.Reader) error) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		ctx, cancel := context.WithTimeout(ctx, cacheTimeout)
+		conn, err := dial(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		c.conn, c.r = conn, bufio.NewReader(conn)
+	}
+
+	deadline := time.Now().Add(cacheTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	if err := f(c.conn, c.r); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// redisCache stores restic output in Redis.
+type redisCache struct {
+	address  string
+	tls      bool
+	username string
+	password string
+	db       int
+
+	conn cacheConn
+}
+
+func (c *redisCache) dial(ctx context.Context) (net.Conn, error) {
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.address)
+		d := tls.Dialer{Config: &tls.Config{ServerName: host}}
+		conn, err = d.DialContext(ctx, "tcp", c.address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", c.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(cacheTimeout))
+	r := bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" {
+		if c.username != "" {
+			setup = append(setup, []string{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, cmd := range setup {
+		if _, _, err := redisCommand(conn, r, cmd...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: %s: %w", cmd[0], err)
+		}
+	}
+
+	return conn, nil
+}
+
+// redisCommand sends a command and reads a simple, integer or bulk string
+// reply. ok is false for a nil reply.
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) (reply []byte, ok bool, err error) {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return nil, false, err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, false, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, false, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), true, nil
+	case '-':
+		return nil, false, errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid reply %q", line)
+		}
+		if n < 0 {
+			return nil, false, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, false, err
+		}
+		return data[:n], true, nil
+	}
+
+	return nil, false, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *redisCache) get(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	err = c.conn.do(ctx, c.dial, func(w io.Writer, r *bufio.Reader) error {
+		value, ok, err = redisCommand(w, r, "GET", key)
+		return err
+	})
+	return value, ok, err
+}
+
+func (c *redisCache) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.conn.do(ctx, c.dial, func(w io.Writer, r *bufio.Reader) error {
+		_, _, err := redisCommand(w, r, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		return err
+	})
+}
+
+// memcacheCache stores restic output in memcached, using the text protocol.
+type memcacheCache struct {
+	address string
+
+	conn cacheConn
+}
+
+func (c *memcacheCache) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", c.address)
+}
+
+func (c *memcacheCache) get(ctx context.Context, key string) (value []byte, ok bool, err error) {
+	err = c.conn.do(ctx, c.dial, func(w io.Writer, r *bufio.Reader) error {
+		if _, err := fmt.Fprintf(w, "get %s\r\n", key); err != nil {
+			return err
+		}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 1 && fields[0] == "END":
+				return nil
+			case len(fields) == 4 && fields[0] == "VALUE":
+				n, err := strconv.Atoi(fields[3])
+				if err != nil {
+					return fmt.Errorf("memcache: invalid reply %q", line)
+				}
+				data := make([]byte, n+2)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return err
+				}
+				value, ok = data[:n], true
+			default:
+				return fmt.Errorf("memcache: %s", strings.TrimSpace(line))
+			}
+		}
+	})
+	return value, ok, err
+}
+
+func (c *memcacheCache) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.conn.do(ctx, c.dial, func(w io.Writer, r *bufio.Reader) error {
+		if _, err := fmt.Fprintf(w, "set %s 0 %d %d\r\n%s\r\n", key, max(int(ttl.Seconds()), 1), len(value), value); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line = strings.TrimSpace(line); line != "STORED" {
+			// e.g. SERVER_ERROR object too large for cache
+			return fmt.Errorf("memcache: %s", line)
+		}
+		return nil
+	})
+}
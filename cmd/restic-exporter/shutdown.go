@@ -0,0 +1,14 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// envShutdownTimeout bounds how long in-flight requests may take to finish
+// once the exporter is asked to stop.
+var envShutdownTimeout = getEnvDuration("RESTIC_EXPORTER_SHUTDOWN_TIMEOUT", 30*time.Second)
+
+// resticCtx is cancelled by killRestic when the exporter gives up waiting
+// for in-flight work on shutdown, stopping every restic still running.
+var resticCtx, killRestic = context.WithCancel(context.Background())
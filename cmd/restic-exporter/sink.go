@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// A sink delivers the exporter's metrics to an output target. Run blocks
+// until ctx is done or the sink fails.
+type sink interface {
+	Run(ctx context.Context, g prometheus.Gatherer) error
+}
+
+var envSinkInterval = getEnvDuration("RESTIC_EXPORTER_SINK_INTERVAL", time.Minute)
+
+// sinksFromEnv returns the sinks listed in RESTIC_EXPORTER_SINKS. Without
+// it, metrics are only served for Prometheus to scrape, or only written to
+// textfileDir if set. webConfigFile is the exporter toolkit web
+// configuration of the HTTP server, if any.
+func sinksFromEnv(webConfigFile, textfileDir string) ([]sink, error) {
+
+	names := os.Getenv("RESTIC_EXPORTER_SINKS")
+	if names == "" && textfileDir != "" {
+		names = "textfile"
+	}
+	if names == "" {
+		names = "prometheus"
+	}
+	if textfileDir == "" {
+		textfileDir = os.Getenv("RESTIC_EXPORTER_TEXTFILE_DIRECTORY")
+	}
+
+	var sinks []sink
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "prometheus":
+			sinks = append(sinks, prometheusSink{address: envAddress + ":" + envPort, webConfigFile: webConfigFile})
+		case "json":
+			sinks = append(sinks, jsonSink{path: getEnvNotEmpty("RESTIC_EXPORTER_JSON_FILE")})
+		case "textfile":
+			if textfileDir == "" {
+				return nil, errors.New("textfile sink requires --collector.textfile.directory or RESTIC_EXPORTER_TEXTFILE_DIRECTORY")
+			}
+			sinks = append(sinks, textfileSink{dir: textfileDir})
+		case "pushgateway":
+			s, err := pushgatewaySinkFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		case "remote_write":
+			s, err := remoteWriteSinkFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		case "influxdb":
+			s, err := influxDBSinkFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		case "graphite":
+			sinks = append(sinks, graphiteSinkFromEnv())
+		case "statsd":
+			sinks = append(sinks, statsdSinkFromEnv())
+		case "otlp":
+			c, err := otlpClientFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, &otlpSink{client: c})
+		default:
+			return nil, fmt.Errorf("unknown sink %q in RESTIC_EXPORTER_SINKS", name)
+		}
+	}
+
+	return sinks, nil
+}
+
+// runSinks runs all sinks concurrently until ctx is done or one of them
+// fails, then waits for the others to stop. It returns the first error other
+// than the cancellation itself.
+func runSinks(ctx context.Context, g prometheus.Gatherer, sinks []sink) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(sinks))
+	for _, s := range sinks {
+		go func(s sink) {
+			errs <- s.Run(ctx, g)
+		}(s)
+	}
+
+	var first error
+	for range sinks {
+		err := <-errs
+		cancel()
+		if first == nil && err != nil && !errors.Is(err, context.Canceled) {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// emitEvery calls emit every interval until ctx is done. Failed emits are
+// logged and retried on the next tick.
+func emitEvery(ctx context.Context, interval time.Duration, emit func() error) error {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := emit(); err != nil {
+			slog.Error("Emitting metrics failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// prometheusSink serves g on /metrics and per-target probes on /probe. TLS
+// and HTTP/2 are set up from webConfigFile.
+type prometheusSink struct {
+	address       string
+	webConfigFile string
+}
+
+func (s prometheusSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+
+	slog.Info("Starting exporter", "address", "http://"+s.address)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", instrumentHandler("/metrics", allowNetworks("/metrics", requireClientCert(requireAuth(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, promhttp.HandlerFor(withLabels(g), promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	))))))
+	mux.Handle("/probe", instrumentHandler("/probe", allowNetworks("/probe", requireClientCert(requireAuth(http.HandlerFunc(probeHandler))))))
+	mux.Handle("/api/v1/snapshots", instrumentHandler("/api/v1/snapshots", allowNetworks("/api/v1/snapshots", requireClientCert(requireAuth(http.HandlerFunc(snapshotsHandler))))))
+	mux.Handle("/api/v1/stats", instrumentHandler("/api/v1/stats", allowNetworks("/api/v1/stats", requireClientCert(requireAuth(http.HandlerFunc(statsHandler))))))
+	mux.Handle("/api/v1/diff", instrumentHandler("/api/v1/diff", allowNetworks("/api/v1/diff", requireClientCert(requireAuth(http.HandlerFunc(diffHandler))))))
+	mux.Handle("/api/v1/backup", instrumentHandler("/api/v1/backup", allowNetworks("/api/v1/backup", requireClientCert(http.HandlerFunc(backupHandler)))))
+	mux.Handle("/api/v1/maintenance/", instrumentHandler("/api/v1/maintenance/", allowNetworks("/api/v1/maintenance/", requireClientCert(http.HandlerFunc(maintenanceHandler)))))
+	mux.Handle("/api/v1/backup/progress", instrumentHandler("/api/v1/backup/progress", allowNetworks("/api/v1/backup/progress", requireClientCert(requireAuth(http.HandlerFunc(backupProgressHandler))))))
+	mux.Handle("/api/v1/progress/stream", instrumentHandler("/api/v1/progress/stream", allowNetworks("/api/v1/progress/stream", requireClientCert(requireAuth(http.HandlerFunc(progressStreamHandler))))))
+	mux.Handle("/api/v1/history", instrumentHandler("/api/v1/history", allowNetworks("/api/v1/history", requireClientCert(requireAuth(http.HandlerFunc(historyHandler))))))
+	mux.Handle("/api/v1/alerts", instrumentHandler("/api/v1/alerts", allowNetworks("/api/v1/alerts", requireClientCert(requireAuth(http.HandlerFunc(alertsHandler))))))
+	mux.Handle("/sd", instrumentHandler("/sd", allowNetworks("/sd", requireClientCert(requireAuth(http.HandlerFunc(sdHandler))))))
+	mux.Handle("/ui", instrumentHandler("/ui", allowNetworks("/ui", requireClientCert(requireAuth(http.HandlerFunc(uiHandler))))))
+	mux.Handle("/healthz", instrumentHandler("/healthz", http.HandlerFunc(healthzHandler)))
+	mux.Handle("/readyz", instrumentHandler("/readyz", http.HandlerFunc(readyzHandler)))
+	mux.Handle("/", instrumentHandler("/", http.HandlerFunc(landingHandler)))
+	if enablePprof {
+		handlePprof(mux)
+	}
+	if envReloadToken != "" {
+		mux.Handle("/-/reload", instrumentHandler("/-/reload", allowNetworks("/-/reload", requireClientCert(http.HandlerFunc(reloadHandler)))))
+	}
+
+	srv := newHTTPServer(s.address, mux)
+
+	errs := make(chan error, 1)
+	go func() {
+		systemdSocket := false
+		errs <- web.ListenAndServe(srv, &web.FlagConfig{
+			WebListenAddresses: &[]string{s.address},
+			WebSystemdSocket:   &systemdSocket,
+			WebConfigFile:      &s.webConfigFile,
+		}, kitLogger{})
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down exporter", "timeout", envShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), envShutdownTimeout)
+	defer cancel()
+
+	// stop accepting requests and wait for in-flight probes
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Requests still running at shutdown, stopping restic", "err", err)
+		killRestic()
+		return srv.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/graphite"
+)
+
+// graphiteSink periodically sends all metrics, including the probes of all
+// targets, to a Graphite server with the plaintext protocol.
+type graphiteSink struct {
+	address  string
+	prefix   string
+	useTags  bool
+	interval time.Duration
+}
+
+// graphiteSinkFromEnv configures a graphiteSink from
+// RESTIC_EXPORTER_GRAPHITE_*.
+func graphiteSinkFromEnv() *graphiteSink {
+	return &graphiteSink{
+		address:  net.JoinHostPort(getEnvNotEmpty("RESTIC_EXPORTER_GRAPHITE_HOST"), getEnv("RESTIC_EXPORTER_GRAPHITE_PORT", "2003")),
+		prefix:   os.Getenv("RESTIC_EXPORTER_GRAPHITE_PREFIX"),
+		useTags:  os.Getenv("RESTIC_EXPORTER_GRAPHITE_TAGS") == "true",
+		interval: getEnvDuration("RESTIC_EXPORTER_GRAPHITE_INTERVAL", envSinkInterval),
+	}
+}
+
+func (s *graphiteSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+
+	b, err := graphite.NewBridge(&graphite.Config{
+		URL:      s.address,
+		Prefix:   s.prefix,
+		UseTags:  s.useTags,
+		Gatherer: withTargets(g),
+	})
+	if err != nil {
+		return err
+	}
+
+	return emitEvery(ctx, s.interval, b.Push)
+}
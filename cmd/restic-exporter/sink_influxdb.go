@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// influxDBSink periodically writes all samples, including the probes of all
+// targets, in InfluxDB line protocol. Each sample becomes a point of the
+// measurement named after it, with its labels as tags and a value field.
+// With a bucket, the InfluxDB v2 API is used, otherwise the v1 API.
+type influxDBSink struct {
+	url string
+
+	// v1
+	database, username, passwordFile string
+
+	// v2
+	org, bucket, tokenFile string
+}
+
+// influxDBSinkFromEnv configures an influxDBSink from
+// RESTIC_EXPORTER_INFLUXDB_*.
+func influxDBSinkFromEnv() (*influxDBSink, error) {
+
+	s := &influxDBSink{
+		url:          strings.TrimSuffix(getEnvNotEmpty("RESTIC_EXPORTER_INFLUXDB_URL"), "/"),
+		database:     os.Getenv("RESTIC_EXPORTER_INFLUXDB_DATABASE"),
+		username:     os.Getenv("RESTIC_EXPORTER_INFLUXDB_USERNAME"),
+		passwordFile: os.Getenv("RESTIC_EXPORTER_INFLUXDB_PASSWORD_FILE"),
+		org:          os.Getenv("RESTIC_EXPORTER_INFLUXDB_ORG"),
+		bucket:       os.Getenv("RESTIC_EXPORTER_INFLUXDB_BUCKET"),
+		tokenFile:    os.Getenv("RESTIC_EXPORTER_INFLUXDB_TOKEN_FILE"),
+	}
+
+	if s.database == "" && s.bucket == "" {
+		return nil, errors.New("influxdb sink requires RESTIC_EXPORTER_INFLUXDB_DATABASE (v1) or RESTIC_EXPORTER_INFLUXDB_BUCKET (v2)")
+	}
+	if s.database != "" && s.bucket != "" {
+		return nil, errors.New("RESTIC_EXPORTER_INFLUXDB_DATABASE and RESTIC_EXPORTER_INFLUXDB_BUCKET are mutually exclusive")
+	}
+
+	return s, nil
+}
+
+func (s *influxDBSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+	return emitEvery(ctx, envSinkInterval, func() error {
+
+		mfs, err := withTargets(g).Gather()
+		if err != nil {
+			return err
+		}
+		body := lineProtocol(jsonSamples(mfs), time.Now())
+
+		query := url.Values{"precision": {"ms"}}
+		path := "/write"
+		if s.bucket != "" {
+			path = "/api/v2/write"
+			query.Set("org", s.org)
+			query.Set("bucket", s.bucket)
+		} else {
+			query.Set("db", s.database)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+path+"?"+query.Encode(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+		// credentials are read on every write, so rotated ones are picked up
+		if s.tokenFile != "" {
+			token, err := readSecretFile(s.tokenFile)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		if s.username != "" {
+			password, err := readSecretFile(s.passwordFile)
+			if err != nil {
+				return err
+			}
+			req.SetBasicAuth(s.username, password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("influxdb: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		}
+
+		return nil
+	})
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// lineProtocol formats samples as InfluxDB line protocol points at now.
+// Tags with empty values are left out, as InfluxDB rejects them.
+func lineProtocol(samples []jsonSample, now time.Time) []byte {
+
+	var b bytes.Buffer
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+
+	for _, s := range samples {
+		b.WriteString(influxMeasurementEscaper.Replace(s.Name))
+		for _, name := range sortedKeys(s.Labels) {
+			if s.Labels[name] == "" {
+				continue
+			}
+			b.WriteByte(',')
+			b.WriteString(influxTagEscaper.Replace(name))
+			b.WriteByte('=')
+			b.WriteString(influxTagEscaper.Replace(s.Labels[name]))
+		}
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(ts)
+		b.WriteByte('\n')
+	}
+
+	return b.Bytes()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jsonSink periodically writes all samples, including the probes of all
+// targets, as a JSON array to path, or to standard output if path is "-".
+type jsonSink struct {
+	path string
+}
+
+type jsonSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+func (s jsonSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+	return emitEvery(ctx, envSinkInterval, func() error {
+
+		mfs, err := withTargets(g).Gather()
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(jsonSamples(mfs))
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		if s.path == "-" {
+			_, err := os.Stdout.Write(data)
+			return err
+		}
+
+		// write to a temporary file first so readers never see a partial file
+		tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+
+		return os.Rename(tmp.Name(), s.path)
+	})
+}
+
+// jsonSamples flattens metric families into samples. Summaries and
+// histograms are reduced to their _sum and _count.
+func jsonSamples(mfs []*dto.MetricFamily) []jsonSample {
+
+	samples := []jsonSample{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			add := func(suffix string, v float64) {
+				samples = append(samples, jsonSample{Name: mf.GetName() + suffix, Labels: labels, Value: v})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				add("_sum", m.GetSummary().GetSampleSum())
+				add("_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				add("_sum", m.GetHistogram().GetSampleSum())
+				add("_count", float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+
+	return samples
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpStartTime is the start of the cumulative counters, histograms and
+// summaries sent with OTLP.
+var otlpStartTime = time.Now()
+
+// otlpSink periodically sends all metrics, including the probes of all
+// targets, to an OpenTelemetry collector. Metrics with a repository label are
+// sent with the repository as resource attribute instead.
+type otlpSink struct {
+	client *otlpClient
+}
+
+func (s *otlpSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+	return emitEvery(ctx, envSinkInterval, func() error {
+
+		mfs, err := withTargets(g).Gather()
+		if err != nil {
+			return err
+		}
+
+		return s.client.export(ctx, "metrics", otlpMetricsRequest(mfs, time.Now()))
+	})
+}
+
+// otlpMetricsRequest encodes mfs as an ExportMetricsServiceRequest message,
+// with one ResourceMetrics per repository.
+func otlpMetricsRequest(mfs []*dto.MetricFamily, now time.Time) []byte {
+
+	// metrics by repository, "" for those of the exporter itself
+	byRepo := map[string][]byte{}
+	for _, mf := range mfs {
+
+		points := map[string][]*dto.Metric{}
+		for _, m := range mf.GetMetric() {
+			var repo string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "repository" {
+					repo = l.GetValue()
+				}
+			}
+			points[repo] = append(points[repo], m)
+		}
+
+		for repo, ms := range points {
+			var metric []byte
+			metric = protoString(metric, 1, mf.GetName())
+			metric = protoString(metric, 2, mf.GetHelp())
+			metric = otlpData(metric, mf.GetType(), ms, now)
+			byRepo[repo] = protoMessage(byRepo[repo], 2, metric)
+		}
+	}
+
+	var req []byte
+	for repo, metrics := range byRepo {
+		var extra map[string]string
+		if repo != "" {
+			extra = map[string]string{"restic.repository": repo}
+		}
+
+		scopeMetrics := protoMessage(nil, 1, otlpScope())
+		scopeMetrics = append(scopeMetrics, metrics...)
+
+		var rm []byte
+		rm = protoMessage(rm, 1, otlpResource(extra))
+		rm = protoMessage(rm, 2, scopeMetrics)
+
+		req = protoMessage(req, 1, rm)
+	}
+
+	return req
+}
+
+// otlpData appends the data field of a Metric message holding ms, of the
+// Prometheus type typ, to b.
+func otlpData(b []byte, typ dto.MetricType, ms []*dto.Metric, now time.Time) []byte {
+
+	const cumulative = 2
+
+	var data []byte
+	for _, m := range ms {
+
+		var p []byte
+		start, ts := uint64(otlpStartTime.UnixNano()), uint64(now.UnixNano())
+		if m.TimestampMs != nil {
+			ts = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+		}
+
+		switch typ {
+		case dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			// NumberDataPoint
+			v := m.GetGauge().GetValue()
+			if typ == dto.MetricType_COUNTER {
+				v = m.GetCounter().GetValue()
+				p = protoFixed64(p, 2, start)
+			} else if typ == dto.MetricType_UNTYPED {
+				v = m.GetUntyped().GetValue()
+			}
+			p = protoFixed64(p, 3, ts)
+			p = protoFixed64(p, 4, math.Float64bits(v))
+			p = otlpAttributes(p, 7, otlpLabels(m))
+
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			// HistogramDataPoint, with bucket counts that aren't cumulative
+			h := m.GetHistogram()
+			p = protoFixed64(p, 2, start)
+			p = protoFixed64(p, 3, ts)
+			p = protoFixed64(p, 4, h.GetSampleCount())
+			p = protoFixed64(p, 5, math.Float64bits(h.GetSampleSum()))
+
+			var counts, bounds []byte
+			var prev uint64
+			for _, bucket := range h.GetBucket() {
+				if math.IsInf(bucket.GetUpperBound(), 1) {
+					continue
+				}
+				counts = protowire.AppendFixed64(counts, bucket.GetCumulativeCount()-prev)
+				bounds = protowire.AppendFixed64(bounds, math.Float64bits(bucket.GetUpperBound()))
+				prev = bucket.GetCumulativeCount()
+			}
+			counts = protowire.AppendFixed64(counts, h.GetSampleCount()-prev)
+			p = protoMessage(p, 6, counts)
+			p = protoMessage(p, 7, bounds)
+			p = otlpAttributes(p, 9, otlpLabels(m))
+
+		case dto.MetricType_SUMMARY:
+			// SummaryDataPoint
+			s := m.GetSummary()
+			p = protoFixed64(p, 2, start)
+			p = protoFixed64(p, 3, ts)
+			p = protoFixed64(p, 4, s.GetSampleCount())
+			p = protoFixed64(p, 5, math.Float64bits(s.GetSampleSum()))
+			for _, q := range s.GetQuantile() {
+				var vq []byte
+				vq = protoFixed64(vq, 1, math.Float64bits(q.GetQuantile()))
+				vq = protoFixed64(vq, 2, math.Float64bits(q.GetValue()))
+				p = protoMessage(p, 6, vq)
+			}
+			p = otlpAttributes(p, 7, otlpLabels(m))
+		}
+
+		data = protoMessage(data, 1, p)
+	}
+
+	switch typ {
+	case dto.MetricType_COUNTER:
+		// Sum
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, cumulative)
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+		return protoMessage(b, 7, data)
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, cumulative)
+		return protoMessage(b, 9, data)
+	case dto.MetricType_SUMMARY:
+		return protoMessage(b, 11, data)
+	default:
+		// Gauge
+		return protoMessage(b, 5, data)
+	}
+}
+
+// otlpLabels returns the labels of m other than repository, which is a
+// resource attribute.
+func otlpLabels(m *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		if l.GetName() != "repository" {
+			labels[l.GetName()] = l.GetValue()
+		}
+	}
+	return labels
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushgatewaySink periodically pushes all metrics, including the probes of
+// all targets, to a Pushgateway, replacing the metrics of its group.
+type pushgatewaySink struct {
+	url      string
+	job      string
+	grouping map[string]string
+
+	username, passwordFile string
+	bearerTokenFile        string
+}
+
+// pushgatewaySinkFromEnv configures a pushgatewaySink from
+// RESTIC_EXPORTER_PUSHGATEWAY_*. Metrics are grouped by the hostname as
+// instance, unless other grouping labels are set.
+func pushgatewaySinkFromEnv() (*pushgatewaySink, error) {
+
+	s := &pushgatewaySink{
+		url:             getEnvNotEmpty("RESTIC_EXPORTER_PUSHGATEWAY_URL"),
+		job:             getEnv("RESTIC_EXPORTER_PUSHGATEWAY_JOB", "restic_exporter"),
+		grouping:        map[string]string{},
+		username:        os.Getenv("RESTIC_EXPORTER_PUSHGATEWAY_USERNAME"),
+		passwordFile:    os.Getenv("RESTIC_EXPORTER_PUSHGATEWAY_PASSWORD_FILE"),
+		bearerTokenFile: os.Getenv("RESTIC_EXPORTER_PUSHGATEWAY_BEARER_TOKEN_FILE"),
+	}
+
+	if grouping := os.Getenv("RESTIC_EXPORTER_PUSHGATEWAY_GROUPING"); grouping != "" {
+		for _, pair := range strings.Split(grouping, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || name == "" || value == "" {
+				return nil, fmt.Errorf("RESTIC_EXPORTER_PUSHGATEWAY_GROUPING: invalid label %q, want name=value", pair)
+			}
+			s.grouping[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	} else {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		s.grouping["instance"] = hostname
+	}
+
+	if s.username != "" && s.bearerTokenFile != "" {
+		return nil, errors.New("RESTIC_EXPORTER_PUSHGATEWAY_USERNAME and RESTIC_EXPORTER_PUSHGATEWAY_BEARER_TOKEN_FILE are mutually exclusive")
+	}
+
+	return s, nil
+}
+
+func (s *pushgatewaySink) Run(ctx context.Context, g prometheus.Gatherer) error {
+	return emitEvery(ctx, envSinkInterval, func() error {
+
+		p := push.New(s.url, s.job).Gatherer(withTargets(g))
+		for name, value := range s.grouping {
+			p = p.Grouping(name, value)
+		}
+
+		// credentials are read on every push, so rotated ones are picked up
+		if s.username != "" {
+			password, err := readSecretFile(s.passwordFile)
+			if err != nil {
+				return err
+			}
+			p = p.BasicAuth(s.username, password)
+		}
+		if s.bearerTokenFile != "" {
+			token, err := readSecretFile(s.bearerTokenFile)
+			if err != nil {
+				return err
+			}
+			p = p.Header(http.Header{"Authorization": {"Bearer " + token}})
+		}
+
+		return p.PushContext(ctx)
+	})
+}
+
+// readSecretFile returns the contents of path without surrounding
+// whitespace, or "" if path is empty.
+func readSecretFile(path string) (string, error) {
+
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	config_util "github.com/prometheus/common/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSink periodically sends all samples, including the probes of
+// all targets, to a Prometheus remote_write endpoint. The samples get job
+// and instance labels, as a scrape would add them.
+type remoteWriteSink struct {
+	url      string
+	client   *http.Client
+	job      string
+	instance string
+
+	// sent are the labels of the series of the last successful request by
+	// their key, so that vanished series can be marked stale.
+	sent map[string]map[string]string
+}
+
+// staleNaN is the value of Prometheus staleness markers, ending a series
+// before the lookback period does.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// remoteWriteSinkFromEnv configures a remoteWriteSink from
+// RESTIC_EXPORTER_REMOTE_WRITE_*.
+func remoteWriteSinkFromEnv() (*remoteWriteSink, error) {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config_util.HTTPClientConfig
+	if username := os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_USERNAME"); username != "" {
+		cfg.BasicAuth = &config_util.BasicAuth{
+			Username:     username,
+			PasswordFile: os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_PASSWORD_FILE"),
+		}
+	}
+	if tokenFile := os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_BEARER_TOKEN_FILE"); tokenFile != "" {
+		cfg.Authorization = &config_util.Authorization{CredentialsFile: tokenFile}
+	}
+	cfg.TLSConfig = config_util.TLSConfig{
+		CAFile:             os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_CA_FILE"),
+		CertFile:           os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_CERT_FILE"),
+		KeyFile:            os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_KEY_FILE"),
+		InsecureSkipVerify: os.Getenv("RESTIC_EXPORTER_REMOTE_WRITE_INSECURE_SKIP_VERIFY") == "true",
+	}
+	// Validate fills in the default authorization type
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("remote_write: %w", err)
+	}
+
+	client, err := config_util.NewClientFromConfig(cfg, "remote_write")
+	if err != nil {
+		return nil, fmt.Errorf("remote_write: %w", err)
+	}
+
+	return &remoteWriteSink{
+		url:      getEnvNotEmpty("RESTIC_EXPORTER_REMOTE_WRITE_URL"),
+		client:   client,
+		job:      getEnv("RESTIC_EXPORTER_REMOTE_WRITE_JOB", "restic_exporter"),
+		instance: getEnv("RESTIC_EXPORTER_REMOTE_WRITE_INSTANCE", hostname),
+	}, nil
+}
+
+func (s *remoteWriteSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+	return emitEvery(ctx, envSinkInterval, func() error {
+
+		mfs, err := withTargets(g).Gather()
+		if err != nil {
+			return err
+		}
+
+		data, sent := s.writeRequest(mfs, time.Now())
+		body := snappy.Encode(nil, data)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("remote_write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		}
+		s.sent = sent
+
+		return nil
+	})
+}
+
+// writeRequest encodes mfs as a remote_write WriteRequest protobuf message.
+// Samples without a timestamp of their own are timestamped with now.
+// Summaries and histograms are split into series as in the text format.
+// Series sent last time but missing from mfs, e.g. of snapshot groups that
+// vanished, get a staleness marker. The series in the request are returned
+// by key.
+func (s *remoteWriteSink) writeRequest(mfs []*dto.MetricFamily, now time.Time) ([]byte, map[string]map[string]string) {
+
+	var req []byte
+	sent := map[string]map[string]string{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+
+			ts := now.UnixMilli()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+
+			labels := map[string]string{"job": s.job, "instance": s.instance}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			add := func(suffix string, v float64, extra ...string) {
+				series := map[string]string{"__name__": mf.GetName() + suffix}
+				for name, value := range labels {
+					series[name] = value
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					series[extra[i]] = extra[i+1]
+				}
+				sent[seriesKey(series)] = series
+				req = protowire.AppendTag(req, 1, protowire.BytesType)
+				req = protowire.AppendBytes(req, timeSeries(series, v, ts))
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", m.GetSummary().GetSampleSum())
+				add("_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				for _, b := range m.GetHistogram().GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+				add("_sum", m.GetHistogram().GetSampleSum())
+				add("_count", float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+
+	for key, series := range s.sent {
+		if _, ok := sent[key]; !ok {
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, timeSeries(series, staleNaN, now.UnixMilli()))
+		}
+	}
+
+	return req, sent
+}
+
+// seriesKey identifies a series by its labels.
+func seriesKey(labels map[string]string) string {
+
+	var key strings.Builder
+	for _, name := range sortedKeys(labels) {
+		key.WriteString(name)
+		key.WriteByte(0xff)
+		key.WriteString(labels[name])
+		key.WriteByte(0xff)
+	}
+
+	return key.String()
+}
+
+// timeSeries encodes a TimeSeries message holding a single sample. Labels
+// are sorted by name, as remote_write requires.
+func timeSeries(labels map[string]string, v float64, ts int64) []byte {
+
+	var b []byte
+	for _, name := range sortedKeys(labels) {
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.BytesType)
+		l = protowire.AppendString(l, name)
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, labels[name])
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, l)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(v))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, sample)
+
+	return b
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
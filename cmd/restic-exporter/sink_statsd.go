@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMaxPacket keeps packets below the usual MTU, so they aren't
+// fragmented.
+const statsdMaxPacket = 1432
+
+// statsdSink probes all targets every interval and sends the key results as
+// StatsD metrics over UDP. With tags enabled, labels are sent in the
+// DogStatsD format.
+type statsdSink struct {
+	address string
+	prefix  string
+	tags    bool
+}
+
+// statsdSinkFromEnv configures a statsdSink from RESTIC_EXPORTER_STATSD_*.
+func statsdSinkFromEnv() *statsdSink {
+	return &statsdSink{
+		address: getEnv("RESTIC_EXPORTER_STATSD_ADDRESS", "127.0.0.1:8125"),
+		prefix:  getEnv("RESTIC_EXPORTER_STATSD_PREFIX", "restic."),
+		tags:    os.Getenv("RESTIC_EXPORTER_STATSD_TAGS") != "false",
+	}
+}
+
+func (s *statsdSink) Run(ctx context.Context, _ prometheus.Gatherer) error {
+	return emitEvery(ctx, envSinkInterval, func() error {
+
+		mfs, err := targetsGatherer{}.Gather()
+		if err != nil {
+			return err
+		}
+
+		conn, err := net.Dial("udp", s.address)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		var packet bytes.Buffer
+		for _, line := range s.lines(mfs, time.Now()) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+				if _, err := conn.Write(packet.Bytes()); err != nil {
+					return err
+				}
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+		if packet.Len() > 0 {
+			_, err = conn.Write(packet.Bytes())
+		}
+
+		return err
+	})
+}
+
+// lines converts the probe results in mfs to StatsD lines: the age of the
+// latest snapshot, its size and number of files, and whether the probe
+// succeeded.
+func (s *statsdSink) lines(mfs []*dto.MetricFamily, now time.Time) []string {
+
+	var lines []string
+	add := func(name string, v float64, typ string, m *dto.Metric, extra ...string) {
+		line := s.prefix + name + ":" + strconv.FormatFloat(v, 'f', -1, 64) + "|" + typ
+		if s.tags {
+			tags := extra
+			for _, l := range m.GetLabel() {
+				if l.GetValue() != "" {
+					tags = append(tags, statsdTag(l.GetName())+":"+statsdTag(l.GetValue()))
+				}
+			}
+			if len(tags) > 0 {
+				line += "|#" + strings.Join(tags, ",")
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			v := m.GetGauge().GetValue()
+			switch mf.GetName() {
+			case "restic_snapshots_latest_time":
+				add("snapshot.age_seconds", now.Sub(time.Unix(int64(v), 0)).Seconds(), "g", m)
+			case "restic_stats_latest_total_size":
+				add("snapshot.total_size_bytes", v, "g", m)
+			case "restic_stats_latest_total_nfiles":
+				add("snapshot.total_files", v, "g", m)
+			case "restic_scrape_error":
+				result := "success"
+				if v > 0 {
+					result = "failure"
+				}
+				add("probe.success", 1-v, "g", m)
+				add("probe.count", 1, "c", m, "result:"+result)
+			}
+		}
+	}
+
+	return lines
+}
+
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdTag replaces the characters separating DogStatsD tags.
+func statsdTag(s string) string {
+	return statsdTagEscaper.Replace(s)
+}
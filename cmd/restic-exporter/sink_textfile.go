@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// textfileSink periodically writes all metrics to restic_exporter.prom in
+// dir, for node_exporter's textfile collector to pick up.
+type textfileSink struct {
+	dir string
+}
+
+func (s textfileSink) Run(ctx context.Context, g prometheus.Gatherer) error {
+
+	path := filepath.Join(s.dir, "restic_exporter.prom")
+	inner := withTargets(g)
+	g = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := inner.Gather()
+
+		// node_exporter exports its own runtime metrics, the exporter's would
+		// collide with them
+		n := 0
+		for _, mf := range mfs {
+			if !strings.HasPrefix(mf.GetName(), "go_") && !strings.HasPrefix(mf.GetName(), "process_") {
+				mfs[n] = mf
+				n++
+			}
+		}
+
+		return mfs[:n], err
+	})
+
+	return emitEvery(ctx, envSinkInterval, func() error {
+		// WriteToTextfile renames a temporary file, node_exporter never
+		// reads a partial file
+		return prometheus.WriteToTextfile(path, g)
+	})
+}
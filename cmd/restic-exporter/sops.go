@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envSopsBin is the sops binary used to decrypt encrypted configuration
+// files. sops finds the keys itself, e.g. SOPS_AGE_KEY_FILE for age or the
+// AWS credentials for KMS.
+var envSopsBin = getEnv("RESTIC_EXPORTER_SOPS_BIN", "sops")
+
+// sopsEncrypted reports whether data is a YAML document encrypted by sops,
+// which adds its metadata in a top-level sops key.
+func sopsEncrypted(data []byte) bool {
+
+	var doc struct {
+		Sops map[string]interface{} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+
+	return doc.Sops["mac"] != nil
+}
+
+// sopsDecrypt returns the decrypted contents of the sops encrypted YAML file
+// at path. The plain text is never written to disk.
+func sopsDecrypt(path string) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var stdOut, stdErr bytes.Buffer
+	cmd := exec.CommandContext(ctx, envSopsBin, "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path)
+	cmd.Stdout = &stdOut
+	cmd.Stderr = &stdErr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sops: %w: %s", err, strings.TrimSpace(stdErr.String()))
+	}
+
+	return stdOut.Bytes(), nil
+}
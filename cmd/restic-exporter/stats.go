@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	repositoryStatsSizeDesc = prometheus.NewDesc(
+		"restic_repository_stats_total_size_bytes",
+		"Total size of all snapshots as reported by restic stats in the given mode",
+		[]string{"repository", "mode"}, nil,
+	)
+	repositoryRestoreSizeDesc = prometheus.NewDesc(
+		"restic_repository_restore_size_bytes",
+		"Size of all snapshots when restored",
+		[]string{"repository"}, nil,
+	)
+	repositoryRawSizeDesc = prometheus.NewDesc(
+		"restic_repository_raw_size_bytes",
+		"Size of the data stored for all snapshots in the repository",
+		[]string{"repository"}, nil,
+	)
+	repositoryStatsFilesDesc = prometheus.NewDesc(
+		"restic_repository_stats_total_files",
+		"Number of files in all snapshots",
+		[]string{"repository"}, nil,
+	)
+	repositoryStatsDedupRatioDesc = prometheus.NewDesc(
+		"restic_stats_dedup_ratio",
+		"Ratio of the restore size of all snapshots to the uncompressed size of the repository data",
+		[]string{"repository"}, nil,
+	)
+	repositoryStatsCompressionRatioDesc = prometheus.NewDesc(
+		"restic_repository_stats_compression_ratio",
+		"Ratio of the uncompressed to the stored size of the repository data",
+		[]string{"repository"}, nil,
+	)
+)
+
+// envRepositoryStats enables exporting `restic stats` of whole repositories
+// on /metrics. It reads all snapshots, which takes long for large
+// repositories, so results are cached for RESTIC_EXPORTER_STATS_CACHE_TTL.
+var (
+	envRepositoryStats = os.Getenv("RESTIC_EXPORTER_REPOSITORY_STATS") == "true"
+	envStatsCacheTTL   = getEnvDuration("RESTIC_EXPORTER_STATS_CACHE_TTL", 5*time.Minute)
+)
+
+// statsModes are the modes of `restic stats`.
+var statsModes = []string{"restore-size", "files-by-contents", "blobs-per-file", "raw-data"}
+
+// resticRepoStatsData is the output of `restic stats --json`. Which fields
+// are set depends on the mode.
+type resticRepoStatsData struct {
+	TotalSize              int64   `json:"total_size"`
+	TotalFileCount         int64   `json:"total_file_count,omitempty"`
+	TotalBlobCount         int64   `json:"total_blob_count,omitempty"`
+	SnapshotsCount         int64   `json:"snapshots_count"`
+	TotalUncompressedSize  int64   `json:"total_uncompressed_size,omitempty"`
+	CompressionRatio       float64 `json:"compression_ratio,omitempty"`
+	CompressionProgress    float64 `json:"compression_progress,omitempty"`
+	CompressionSpaceSaving float64 `json:"compression_space_saving,omitempty"`
+}
+
+// cachedStats are the stats of a repository in one mode, and when they were
+// collected.
+type cachedStats struct {
+	mu          sync.Mutex
+	stats       *resticRepoStatsData
+	collectedAt time.Time
+}
+
+var (
+	statsCacheMu sync.Mutex
+	// statsCache holds stats by repository name, location and mode, so they
+	// survive configuration reloads.
+	statsCache = map[[3]string]*cachedStats{}
+)
+
+// repositoryStats returns the stats of repo in mode, running restic only if
+// the cached ones are older than RESTIC_EXPORTER_STATS_CACHE_TTL. Concurrent
+// callers wait for a single restic invocation.
+func repositoryStats(ctx context.Context, repo *repository, mode string) (*resticRepoStatsData, time.Time, error) {
+
+	key := [3]string{repo.Name, repo.Repository, mode}
+
+	statsCacheMu.Lock()
+	c, ok := statsCache[key]
+	if !ok {
+		c = &cachedStats{}
+		statsCache[key] = c
+	}
+	statsCacheMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats != nil && time.Since(c.collectedAt) < envStatsCacheTTL {
+		return c.stats, c.collectedAt, nil
+	}
+
+	var stats resticRepoStatsData
+	if err := unmarshallFromRestic(ctx, repo, &stats, "stats", "--mode", mode, "--json"); err != nil {
+		return nil, time.Time{}, err
+	}
+	c.stats, c.collectedAt = &stats, time.Now()
+	if mode == "raw-data" {
+		recordRawSize(repo, stats.TotalSize, c.collectedAt)
+	}
+
+	return c.stats, c.collectedAt, nil
+}
+
+// cachedRepositoryStats returns the cached stats of repo in mode without
+// running restic. ok is false if there are none, or if they are being
+// collected right now.
+func cachedRepositoryStats(repo *repository, mode string) (stats *resticRepoStatsData, collectedAt time.Time, ok bool) {
+
+	statsCacheMu.Lock()
+	c, ok := statsCache[[3]string{repo.Name, repo.Repository, mode}]
+	statsCacheMu.Unlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	if !c.mu.TryLock() {
+		return nil, time.Time{}, false
+	}
+	defer c.mu.Unlock()
+
+	return c.stats, c.collectedAt, c.stats != nil
+}
+
+// collectStats exports the restore size, raw size, file count,
+// deduplication and compression ratio, and growth rates of repo. The sizes are exported both
+// as metrics of their own and, for compatibility, labelled with the mode.
+func collectStats(ctx context.Context, repo *repository, ch chan<- prometheus.Metric) error {
+
+	restore, _, err := repositoryStats(ctx, repo, "restore-size")
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(repositoryStatsSizeDesc, prometheus.GaugeValue, float64(restore.TotalSize), repo.Name, "restore-size")
+	ch <- prometheus.MustNewConstMetric(repositoryRestoreSizeDesc, prometheus.GaugeValue, float64(restore.TotalSize), repo.Name)
+	ch <- prometheus.MustNewConstMetric(repositoryStatsFilesDesc, prometheus.GaugeValue, float64(restore.TotalFileCount), repo.Name)
+
+	raw, _, err := repositoryStats(ctx, repo, "raw-data")
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(repositoryStatsSizeDesc, prometheus.GaugeValue, float64(raw.TotalSize), repo.Name, "raw-data")
+	ch <- prometheus.MustNewConstMetric(repositoryRawSizeDesc, prometheus.GaugeValue, float64(raw.TotalSize), repo.Name)
+	// compression is left out, it has a ratio of its own
+	uncompressed := raw.TotalUncompressedSize
+	if uncompressed == 0 {
+		uncompressed = raw.TotalSize
+	}
+	if uncompressed > 0 {
+		ch <- prometheus.MustNewConstMetric(repositoryStatsDedupRatioDesc, prometheus.GaugeValue, float64(restore.TotalSize)/float64(uncompressed), repo.Name)
+	}
+	if raw.CompressionRatio > 0 {
+		ch <- prometheus.MustNewConstMetric(repositoryStatsCompressionRatioDesc, prometheus.GaugeValue, raw.CompressionRatio, repo.Name)
+	}
+	collectGrowth(repo, ch)
+
+	return nil
+}
+
+type apiStatsResponse struct {
+	Repository  string    `json:"repository"`
+	Mode        string    `json:"mode"`
+	CollectedAt time.Time `json:"collected_at"`
+	*resticRepoStatsData
+}
+
+// statsHandler serves the stats of a repository as JSON, from the same cache
+// as the metrics.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "restore-size"
+	}
+	if !slices.Contains(statsModes, mode) {
+		writeAPIError(w, http.StatusBadRequest, "invalid parameter: unknown mode "+mode)
+		return
+	}
+
+	repo := currentConfig.Load().repository(r.URL.Query().Get("repo"))
+	if repo == nil {
+		writeAPIError(w, http.StatusNotFound, "unknown repository")
+		return
+	}
+
+	stats, collectedAt, err := repositoryStats(r.Context(), repo, mode)
+	if err != nil {
+		writeResticError(w, repo, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiStatsResponse{Repository: repo.Name, Mode: mode, CollectedAt: collectedAt, resticRepoStatsData: stats})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"restic-exporter/pkg/collector"
+)
+
+// repositoryStatus describes the outcome of the latest restic invocations
+// against a repository.
+type repositoryStatus struct {
+	LastRun     time.Time
+	LastSuccess time.Time
+	LastError   string
+
+	// LastRestoreTest is zero if no restore test ran yet.
+	LastRestoreTest  time.Time
+	RestoreTestError string
+
+	// LastCheck is zero if `restic check` never ran as maintenance.
+	LastCheck  time.Time
+	CheckError string
+}
+
+// hostStatus is the outcome of the latest probe of a host in a repository.
+type hostStatus struct {
+	Repository string
+	Host       string
+	LastProbe  time.Time
+	LastError  string
+
+	// Latest is the time of the latest snapshot, zero if none was found.
+	Latest time.Time
+	Size   int64
+	Files  int64
+}
+
+var (
+	statusesMu sync.Mutex
+	statuses   = map[string]*repositoryStatus{}
+	// hostStatuses are keyed by repository and host.
+	hostStatuses = map[[2]string]*hostStatus{}
+)
+
+// recordStatus updates the status of repository after running restic
+// against it.
+func recordStatus(repository string, err error) {
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	s, ok := statuses[repository]
+	if !ok {
+		s = &repositoryStatus{}
+		statuses[repository] = s
+	}
+
+	s.LastRun = time.Now()
+	if err != nil {
+		s.LastError = err.Error()
+	} else {
+		s.LastSuccess = s.LastRun
+		s.LastError = ""
+	}
+}
+
+// recordRestoreTest updates the status of repository after a restore test.
+func recordRestoreTest(repository string, start time.Time, err error) {
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	s, ok := statuses[repository]
+	if !ok {
+		s = &repositoryStatus{}
+		statuses[repository] = s
+	}
+
+	s.LastRestoreTest = start
+	s.RestoreTestError = ""
+	if err != nil {
+		s.RestoreTestError = err.Error()
+	}
+}
+
+// recordCheck updates the status of repository after `restic check`.
+func recordCheck(repository string, finished time.Time, err error) {
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	s, ok := statuses[repository]
+	if !ok {
+		s = &repositoryStatus{}
+		statuses[repository] = s
+	}
+
+	s.LastCheck = finished
+	s.CheckError = ""
+	if err != nil {
+		s.CheckError = err.Error()
+	}
+}
+
+// recordProbe updates the status of host in repository after probing it.
+// rd is ignored if err is set.
+func recordProbe(repository, host string, rd *collector.Result, err error) {
+
+	if err == nil {
+		recordProbeHistory(repository, rd)
+	}
+	recordOnceError(err)
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	s := &hostStatus{Repository: repository, Host: host, LastProbe: time.Now()}
+	if old, ok := hostStatuses[[2]string{repository, host}]; ok {
+		*s = *old
+		s.LastProbe = time.Now()
+	}
+
+	if err != nil {
+		s.LastError = err.Error()
+	} else {
+		s.LastError = ""
+		s.Latest, s.Size, s.Files = time.Time{}, 0, 0
+		if len(rd.Snapshots) != 0 {
+			s.Latest = rd.Snapshots[0].Time
+			s.Size = int64(rd.Stats.TotalSize)
+			s.Files = int64(rd.Stats.TotalFileCount)
+		}
+	}
+	hostStatuses[[2]string{repository, host}] = s
+}
+
+// hostStatusesOf returns the status of all probed hosts of repository,
+// sorted by host.
+func hostStatusesOf(repository string) []hostStatus {
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	var hosts []hostStatus
+	for key, s := range hostStatuses {
+		if key[0] == repository {
+			hosts = append(hosts, *s)
+		}
+	}
+	slices.SortFunc(hosts, func(a, b hostStatus) int { return strings.Compare(a.Host, b.Host) })
+
+	return hosts
+}
+
+// statusOf returns the status of repository. It is zero if restic never ran
+// against it.
+func statusOf(repository string) repositoryStatus {
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	if s, ok := statuses[repository]; ok {
+		return *s
+	}
+	return repositoryStatus{}
+}
+
+// configuredRepositories returns the names of all repositories in the
+// current configuration.
+func configuredRepositories() []string {
+
+	var names []string
+	for _, repo := range currentConfig.Load().Repositories {
+		names = append(names, repo.Name)
+	}
+
+	return names
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"restic-exporter/pkg/collector"
+)
+
+// envCollectTargets enables collecting the probes of all targets on
+// /metrics, so that Prometheus does not need to send probes.
+var envCollectTargets = getEnv("RESTIC_EXPORTER_COLLECT_TARGETS", "false") == "true"
+
+// targetsGatherer probes the targets of all repositories. Sinks pushing
+// metrics include it, as nobody sends them probes.
+type targetsGatherer struct{}
+
+func (targetsGatherer) Gather() ([]*dto.MetricFamily, error) {
+
+	var gatherers prometheus.Gatherers
+	for _, repo := range currentConfig.Load().Repositories {
+		for _, target := range repo.targets() {
+			// failures are reported in restic_scrape_error
+			registry, _ := probe(context.Background(), repo, target.Host, "", target.Tags, prometheus.Labels{"repository": repo.Name, "target": target.Host})
+			gatherers = append(gatherers, registry)
+		}
+	}
+
+	return gatherers.Gather()
+}
+
+// withTargets returns g extended by the probes of all targets, unless g
+// collects them already, with the labels of the configuration applied.
+func withTargets(g prometheus.Gatherer) prometheus.Gatherer {
+	if envCollectTargets {
+		return withLabels(g)
+	}
+	return withLabels(prometheus.Gatherers{g, targetsGatherer{}})
+}
+
+// targetsCollector collects the probes of the targets of a repository. One
+// is registered per repository with envCollectTargets, so that the
+// repositories are probed in parallel.
+type targetsCollector struct {
+	repo           *repository
+	snapshotLabels []string
+	infoLabels     []string
+	splitPaths     bool
+
+	latestTime  *prometheus.Desc
+	latestInfo  *prometheus.Desc
+	totalFiles  *prometheus.Desc
+	totalSize   *prometheus.Desc
+	scrapeError *prometheus.Desc
+	freshness   *freshnessDescs
+}
+
+func newTargetsCollector(repo *repository, metrics *metricsConfig) *targetsCollector {
+
+	constLabels := prometheus.Labels{"repository": repo.Name}
+	snapshotLabels := append([]string{"target"}, metrics.snapshotLabels()...)
+
+	return &targetsCollector{
+		repo:           repo,
+		snapshotLabels: metrics.snapshotLabels(),
+		infoLabels:     collector.InfoLabels(metrics.snapshotLabels()),
+		splitPaths:     metrics.SplitPaths,
+		latestTime:     prometheus.NewDesc("restic_snapshots_latest_time", "Time of the latest snapshot", snapshotLabels, constLabels),
+		latestInfo:     prometheus.NewDesc("restic_snapshots_latest_info", "Latest snapshot, labelled with its short ID", append([]string{"target"}, collector.InfoLabels(metrics.snapshotLabels())...), constLabels),
+		totalFiles:     prometheus.NewDesc("restic_stats_latest_total_nfiles", "Number of files", snapshotLabels, constLabels),
+		totalSize:      prometheus.NewDesc("restic_stats_latest_total_size", "Total Size", snapshotLabels, constLabels),
+		scrapeError:    prometheus.NewDesc("restic_scrape_error", "Whether running restic for the probe failed", []string{"target"}, constLabels),
+		freshness:      newFreshnessDescs([]string{"target", "hostname"}, constLabels),
+	}
+}
+
+func (c *targetsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.latestTime
+	ch <- c.latestInfo
+	ch <- c.totalFiles
+	ch <- c.totalSize
+	ch <- c.scrapeError
+	c.freshness.describe(ch)
+}
+
+func (c *targetsCollector) Collect(ch chan<- prometheus.Metric) {
+
+	// targets probed with the same tags share a restic call
+	var (
+		tagSets []string
+		byTags  = map[string][]string{}
+	)
+	for _, target := range c.repo.targets() {
+		tags := strings.Join(target.Tags, ",")
+		if _, ok := byTags[tags]; !ok {
+			tagSets = append(tagSets, tags)
+		}
+		byTags[tags] = append(byTags[tags], target.Host)
+	}
+
+	for _, tags := range tagSets {
+		var tagList []string
+		if tags != "" {
+			tagList = strings.Split(tags, ",")
+		}
+
+		// failures are reported in restic_scrape_error
+		results, _ := probeTargets(context.Background(), c.repo, byTags[tags], "", tagList)
+		for _, res := range results {
+			ch <- prometheus.MustNewConstMetric(c.scrapeError, prometheus.GaugeValue, boolToFloat(res.Err != nil), res.Host)
+			if res.Err != nil {
+				continue
+			}
+
+			if f, ok := freshnessOf(c.repo, res.Host, latestSnapshotTime(&res.Result)); ok {
+				c.freshness.collect(ch, f, res.Host, res.Host)
+			}
+
+			if len(res.Result.Snapshots) == 0 {
+				continue
+			}
+
+			s := res.Result.Snapshots[0]
+			for _, values := range collector.SnapshotSeries(s, c.snapshotLabels, c.splitPaths) {
+				labels := append([]string{res.Host}, values...)
+				ch <- prometheus.MustNewConstMetric(c.latestTime, prometheus.GaugeValue, float64(s.Time.Unix()), labels...)
+				ch <- prometheus.MustNewConstMetric(c.totalFiles, prometheus.GaugeValue, float64(res.Result.Stats.TotalFileCount), labels...)
+				ch <- prometheus.MustNewConstMetric(c.totalSize, prometheus.GaugeValue, float64(res.Result.Stats.TotalSize), labels...)
+			}
+			for _, values := range collector.SnapshotSeries(s, c.infoLabels, c.splitPaths) {
+				ch <- prometheus.MustNewConstMetric(c.latestInfo, prometheus.GaugeValue, 1, append([]string{res.Host}, values...)...)
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxPendingSpans limits the spans kept while the collector is unreachable.
+const maxPendingSpans = 4096
+
+// tracer exports the spans of probes with OTLP. It is nil unless
+// RESTIC_EXPORTER_TRACING is true, and then no spans are recorded.
+var tracer *spanExporter
+
+// setupTracing enables tracing if RESTIC_EXPORTER_TRACING is true.
+func setupTracing() error {
+
+	if os.Getenv("RESTIC_EXPORTER_TRACING") != "true" {
+		return nil
+	}
+
+	client, err := otlpClientFromEnv()
+	if err != nil {
+		return err
+	}
+	tracer = &spanExporter{client: client}
+	go tracer.run()
+
+	return nil
+}
+
+// A span is a timed operation of a trace, e.g. a probe or a restic
+// invocation of it.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	err      error
+}
+
+// Span kinds as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type spanKey struct{}
+
+// startSpan starts a span named name as child of the span in ctx. Without
+// a span in ctx, a new trace is started if root is set, otherwise nothing
+// is recorded. The returned span is nil if tracing is disabled.
+func startSpan(ctx context.Context, name string, kind int, root bool) (context.Context, *span) {
+
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if !root {
+		return ctx, nil
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// contextWithTraceparent returns ctx with the remote parent span of a W3C
+// traceparent header, if valid, so that probes join the caller's trace.
+func contextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+
+	if tracer == nil {
+		return ctx
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+
+	var parent span
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanKey{}, &parent)
+}
+
+// set sets the attribute key of s to a string or int value.
+func (s *span) set(key string, value any) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// traceIDString returns the trace ID of s in hex, empty if s is nil.
+func (s *span) traceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// finish ends s, failed if err is set, and queues it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	tracer.add(s)
+}
+
+// spanExporter batches finished spans and sends them every few seconds.
+type spanExporter struct {
+	client *otlpClient
+
+	mu      sync.Mutex
+	pending []*span
+}
+
+func (e *spanExporter) add(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.pending) < maxPendingSpans {
+		e.pending = append(e.pending, s)
+	}
+}
+
+func (e *spanExporter) run() {
+	for range time.Tick(5 * time.Second) {
+		if err := e.flush(context.Background()); err != nil {
+			slog.Error("Exporting spans failed", "err", err)
+		}
+	}
+}
+
+// flush sends all pending spans. They are kept for the next attempt if the
+// collector is unreachable.
+func (e *spanExporter) flush(ctx context.Context) error {
+
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := e.client.export(ctx, "traces", otlpTraceRequest(spans)); err != nil {
+		e.mu.Lock()
+		e.pending = append(spans, e.pending...)
+		if len(e.pending) > maxPendingSpans {
+			e.pending = e.pending[len(e.pending)-maxPendingSpans:]
+		}
+		e.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// flushSpans sends the pending spans before the exporter exits.
+func flushSpans() {
+	if tracer == nil {
+		return
+	}
+	if err := tracer.flush(context.Background()); err != nil {
+		slog.Error("Exporting spans failed", "err", err)
+	}
+}
+
+// otlpTraceRequest encodes spans as an ExportTraceServiceRequest message.
+func otlpTraceRequest(spans []*span) []byte {
+
+	scopeSpans := protoMessage(nil, 1, otlpScope())
+	for _, s := range spans {
+		var b []byte
+		b = protoMessage(b, 1, s.traceID[:])
+		b = protoMessage(b, 2, s.spanID[:])
+		if s.parentID != [8]byte{} {
+			b = protoMessage(b, 4, s.parentID[:])
+		}
+		b = protoString(b, 5, s.name)
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s.kind))
+		b = protoFixed64(b, 7, uint64(s.start.UnixNano()))
+		b = protoFixed64(b, 8, uint64(s.end.UnixNano()))
+
+		for _, key := range sortedAnyKeys(s.attrs) {
+			var value []byte
+			switch v := s.attrs[key].(type) {
+			case int:
+				value = protowire.AppendTag(value, 3, protowire.VarintType)
+				value = protowire.AppendVarint(value, uint64(v))
+			default:
+				value = protowire.AppendTag(value, 1, protowire.BytesType)
+				value = protowire.AppendString(value, fmt.Sprint(v))
+			}
+
+			var kv []byte
+			kv = protoString(kv, 1, key)
+			kv = protoMessage(kv, 2, value)
+			b = protoMessage(b, 9, kv)
+		}
+
+		if s.err != nil {
+			const statusError = 2
+			var status []byte
+			status = protoString(status, 2, s.err.Error())
+			status = protowire.AppendTag(status, 3, protowire.VarintType)
+			status = protowire.AppendVarint(status, statusError)
+			b = protoMessage(b, 15, status)
+		}
+
+		scopeSpans = protoMessage(scopeSpans, 2, b)
+	}
+
+	var rs []byte
+	rs = protoMessage(rs, 1, otlpResource(nil))
+	rs = protoMessage(rs, 2, scopeSpans)
+
+	return protoMessage(nil, 1, rs)
+}
+
+func sortedAnyKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Age of the latest snapshot from which the dashboard shows a host as
+// yellow and red.
+var (
+	envUIWarningAge  = getEnvDuration("RESTIC_EXPORTER_UI_WARNING_AGE", 26*time.Hour)
+	envUICriticalAge = getEnvDuration("RESTIC_EXPORTER_UI_CRITICAL_AGE", 50*time.Hour)
+)
+
+var uiTemplate = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"age":   formatAge,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Restic Exporter &ndash; Backups</title>
+<meta http-equiv="refresh" content="60">
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+.state { display: inline-block; width: 0.8em; height: 0.8em; border-radius: 50%; }
+.green { background: #2e7d32; }
+.yellow { background: #f9a825; }
+.red { background: #c62828; }
+.grey { background: #9e9e9e; }
+.error { color: #c62828; }
+</style>
+</head>
+<body>
+<h1>Backups</h1>
+<p>Snapshots older than {{.WarningAge}} are yellow, older than {{.CriticalAge}} or failing red. Hosts not probed yet are grey.</p>
+<table>
+<tr><th></th><th>Repository</th><th>Host</th><th>Latest snapshot</th><th>Age</th><th>Size</th><th>Files</th><th>Check</th><th>Restore test</th></tr>
+{{range .Rows}}<tr>
+<td><span class="state {{.State}}" title="{{.State}}"></span></td>
+<td>{{.Repository}}</td>
+<td>{{.Host}}</td>
+{{if .Probed}}<td>{{if .Latest.IsZero}}none{{else}}{{.Latest.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{if not .Latest.IsZero}}{{age .Latest}}{{end}}</td>
+<td>{{if not .Latest.IsZero}}{{bytes .Size}}{{end}}</td>
+<td>{{if not .Latest.IsZero}}{{.Files}}{{end}}</td>
+{{else}}<td colspan="4">not probed yet</td>
+{{end}}<td>{{if .Check.IsZero}}&ndash;{{else if .CheckError}}<span class="error" title="{{.CheckError}}">failed</span>{{else}}ok{{end}}</td>
+<td>{{if .RestoreTest.IsZero}}&ndash;{{else if .RestoreTestError}}<span class="error" title="{{.RestoreTestError}}">failed</span>{{else}}ok{{end}}</td>
+</tr>
+{{if .LastError}}<tr><td></td><td colspan="8" class="error">{{.LastError}}</td></tr>
+{{end}}{{end}}</table>
+</body>
+</html>
+`))
+
+type uiRow struct {
+	hostStatus
+	Probed           bool
+	State            string
+	Check            time.Time
+	CheckError       string
+	RestoreTest      time.Time
+	RestoreTestError string
+}
+
+// uiHandler serves a dashboard of the freshness of each repository's hosts.
+// It shows the results of the latest probes and never runs restic itself.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+
+	now := time.Now()
+
+	var rows []uiRow
+	for _, repo := range currentConfig.Load().Repositories {
+		status := statusOf(repo.Name)
+
+		hosts := hostStatusesOf(repo.Name)
+		for _, target := range repo.targets() {
+			if !slices.ContainsFunc(hosts, func(h hostStatus) bool { return h.Host == target.Host }) {
+				hosts = append(hosts, hostStatus{Repository: repo.Name, Host: target.Host})
+			}
+		}
+
+		for _, h := range hosts {
+			row := uiRow{
+				hostStatus:       h,
+				Probed:           !h.LastProbe.IsZero(),
+				Check:            status.LastCheck,
+				CheckError:       status.CheckError,
+				RestoreTest:      status.LastRestoreTest,
+				RestoreTestError: status.RestoreTestError,
+			}
+			switch age := now.Sub(h.Latest); {
+			case !row.Probed:
+				row.State = "grey"
+			case h.LastError != "" || h.Latest.IsZero() || age >= envUICriticalAge:
+				row.State = "red"
+			case age >= envUIWarningAge:
+				row.State = "yellow"
+			default:
+				row.State = "green"
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := uiTemplate.Execute(w, struct {
+		WarningAge, CriticalAge time.Duration
+		Rows                    []uiRow
+	}{envUIWarningAge, envUICriticalAge, rows})
+	if err != nil {
+		slog.Error("Rendering dashboard failed", "err", err)
+	}
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatAge formats the time since t, rounded to minutes.
+func formatAge(t time.Time) string {
+	return time.Since(t).Round(time.Minute).String()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultConfig configures the HashiCorp Vault server repository secrets are
+// read from. The client authenticates with AppRole if configured, and with
+// the token in TokenFile or VAULT_TOKEN otherwise.
+type vaultConfig struct {
+	// Address defaults to VAULT_ADDR.
+	Address   string        `yaml:"address"`
+	TokenFile string        `yaml:"token_file"`
+	AppRole   *vaultAppRole `yaml:"approle"`
+
+	// RefreshInterval is the longest time secrets are used before being
+	// read again. Shorter token TTLs and secret leases take precedence.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	client *vaultClient
+}
+
+type vaultAppRole struct {
+	Mount        string `yaml:"mount"`
+	RoleID       string `yaml:"role_id"`
+	SecretIDFile string `yaml:"secret_id_file"`
+}
+
+// vaultSecret is a secret read from Vault for a repository. Env maps the
+// environment variables restic is run with, e.g. RESTIC_PASSWORD or
+// AWS_ACCESS_KEY_ID, to keys of the secret's data. Both KV version 2 and
+// dynamic secrets, such as the AWS secrets engine's, are supported.
+type vaultSecret struct {
+	Path string            `yaml:"path"`
+	Env  map[string]string `yaml:"env"`
+}
+
+// vaultResponse is the part of Vault's responses used by the exporter.
+type vaultResponse struct {
+	Data          map[string]interface{} `json:"data"`
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Auth          *vaultAuth             `json:"auth"`
+	Errors        []string               `json:"errors"`
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultClient struct {
+	cfg *vaultConfig
+
+	token     string
+	ttl       time.Duration
+	renewable bool
+
+	// next is when secrets need to be read again.
+	next time.Duration
+
+	// leases are the IDs of the dynamic secrets restic is run with, by
+	// repository. They are revoked once the secrets are replaced.
+	leasesMu sync.Mutex
+	leases   map[string][]string
+}
+
+// vaultLease is the lease of a dynamic secret. id is empty for KV secrets.
+type vaultLease struct {
+	id       string
+	duration time.Duration
+}
+
+// validate checks v and fills in defaults. used tells whether any repository
+// reads secrets from Vault.
+func (v *vaultConfig) validate(used bool) error {
+
+	if !used {
+		return nil
+	}
+
+	if v.Address == "" {
+		v.Address = os.Getenv("VAULT_ADDR")
+	}
+	if v.Address == "" {
+		return errors.New("address or VAULT_ADDR required")
+	}
+	if v.RefreshInterval == 0 {
+		v.RefreshInterval = 5 * time.Minute
+	}
+	if v.AppRole != nil {
+		if v.AppRole.RoleID == "" {
+			return errors.New("approle: role_id required")
+		}
+		if v.AppRole.Mount == "" {
+			v.AppRole.Mount = "approle"
+		}
+	}
+
+	v.client = &vaultClient{cfg: v}
+
+	return nil
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	url := strings.TrimSuffix(v.cfg.Address, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		var errResp vaultResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("vault: %s %s: %s %s", method, path, resp.Status, strings.Join(errResp.Errors, ", "))
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (v *vaultClient) setToken(auth *vaultAuth) {
+	v.token = auth.ClientToken
+	v.ttl = time.Duration(auth.LeaseDuration) * time.Second
+	v.renewable = auth.Renewable
+}
+
+// authenticate makes sure v holds a valid token. A renewable token is
+// renewed, otherwise a new one is obtained.
+func (v *vaultClient) authenticate(ctx context.Context) error {
+
+	if v.renewable {
+		var resp vaultResponse
+		err := v.do(ctx, http.MethodPost, "auth/token/renew-self", struct{}{}, &resp)
+		if err == nil && resp.Auth != nil {
+			v.setToken(resp.Auth)
+			return nil
+		}
+		slog.Warn("Renewing Vault token failed, authenticating again", "err", err)
+	}
+
+	if role := v.cfg.AppRole; role != nil {
+		login := map[string]string{"role_id": role.RoleID}
+		if role.SecretIDFile != "" {
+			secretID, err := os.ReadFile(role.SecretIDFile)
+			if err != nil {
+				return err
+			}
+			login["secret_id"] = strings.TrimSpace(string(secretID))
+		}
+
+		v.token = ""
+		var resp vaultResponse
+		if err := v.do(ctx, http.MethodPost, "auth/"+role.Mount+"/login", login, &resp); err != nil {
+			return err
+		}
+		if resp.Auth == nil {
+			return errors.New("vault: AppRole login returned no token")
+		}
+		v.setToken(resp.Auth)
+		return nil
+	}
+
+	// the file is read every time, so that a rotated token is picked up
+	token := os.Getenv("VAULT_TOKEN")
+	if v.cfg.TokenFile != "" {
+		data, err := os.ReadFile(v.cfg.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		return errors.New("vault: no token, set token_file, VAULT_TOKEN or approle")
+	}
+	v.token = token
+
+	var resp vaultResponse
+	if err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+		return err
+	}
+	ttl, _ := resp.Data["ttl"].(float64)
+	v.ttl = time.Duration(ttl) * time.Second
+	v.renewable, _ = resp.Data["renewable"].(bool)
+
+	return nil
+}
+
+// read returns the environment variables s maps from the secret at its path,
+// and the secret's lease.
+func (v *vaultClient) read(ctx context.Context, s vaultSecret) ([]string, vaultLease, error) {
+
+	var resp vaultResponse
+	if err := v.do(ctx, http.MethodGet, s.Path, nil, &resp); err != nil {
+		return nil, vaultLease{}, err
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		// KV version 2 wraps the secret in metadata
+		data = inner
+	}
+
+	var env []string
+	for name, key := range s.Env {
+		val, ok := data[key]
+		if !ok {
+			return nil, vaultLease{}, fmt.Errorf("vault: no key %q in %s", key, s.Path)
+		}
+		env = append(env, name+"="+fmt.Sprint(val))
+	}
+	sort.Strings(env)
+
+	return env, vaultLease{id: resp.LeaseID, duration: time.Duration(resp.LeaseDuration) * time.Second}, nil
+}
+
+// replaceLeases records leases as those of the secrets of repository and
+// revokes the ones they replace, so that superseded credentials, e.g. of the
+// AWS secrets engine, don't stay valid until their lease expires.
+func (v *vaultClient) replaceLeases(ctx context.Context, repository string, leases []string) {
+
+	v.leasesMu.Lock()
+	old := v.leases[repository]
+	if v.leases == nil {
+		v.leases = map[string][]string{}
+	}
+	v.leases[repository] = leases
+	v.leasesMu.Unlock()
+
+	v.revoke(ctx, old)
+}
+
+// revokeLeases revokes the leases of all secrets read by v.
+func (v *vaultClient) revokeLeases(ctx context.Context) {
+
+	v.leasesMu.Lock()
+	var leases []string
+	for _, l := range v.leases {
+		leases = append(leases, l...)
+	}
+	v.leases = nil
+	v.leasesMu.Unlock()
+
+	v.revoke(ctx, leases)
+}
+
+func (v *vaultClient) revoke(ctx context.Context, leases []string) {
+	for _, id := range leases {
+		if err := v.do(ctx, http.MethodPut, "sys/leases/revoke", map[string]string{"lease_id": id}, nil); err != nil {
+			// the lease still expires on its own
+			slog.Warn("Revoking Vault lease failed", "lease_id", id, "err", err)
+		}
+	}
+}
+
+// resolveVaultSecrets reads the Vault secrets of all repositories of c and
+// makes them available to restic.
+func (c *config) resolveVaultSecrets(ctx context.Context) error {
+
+	v := c.Vault.client
+	if v == nil {
+		return nil
+	}
+
+	if err := v.authenticate(ctx); err != nil {
+		return err
+	}
+
+	next := c.Vault.RefreshInterval
+	if v.ttl > 0 && v.ttl*2/3 < next {
+		next = v.ttl * 2 / 3
+	}
+
+	for _, repo := range c.Repositories {
+		var (
+			env    []string
+			leases []string
+		)
+		for _, s := range repo.VaultSecrets {
+			e, lease, err := v.read(ctx, s)
+			if err != nil {
+				// the leases read so far expire on their own
+				return fmt.Errorf("repository %q: %w", repo.Name, err)
+			}
+			env = append(env, e...)
+			if lease.id != "" {
+				leases = append(leases, lease.id)
+			}
+			if lease.duration > 0 && lease.duration*2/3 < next {
+				next = lease.duration * 2 / 3
+			}
+		}
+		repo.vaultEnv.Store(&env)
+		v.replaceLeases(ctx, repo.Name, leases)
+	}
+
+	v.next = max(next, 10*time.Second)
+
+	return nil
+}
+
+// refreshVaultSecrets reads the Vault secrets of c again before they or the
+// token expire, until ctx is done.
+func (c *config) refreshVaultSecrets(ctx context.Context) {
+
+	next := c.Vault.client.next
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+
+		if err := c.resolveVaultSecrets(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Refreshing Vault secrets failed", "err", err)
+			next = 30 * time.Second
+			continue
+		}
+		next = c.Vault.client.next
+	}
+}
+
+// revokeVaultLeases revokes the leases of the Vault secrets of the current
+// configuration, once restic no longer runs with them on shutdown.
+func revokeVaultLeases() {
+
+	cfg := currentConfig.Load()
+	if cfg == nil || cfg.Vault.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg.Vault.client.revokeLeases(ctx)
+}
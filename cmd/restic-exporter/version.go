@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// envMinResticVersion is the oldest restic release the exporter works with.
+// Repository format version 2 and `restic migrate` first appeared in 0.14.0.
+var envMinResticVersion = getEnv("RESTIC_EXPORTER_MIN_RESTIC_VERSION", "0.14.0")
+
+var resticVersionRe = regexp.MustCompile(`^restic (\S+) compiled with (\S+)`)
+
+type resticVersionData struct {
+	Version   string
+	GoVersion string
+}
+
+// checkResticVersion runs `restic version` and verifies the binary is recent
+// enough, so an outdated restic fails at startup rather than with obscure
+// errors while parsing its output.
+func checkResticVersion(ctx context.Context) (*resticVersionData, error) {
+
+	out, err := runRestic(ctx, nil, "version")
+	if err != nil {
+		return nil, fmt.Errorf("running %s version: %w", envResticBin, err)
+	}
+
+	m := resticVersionRe.FindStringSubmatch(strings.TrimSpace(string(out)))
+	if m == nil {
+		return nil, fmt.Errorf("unexpected output of %s version: %q", envResticBin, out)
+	}
+	v := &resticVersionData{Version: m[1], GoVersion: m[2]}
+
+	if compareVersions(v.Version, envMinResticVersion) < 0 {
+		return nil, fmt.Errorf("restic %s is too old, at least %s is required", v.Version, envMinResticVersion)
+	}
+
+	return v, nil
+}
+
+// resticVersionInfo returns a constant restic_version_info gauge for v.
+func resticVersionInfo(v *resticVersionData) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "restic",
+		Name:        "version_info",
+		Help:        "Version of the restic binary used by the exporter",
+		ConstLabels: prometheus.Labels{"version": v.Version, "go_version": v.GoVersion},
+	})
+	g.Set(1)
+	return g
+}
+
+// compareVersions compares dotted version strings numerically, ignoring
+// suffixes such as "-dev". It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func leadingInt(s string) int {
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		s = s[:end]
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -42,6 +42,15 @@
               '';
             };
 
+            webConfigFile = mkOption {
+              type = types.nullOr types.path;
+              default = null;
+              description = ''
+                Path to a prometheus exporter-toolkit web configuration file
+                enabling TLS for the exporter
+              '';
+            };
+
             user = mkOption {
               type = types.str;
               default = "restic-exporter";
@@ -65,7 +74,8 @@
                 User = cfg.user;
                 Group = cfg.group;
                 CacheDirectory = "restic-exporter";
-                ExecStart = "${self.packages."${pkgs.system}".default}/bin/restic-exporter";
+                ExecStart = "${self.packages."${pkgs.system}".default}/bin/restic-exporter"
+                  + optionalString (cfg.webConfigFile != null) " --web.config.file=${cfg.webConfigFile}";
                 Restart = "on-failure";
                 EnvironmentFile = mkIf (cfg.environmentFile != null) [ cfg.environmentFile ];
                 Environment = [
@@ -107,7 +117,15 @@
             pname = "restic-exporter";
             version = "1.0.0";
             src = self;
-            vendorSha256 = "sha256-WtO+3uH6H2um6pcdqhU/Yaw6HDNkz1XGjslGQphyMiA=";
+            subPackages = [ "cmd/restic-exporter" ];
+            vendorSha256 = "sha256-8+HNRb/Xn0uECDjt6d36Vu0mAdnXTlaGhu7Kye03og0=";
+            ldflags = [
+              "-s"
+              "-w"
+              "-X main.version=${version}"
+              "-X main.commit=${self.rev or "dirty"}"
+              "-X main.date=${self.lastModifiedDate or "unknown"}"
+            ];
             installCheckPhase = ''
               runHook preCheck
               $out/bin/restic-exporter -h
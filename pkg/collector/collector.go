@@ -0,0 +1,35 @@
+// Package collector runs restic, parses its JSON output and turns it into
+// Prometheus metrics. It is used by restic-exporter, and can be embedded by
+// other programs running restic, such as backup orchestrators.
+//
+// How restic is run is left to a Runner, which typically sets the
+// repository, password and cache directory through the environment.
+package collector
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Runner runs restic with args and returns its standard output.
+type Runner interface {
+	Run(ctx context.Context, args ...string) ([]byte, error)
+}
+
+// RunnerFunc adapts a function to a Runner.
+type RunnerFunc func(ctx context.Context, args ...string) ([]byte, error)
+
+func (f RunnerFunc) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return f(ctx, args...)
+}
+
+// Unmarshal runs restic with args and parses its JSON output into out.
+func Unmarshal(ctx context.Context, r Runner, out interface{}, args ...string) error {
+
+	stdOut, err := r.Run(ctx, args...)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(stdOut, out)
+}
@@ -0,0 +1,28 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixtureRunner returns a Runner answering the restic commands of outputs,
+// keyed by their arguments joined by spaces, with the content of a file in
+// testdata. An empty file name fails the command.
+func fixtureRunner(t *testing.T, outputs map[string]string) Runner {
+	return RunnerFunc(func(ctx context.Context, args ...string) ([]byte, error) {
+		cmd := strings.Join(args, " ")
+		name, ok := outputs[cmd]
+		if !ok {
+			t.Errorf("unexpected restic %s", cmd)
+			return nil, errors.New("unexpected command")
+		}
+		if name == "" {
+			return nil, errors.New("exit status 1")
+		}
+		return os.ReadFile(filepath.Join("testdata", name))
+	})
+}
@@ -0,0 +1,109 @@
+package collector
+
+import (
+	"slices"
+	"strings"
+)
+
+// Group is the snapshots sharing host name, paths and tags. Paths are
+// joined by ":" and tags by ",", as in metric labels.
+type Group struct {
+	Hostname string
+	Paths    string
+	Tags     string
+
+	Latest Snapshot
+	// Previous is the snapshot before Latest, if any.
+	Previous  *Snapshot
+	Snapshots int
+}
+
+// GroupSnapshots groups snapshots by host name, paths and tags, ordered by
+// the group labels.
+func GroupSnapshots(snapshots []Snapshot) []*Group {
+
+	byKey := map[[3]string]*Group{}
+	for _, s := range snapshots {
+		paths := slices.Clone(s.Paths)
+		slices.Sort(paths)
+		tags := slices.Clone(s.Tags)
+		slices.Sort(tags)
+
+		key := [3]string{s.Hostname, strings.Join(paths, ":"), strings.Join(tags, ",")}
+		g, ok := byKey[key]
+		if !ok {
+			g = &Group{Hostname: key[0], Paths: key[1], Tags: key[2]}
+			byKey[key] = g
+		}
+		switch {
+		case g.Snapshots == 0:
+			g.Latest = s
+		case s.Time.After(g.Latest.Time):
+			previous := g.Latest
+			g.Previous = &previous
+			g.Latest = s
+		case g.Previous == nil || s.Time.After(g.Previous.Time):
+			previous := s
+			g.Previous = &previous
+		}
+		g.Snapshots++
+	}
+
+	groups := make([]*Group, 0, len(byKey))
+	for _, g := range byKey {
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b *Group) int {
+		return strings.Compare(a.Hostname+"\x00"+a.Paths+"\x00"+a.Tags, b.Hostname+"\x00"+b.Paths+"\x00"+b.Tags)
+	})
+
+	return groups
+}
+
+// UserGroup is the snapshots of a host taken by the same user.
+type UserGroup struct {
+	Hostname string
+	Username string
+
+	Latest Snapshot
+	// Previous is the snapshot before Latest, if any.
+	Previous  *Snapshot
+	Snapshots int
+}
+
+// GroupSnapshotsByUser groups snapshots by host name and user name, ordered
+// by them.
+func GroupSnapshotsByUser(snapshots []Snapshot) []*UserGroup {
+
+	byKey := map[[2]string]*UserGroup{}
+	for _, s := range snapshots {
+		key := [2]string{s.Hostname, s.Username}
+		g, ok := byKey[key]
+		if !ok {
+			g = &UserGroup{Hostname: key[0], Username: key[1]}
+			byKey[key] = g
+		}
+		switch {
+		case g.Snapshots == 0:
+			g.Latest = s
+		case s.Time.After(g.Latest.Time):
+			previous := g.Latest
+			g.Previous = &previous
+			g.Latest = s
+		case g.Previous == nil || s.Time.After(g.Previous.Time):
+			previous := s
+			g.Previous = &previous
+		}
+		g.Snapshots++
+	}
+
+	groups := make([]*UserGroup, 0, len(byKey))
+	for _, g := range byKey {
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b *UserGroup) int {
+		return strings.Compare(a.Hostname+"\x00"+a.Username, b.Hostname+"\x00"+b.Username)
+	})
+
+	return groups
+}
@@ -0,0 +1,99 @@
+package collector
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGroupSnapshots(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/snapshots_all.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := ParseSnapshots(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname, paths, tags string
+		latest, previous      string
+		snapshots             int
+	}{
+		// paths are grouped regardless of their order
+		{hostname: "ahorn", paths: "/etc:/home", tags: "daily", latest: "a3", previous: "a2", snapshots: 3},
+		{hostname: "ahorn", paths: "/home", tags: "before-upgrade,manual", latest: "a4", snapshots: 1},
+		{hostname: "birke", paths: "/srv", latest: "b1", snapshots: 1},
+	}
+
+	groups := GroupSnapshots(snapshots)
+	if len(groups) != len(tests) {
+		t.Fatalf("GroupSnapshots() returned %d groups, want %d", len(groups), len(tests))
+	}
+	for i, tt := range tests {
+		g := groups[i]
+		if g.Hostname != tt.hostname || g.Paths != tt.paths || g.Tags != tt.tags {
+			t.Errorf("group %d = %s %s %s, want %s %s %s", i, g.Hostname, g.Paths, g.Tags, tt.hostname, tt.paths, tt.tags)
+		}
+		if g.Latest.ID != tt.latest {
+			t.Errorf("group %d: latest = %s, want %s", i, g.Latest.ID, tt.latest)
+		}
+		var previous string
+		if g.Previous != nil {
+			previous = g.Previous.ID
+		}
+		if previous != tt.previous {
+			t.Errorf("group %d: previous = %q, want %q", i, previous, tt.previous)
+		}
+		if g.Snapshots != tt.snapshots {
+			t.Errorf("group %d: snapshots = %d, want %d", i, g.Snapshots, tt.snapshots)
+		}
+	}
+}
+
+func TestGroupSnapshotsByUser(t *testing.T) {
+
+	data, err := os.ReadFile("testdata/snapshots_all.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := ParseSnapshots(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname, username string
+		latest, previous   string
+		snapshots          int
+	}{
+		{hostname: "ahorn", username: "alice", latest: "a4", snapshots: 1},
+		{hostname: "ahorn", username: "root", latest: "a3", previous: "a2", snapshots: 3},
+		{hostname: "birke", username: "backup", latest: "b1", snapshots: 1},
+	}
+
+	groups := GroupSnapshotsByUser(snapshots)
+	if len(groups) != len(tests) {
+		t.Fatalf("GroupSnapshotsByUser() returned %d groups, want %d", len(groups), len(tests))
+	}
+	for i, tt := range tests {
+		g := groups[i]
+		if g.Hostname != tt.hostname || g.Username != tt.username {
+			t.Errorf("group %d = %s %s, want %s %s", i, g.Hostname, g.Username, tt.hostname, tt.username)
+		}
+		if g.Latest.ID != tt.latest {
+			t.Errorf("group %d: latest = %s, want %s", i, g.Latest.ID, tt.latest)
+		}
+		var previous string
+		if g.Previous != nil {
+			previous = g.Previous.ID
+		}
+		if previous != tt.previous {
+			t.Errorf("group %d: previous = %q, want %q", i, previous, tt.previous)
+		}
+		if g.Snapshots != tt.snapshots {
+			t.Errorf("group %d: snapshots = %d, want %d", i, g.Snapshots, tt.snapshots)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package collector
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultSnapshotLabels are the labels of the snapshot metrics unless others
+// are chosen.
+var DefaultSnapshotLabels = []string{"hostname", "paths", "tags"}
+
+// snapshotLabelValues returns the value of each snapshot label.
+var snapshotLabelValues = map[string]func(s Snapshot) string{
+	"hostname": func(s Snapshot) string { return s.Hostname },
+	"paths":    func(s Snapshot) string { return strings.Join(s.Paths, ":") },
+	"tags":     func(s Snapshot) string { return strings.Join(s.Tags, ",") },
+	"username": func(s Snapshot) string { return s.Username },
+	"id":       func(s Snapshot) string { return s.ID },
+	"short_id": func(s Snapshot) string { return s.ShortID },
+}
+
+// IsSnapshotLabel returns whether name is one of the snapshot labels:
+// hostname, paths, tags, username, id and short_id.
+func IsSnapshotLabel(name string) bool {
+	_, ok := snapshotLabelValues[name]
+	return ok
+}
+
+// SnapshotLabelValues returns the values of the snapshot labels names for
+// s.
+func SnapshotLabelValues(s Snapshot, names []string) []string {
+
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		values = append(values, snapshotLabelValues[name](s))
+	}
+
+	return values
+}
+
+// SnapshotSeries returns the values of the snapshot labels names of the
+// series of s. With splitPaths, snapshots of several paths get a series for
+// each path, labelled with the single path, if names include paths.
+func SnapshotSeries(s Snapshot, names []string, splitPaths bool) [][]string {
+
+	if !splitPaths || len(s.Paths) < 2 || !slices.Contains(names, "paths") {
+		return [][]string{SnapshotLabelValues(s, names)}
+	}
+
+	series := make([][]string, 0, len(s.Paths))
+	for _, path := range s.Paths {
+		single := s
+		single.Paths = []string{path}
+		series = append(series, SnapshotLabelValues(single, names))
+	}
+
+	return series
+}
+
+// InfoLabels returns the labels of restic_snapshots_latest_info,
+// snapshotLabels and short_id.
+func InfoLabels(snapshotLabels []string) []string {
+
+	if slices.Contains(snapshotLabels, "short_id") {
+		return snapshotLabels
+	}
+
+	return append(slices.Clip(snapshotLabels), "short_id")
+}
+
+// ProbeMetrics are the metrics of a probe. They are a prometheus.Collector.
+type ProbeMetrics struct {
+	// SplitPaths reports snapshots of several paths as a series for each
+	// path. Sizes and file counts are those of the whole snapshot.
+	SplitPaths bool
+
+	snapshotLabels []string
+	infoLabels     []string
+
+	snapshotsLatestTime *prometheus.GaugeVec
+	snapshotsLatestInfo *prometheus.GaugeVec
+	latestTotalFiles    *prometheus.GaugeVec
+	latestTotalSize     *prometheus.GaugeVec
+	scrapeError         prometheus.Gauge
+}
+
+// NewProbeMetrics returns the metrics of a probe with labels added. The
+// snapshot metrics are labelled with snapshotLabels, DefaultSnapshotLabels
+// if none are given. Unknown snapshot labels are an error.
+func NewProbeMetrics(labels prometheus.Labels, snapshotLabels ...string) (*ProbeMetrics, error) {
+
+	if len(snapshotLabels) == 0 {
+		snapshotLabels = DefaultSnapshotLabels
+	}
+	for _, name := range snapshotLabels {
+		if !IsSnapshotLabel(name) {
+			return nil, fmt.Errorf("unknown snapshot label %q", name)
+		}
+	}
+
+	return &ProbeMetrics{
+		snapshotLabels: snapshotLabels,
+		infoLabels:     InfoLabels(snapshotLabels),
+
+		snapshotsLatestTime: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "restic",
+				Subsystem:   "snapshots",
+				Name:        "latest_time",
+				Help:        "Time of the latest snapshot",
+				ConstLabels: labels,
+			},
+			snapshotLabels,
+		),
+		snapshotsLatestInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "restic",
+				Subsystem:   "snapshots",
+				Name:        "latest_info",
+				Help:        "Latest snapshot, labelled with its short ID",
+				ConstLabels: labels,
+			},
+			InfoLabels(snapshotLabels),
+		),
+		latestTotalFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "restic",
+				Subsystem:   "stats",
+				Name:        "latest_total_nfiles",
+				Help:        "Number of files",
+				ConstLabels: labels,
+			},
+			snapshotLabels,
+		),
+		latestTotalSize: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "restic",
+				Subsystem:   "stats",
+				Name:        "latest_total_size",
+				Help:        "Total Size",
+				ConstLabels: labels,
+			},
+			snapshotLabels,
+		),
+		scrapeError: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   "restic",
+				Name:        "scrape_error",
+				Help:        "Whether running restic for the probe failed",
+				ConstLabels: labels,
+			},
+		),
+	}, nil
+}
+
+// NewProbeRegistry returns a registry holding the metrics of a probe with
+// labels added, and the snapshot metrics labelled with snapshotLabels.
+func NewProbeRegistry(labels prometheus.Labels, snapshotLabels ...string) (*prometheus.Registry, *ProbeMetrics, error) {
+
+	m, err := NewProbeMetrics(labels, snapshotLabels...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(m)
+
+	return registry, m, nil
+}
+
+func (m *ProbeMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.latestTotalSize.Describe(ch)
+	m.latestTotalFiles.Describe(ch)
+	m.snapshotsLatestTime.Describe(ch)
+	m.snapshotsLatestInfo.Describe(ch)
+	m.scrapeError.Describe(ch)
+}
+
+func (m *ProbeMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.latestTotalSize.Collect(ch)
+	m.latestTotalFiles.Collect(ch)
+	m.snapshotsLatestTime.Collect(ch)
+	m.snapshotsLatestInfo.Collect(ch)
+	m.scrapeError.Collect(ch)
+}
+
+// Set sets the metrics to the result of a probe. If err is set, only
+// restic_scrape_error is reported.
+func (m *ProbeMetrics) Set(res *Result, err error) {
+
+	if err != nil {
+		m.scrapeError.Set(1)
+		return
+	}
+	if len(res.Snapshots) == 0 {
+		return
+	}
+
+	s := res.Snapshots[0]
+	for _, values := range SnapshotSeries(s, m.snapshotLabels, m.SplitPaths) {
+		m.latestTotalSize.WithLabelValues(values...).Set(float64(res.Stats.TotalSize))
+		m.latestTotalFiles.WithLabelValues(values...).Set(float64(res.Stats.TotalFileCount))
+		m.snapshotsLatestTime.WithLabelValues(values...).Set(float64(s.Time.Unix()))
+	}
+	for _, values := range SnapshotSeries(s, m.infoLabels, m.SplitPaths) {
+		m.snapshotsLatestInfo.WithLabelValues(values...).Set(1)
+	}
+}
+
+// SetGroups sets the metrics to the results of a probe by group. If err is
+// set, only restic_scrape_error is reported.
+func (m *ProbeMetrics) SetGroups(results []GroupResult, err error) {
+
+	if err != nil {
+		m.scrapeError.Set(1)
+		return
+	}
+
+	for i := range results {
+		m.Set(&results[i].Result, nil)
+	}
+}
@@ -0,0 +1,29 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewProbeMetrics(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		snapshotLabels []string
+		wantErr        bool
+	}{
+		{name: "default"},
+		{name: "chosen", snapshotLabels: []string{"hostname", "username", "id"}},
+		{name: "unknown", snapshotLabels: []string{"hostname", "uid"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewProbeMetrics(prometheus.Labels{"repository": "local"}, tt.snapshotLabels...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProbeMetrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
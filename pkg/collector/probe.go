@@ -0,0 +1,173 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Filter selects snapshots by host, path and tags. Empty fields match all
+// snapshots.
+type Filter struct {
+	Host string
+	Path string
+	Tags []string
+}
+
+// Args returns the restic arguments selecting the snapshots of f.
+func (f Filter) Args() []string {
+
+	var args []string
+	if f.Host != "" {
+		args = append(args, "--host", f.Host)
+	}
+	if f.Path != "" {
+		args = append(args, "--path", f.Path)
+	}
+	for _, tag := range f.Tags {
+		args = append(args, "--tag", tag)
+	}
+
+	return args
+}
+
+// Latest returns the latest snapshot matching f and its stats.
+func Latest(ctx context.Context, r Runner, f Filter) (*Result, error) {
+
+	args := append([]string{"latest", "--json"}, f.Args()...)
+
+	var res Result
+	if err := Unmarshal(ctx, r, &res.Stats, append([]string{"stats"}, args...)...); err != nil {
+		return &res, err
+	}
+	err := Unmarshal(ctx, r, &res.Snapshots, append([]string{"snapshots"}, args...)...)
+
+	return &res, err
+}
+
+// HostResult is the result of probing a host.
+type HostResult struct {
+	Host   string
+	Result Result
+	Err    error
+}
+
+// LatestByHost returns the latest snapshot of each of hosts matching path
+// and tags, and its stats. The snapshots of all hosts are listed by a
+// single restic call. Stats are taken from the snapshot summaries restic
+// 0.17 and later record, and only requested from restic for older
+// snapshots. The error returned is the first of any host.
+func LatestByHost(ctx context.Context, r Runner, hosts []string, path string, tags []string) (results []HostResult, err error) {
+
+	args := []string{"snapshots", "--json", "--latest", "1", "--group-by", "host"}
+	for _, host := range hosts {
+		args = append(args, "--host", host)
+	}
+	args = append(args, Filter{Path: path, Tags: tags}.Args()...)
+
+	var groups []SnapshotGroup
+	listErr := Unmarshal(ctx, r, &groups, args...)
+
+	latest := map[string]Snapshot{}
+	for _, g := range groups {
+		for _, s := range g.Snapshots {
+			if l, ok := latest[s.Hostname]; !ok || s.Time.After(l.Time) {
+				latest[s.Hostname] = s
+			}
+		}
+	}
+
+	for _, host := range hosts {
+		res := HostResult{Host: host, Err: listErr}
+		if s, ok := latest[host]; ok && listErr == nil {
+			res.Result.Snapshots = []Snapshot{s}
+			res.Result.Stats, res.Err = snapshotStats(ctx, r, s)
+		}
+		if err == nil {
+			err = res.Err
+		}
+		results = append(results, res)
+	}
+
+	return results, err
+}
+
+// snapshotStats returns the stats of s, from its summary if restic recorded
+// one.
+func snapshotStats(ctx context.Context, r Runner, s Snapshot) (Stats, error) {
+
+	var stats Stats
+	if s.Summary != nil {
+		stats.TotalSize = int(s.Summary.TotalBytesProcessed)
+		stats.TotalFileCount = s.Summary.TotalFilesProcessed
+		return stats, nil
+	}
+
+	err := Unmarshal(ctx, r, &stats, "stats", s.ID, "--json")
+
+	return stats, err
+}
+
+// GroupFields are the fields snapshots can be grouped by, as understood by
+// restic's --group-by.
+var GroupFields = []string{"host", "paths", "tags"}
+
+// GroupLabels returns the snapshot labels of the fields of groupBy.
+func GroupLabels(groupBy []string) []string {
+
+	labels := make([]string, 0, len(groupBy))
+	for _, field := range groupBy {
+		if field == "host" {
+			field = "hostname"
+		}
+		labels = append(labels, field)
+	}
+
+	return labels
+}
+
+// GroupResult is the latest snapshot of a snapshot group and its stats.
+type GroupResult struct {
+	Key    GroupKey
+	Result Result
+}
+
+// LatestByGroup groups the snapshots matching f by the fields of groupBy,
+// and returns the latest snapshot of each group and its stats, taken from
+// the snapshot summaries where possible.
+func LatestByGroup(ctx context.Context, r Runner, f Filter, groupBy []string) ([]GroupResult, error) {
+
+	for _, field := range groupBy {
+		if !slices.Contains(GroupFields, field) {
+			return nil, fmt.Errorf("unknown group field %q", field)
+		}
+	}
+
+	args := []string{"snapshots", "--json", "--latest", "1", "--group-by", strings.Join(groupBy, ",")}
+	var groups []SnapshotGroup
+	if err := Unmarshal(ctx, r, &groups, append(args, f.Args()...)...); err != nil {
+		return nil, err
+	}
+
+	var results []GroupResult
+	for _, g := range groups {
+		if len(g.Snapshots) == 0 {
+			continue
+		}
+		latest := g.Snapshots[0]
+		for _, s := range g.Snapshots[1:] {
+			if s.Time.After(latest.Time) {
+				latest = s
+			}
+		}
+
+		stats, err := snapshotStats(ctx, r, latest)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, GroupResult{Key: g.GroupKey, Result: Result{Stats: stats, Snapshots: []Snapshot{latest}}})
+	}
+
+	return results, nil
+}
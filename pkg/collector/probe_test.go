@@ -0,0 +1,226 @@
+package collector
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatest(t *testing.T) {
+
+	const (
+		stats     = "stats latest --json --host ahorn --tag daily"
+		snapshots = "snapshots latest --json --host ahorn --tag daily"
+	)
+
+	tests := []struct {
+		name      string
+		outputs   map[string]string
+		wantErr   bool
+		wantStats Stats
+		wantID    string
+	}{
+		{
+			name:      "found",
+			outputs:   map[string]string{stats: "stats.json", snapshots: "snapshots.json"},
+			wantStats: Stats{TotalSize: 1073741824, TotalFileCount: 52817},
+			wantID:    "4e8e0b6a",
+		},
+		{
+			name:    "stats fail",
+			outputs: map[string]string{stats: ""},
+			wantErr: true,
+		},
+		{
+			name:      "snapshots fail",
+			outputs:   map[string]string{stats: "stats.json", snapshots: ""},
+			wantErr:   true,
+			wantStats: Stats{TotalSize: 1073741824, TotalFileCount: 52817},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Latest(context.Background(), fixtureRunner(t, tt.outputs), Filter{Host: "ahorn", Tags: []string{"daily"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Latest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if res.Stats != tt.wantStats {
+				t.Errorf("Latest() stats = %+v, want %+v", res.Stats, tt.wantStats)
+			}
+			if tt.wantID == "" {
+				return
+			}
+			if len(res.Snapshots) != 1 {
+				t.Fatalf("Latest() returned %d snapshots, want 1", len(res.Snapshots))
+			}
+			s := res.Snapshots[0]
+			if s.ShortID != tt.wantID {
+				t.Errorf("Latest() snapshot = %s, want %s", s.ShortID, tt.wantID)
+			}
+			if want := time.Date(2024, 5, 10, 1, 0, 12, 345678000, time.UTC); !s.Time.Equal(want) {
+				t.Errorf("Latest() snapshot time = %v, want %v", s.Time, want)
+			}
+		})
+	}
+}
+
+func TestLatestByHost(t *testing.T) {
+
+	const (
+		list  = "snapshots --json --latest 1 --group-by host --host ahorn --host birke --host eiche --path /home"
+		stats = "stats 9f1c2d3e4b5a6978a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3 --json"
+	)
+
+	type host struct {
+		id      string
+		stats   Stats
+		wantErr bool
+	}
+	tests := []struct {
+		name    string
+		outputs map[string]string
+		wantErr bool
+		want    map[string]host
+	}{
+		{
+			name:    "summaries and stats",
+			outputs: map[string]string{list: "snapshots_by_host.json", stats: "stats.json"},
+			want: map[string]host{
+				// restic 0.17 summary
+				"ahorn": {id: "4e8e0b6a", stats: Stats{TotalSize: 3500000, TotalFileCount: 1200}},
+				// no summary, stats from restic
+				"birke": {id: "9f1c2d3e", stats: Stats{TotalSize: 1073741824, TotalFileCount: 52817}},
+				// no snapshots
+				"eiche": {},
+			},
+		},
+		{
+			name:    "stats fail",
+			outputs: map[string]string{list: "snapshots_by_host.json", stats: ""},
+			wantErr: true,
+			want: map[string]host{
+				"ahorn": {id: "4e8e0b6a", stats: Stats{TotalSize: 3500000, TotalFileCount: 1200}},
+				"birke": {id: "9f1c2d3e", wantErr: true},
+				"eiche": {},
+			},
+		},
+		{
+			name:    "listing fails",
+			outputs: map[string]string{list: ""},
+			wantErr: true,
+			want: map[string]host{
+				"ahorn": {wantErr: true},
+				"birke": {wantErr: true},
+				"eiche": {wantErr: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := LatestByHost(context.Background(), fixtureRunner(t, tt.outputs), []string{"ahorn", "birke", "eiche"}, "/home", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LatestByHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(results) != len(tt.want) {
+				t.Fatalf("LatestByHost() returned %d results, want %d", len(results), len(tt.want))
+			}
+			for _, res := range results {
+				want, ok := tt.want[res.Host]
+				if !ok {
+					t.Errorf("LatestByHost() returned unexpected host %s", res.Host)
+					continue
+				}
+				if (res.Err != nil) != want.wantErr {
+					t.Errorf("%s: error = %v, wantErr %v", res.Host, res.Err, want.wantErr)
+				}
+				var id string
+				if len(res.Result.Snapshots) != 0 {
+					id = res.Result.Snapshots[0].ShortID
+				}
+				if id != want.id {
+					t.Errorf("%s: snapshot = %q, want %q", res.Host, id, want.id)
+				}
+				if res.Result.Stats != want.stats {
+					t.Errorf("%s: stats = %+v, want %+v", res.Host, res.Result.Stats, want.stats)
+				}
+			}
+		})
+	}
+}
+
+func TestLatestByGroup(t *testing.T) {
+
+	const (
+		list  = "snapshots --json --latest 1 --group-by paths --tag daily"
+		stats = "stats 3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d --json"
+	)
+
+	type group struct {
+		paths string
+		id    string
+		stats Stats
+	}
+	tests := []struct {
+		name    string
+		groupBy []string
+		outputs map[string]string
+		wantErr bool
+		want    []group
+	}{
+		{
+			name:    "latest of each group",
+			groupBy: []string{"paths"},
+			outputs: map[string]string{list: "snapshots_by_paths.json", stats: "stats.json"},
+			want: []group{
+				{paths: "/etc", id: "2b3c4d5e", stats: Stats{TotalSize: 1900000, TotalFileCount: 280}},
+				{paths: "/home", id: "3c4d5e6f", stats: Stats{TotalSize: 1073741824, TotalFileCount: 52817}},
+			},
+		},
+		{
+			name:    "stats fail",
+			groupBy: []string{"paths"},
+			outputs: map[string]string{list: "snapshots_by_paths.json", stats: ""},
+			wantErr: true,
+			want: []group{
+				{paths: "/etc", id: "2b3c4d5e", stats: Stats{TotalSize: 1900000, TotalFileCount: 280}},
+			},
+		},
+		{
+			name:    "listing fails",
+			groupBy: []string{"paths"},
+			outputs: map[string]string{list: ""},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			groupBy: []string{"username"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := LatestByGroup(context.Background(), fixtureRunner(t, tt.outputs), Filter{Tags: []string{"daily"}}, tt.groupBy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LatestByGroup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(results) != len(tt.want) {
+				t.Fatalf("LatestByGroup() returned %d results, want %d", len(results), len(tt.want))
+			}
+			for i, want := range tt.want {
+				res := results[i]
+				if got := res.Key.Paths; len(got) != 1 || got[0] != want.paths {
+					t.Errorf("group %d: paths = %v, want %s", i, got, want.paths)
+				}
+				if got := res.Result.Snapshots[0].ShortID; got != want.id {
+					t.Errorf("group %d: snapshot = %s, want %s", i, got, want.id)
+				}
+				if res.Result.Stats != want.stats {
+					t.Errorf("group %d: stats = %+v, want %+v", i, res.Result.Stats, want.stats)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Snapshot is a snapshot as listed by `restic snapshots --json`.
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	Parent   string    `json:"parent"`
+	Tree     string    `json:"tree"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+	Hostname string    `json:"hostname"`
+	Username string    `json:"username"`
+	ID       string    `json:"id"`
+	ShortID  string    `json:"short_id"`
+
+	Summary *SnapshotSummary `json:"summary,omitempty"`
+}
+
+// SnapshotSummary is the summary restic 0.17 and later record in snapshots
+// about the backup creating them.
+type SnapshotSummary struct {
+	BackupStart         time.Time `json:"backup_start"`
+	BackupEnd           time.Time `json:"backup_end"`
+	FilesNew            int       `json:"files_new"`
+	FilesChanged        int       `json:"files_changed"`
+	FilesUnmodified     int       `json:"files_unmodified"`
+	DirsNew             int       `json:"dirs_new"`
+	DirsChanged         int       `json:"dirs_changed"`
+	DirsUnmodified      int       `json:"dirs_unmodified"`
+	DataBlobs           int       `json:"data_blobs"`
+	TreeBlobs           int       `json:"tree_blobs"`
+	DataAdded           int64     `json:"data_added"`
+	DataAddedPacked     int64     `json:"data_added_packed"`
+	TotalFilesProcessed int       `json:"total_files_processed"`
+	TotalBytesProcessed int64     `json:"total_bytes_processed"`
+}
+
+// SnapshotGroup is a group listed by `restic snapshots --json --group-by`.
+// Only the grouping fields are set in the key.
+type SnapshotGroup struct {
+	GroupKey  GroupKey   `json:"group_key"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// GroupKey holds the fields snapshots are grouped by.
+type GroupKey struct {
+	Hostname string   `json:"hostname"`
+	Paths    []string `json:"paths"`
+	Tags     []string `json:"tags"`
+}
+
+// Stats are the statistics printed by `restic stats --json` in the default
+// restore-size mode.
+type Stats struct {
+	TotalSize      int `json:"total_size"`
+	TotalFileCount int `json:"total_file_count"`
+}
+
+// Result is the latest snapshot matching a probe, if any, and its stats.
+type Result struct {
+	Stats     Stats
+	Snapshots []Snapshot
+}
+
+// ParseSnapshots parses the output of `restic snapshots --json`.
+func ParseSnapshots(data []byte) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := json.Unmarshal(data, &snapshots)
+	return snapshots, err
+}
+
+// ParseSnapshotGroups parses the output of `restic snapshots --json
+// --group-by`.
+func ParseSnapshotGroups(data []byte) ([]SnapshotGroup, error) {
+	var groups []SnapshotGroup
+	err := json.Unmarshal(data, &groups)
+	return groups, err
+}
+
+// ParseStats parses the output of `restic stats --json`.
+func ParseStats(data []byte) (*Stats, error) {
+	var stats Stats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// ParseTime parses timestamps restic prints in local time without a zone,
+// such as the creation time of keys, as well as RFC 3339 ones.
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+}